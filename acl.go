@@ -0,0 +1,93 @@
+package fastlike
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+)
+
+// ACLEntry is a prefix in an ACL, along with the action for addresses it contains (usually "ALLOW"
+// or "BLOCK")
+type ACLEntry struct {
+	Prefix string `json:"prefix"`
+	Action string `json:"action"`
+}
+
+// ReadACL reads ACL entries from a JSON file in the same format as Fastly's API uses:
+//
+//	{"entries": [{"prefix": "192.0.2.0/24", "action": "BLOCK"}]}
+func ReadACL(path string) ([]ACLEntry, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var content struct {
+		Entries []ACLEntry `json:"entries"`
+	}
+	if err := json.NewDecoder(fd).Decode(&content); err != nil {
+		return nil, err
+	}
+
+	for _, e := range content.Entries {
+		if _, err := parsePrefix(e.Prefix); err != nil {
+			return nil, fmt.Errorf("acl: invalid prefix %q in %s", e.Prefix, path)
+		}
+	}
+
+	return content.Entries, nil
+}
+
+// acl matches addresses against the prefixes in an ACL
+type acl struct {
+	name  string
+	table *prefixTable
+}
+
+func newACL(name string, entries []ACLEntry) acl {
+	table := &prefixTable{}
+	for _, e := range entries {
+		// Invalid prefixes can't match anything, so they're left out
+		network, err := parsePrefix(e.Prefix)
+		if err != nil {
+			continue
+		}
+		table.add(network, ACLEntry{Prefix: network.String(), Action: e.Action})
+	}
+
+	table.sort()
+	return acl{name, table}
+}
+
+// lookup returns the entry for the longest prefix containing ip, if there is one
+func (a acl) lookup(ip net.IP) (ACLEntry, bool) {
+	e, ok := a.table.lookup(ip)
+	if !ok {
+		return ACLEntry{}, false
+	}
+	return e.(ACLEntry), true
+}
+
+func (i *Instance) addACL(name string, entries []ACLEntry) {
+	i.acls = append(i.acls, newACL(name, entries))
+}
+
+func (i *Instance) getACLHandle(name string) int {
+	for j, a := range i.acls {
+		if a.name == name {
+			return j
+		}
+	}
+
+	return HandleInvalid
+}
+
+func (i *Instance) getACL(handle int) *acl {
+	if handle < 0 || handle > len(i.acls)-1 {
+		return nil
+	}
+
+	return &i.acls[handle]
+}
@@ -0,0 +1,82 @@
+package fastlike_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/Khan/fastlike"
+)
+
+// The status codes aclWat responds with, which are 200 plus the ACL error
+const (
+	aclMatch   = 201
+	aclNoMatch = 202
+)
+
+// aclWat looks up some address octets in the "acl" ACL, and responds with the matching entry and a
+// status of 200 plus the ACL error. Use it with fmt.Sprintf, supplying the octets as a WebAssembly
+// string and how many there are.
+var aclWat = guest(`
+	(import "fastly_acl" "open" (func $open (param i32 i32 i32) (result i32)))
+	(import "fastly_acl" "lookup" (func $lookup (param i32 i32 i32 i32 i32) (result i32)))`, `
+	(data (i32.const 1024) "acl")
+	(data (i32.const 1040) "%s")
+	(func (export "_start")
+		(drop (call $open (i32.const 1024) (i32.const 3) (i32.const 0)))
+		(drop (call $lookup (i32.load (i32.const 0)) (i32.const 1040) (i32.const %d) (i32.const 4) (i32.const 16)))
+		(if (i32.eq (i32.load (i32.const 16)) (i32.const 1))
+			(then
+				(call $respond (i32.const 201) (i32.load (i32.const 4))))
+			(else
+				(call $respond (i32.add (i32.const 200) (i32.load (i32.const 16))) (call $body)))))`)
+
+func TestACL(t *testing.T) {
+	t.Parallel()
+
+	data := `{"entries": [
+		{"prefix": "192.0.2.0/24", "action": "BLOCK"},
+		{"prefix": "192.0.2.128/25", "action": "ALLOW"},
+		{"prefix": "192.0.2.200", "action": "BLOCK"},
+		{"prefix": "2001:db8::/32", "action": "ALLOW"}
+	]}`
+	path := filepath.Join(t.TempDir(), "acl.json")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("expected no error, got %s", err.Error())
+	}
+
+	entries, err := fastlike.ReadACL(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err.Error())
+	}
+
+	// Each address is expected to match the most specific entry containing it, which the guest
+	// responds with as JSON
+	cases := []struct {
+		ip     string
+		prefix string
+		action string
+	}{
+		{"192.0.2.1", "192.0.2.0/24", "BLOCK"},
+		{"192.0.2.129", "192.0.2.128/25", "ALLOW"},
+		{"192.0.2.200", "192.0.2.200/32", "BLOCK"},
+		{"2001:db8::1", "2001:db8::/32", "ALLOW"},
+		{"203.0.113.1", "", ""},
+	}
+
+	for _, c := range cases {
+		ip := net.ParseIP(c.ip)
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		h := newGuest(t, fmt.Sprintf(aclWat, watBytes(ip), len(ip)), fastlike.WithACL("acl", entries))
+
+		if c.prefix == "" {
+			expectResponse(t, c.ip, h, aclNoMatch, "")
+		} else {
+			expectResponse(t, c.ip, h, aclMatch, fmt.Sprintf(`{"prefix":%q,"action":%q}`, c.prefix, c.action))
+		}
+	}
+}
@@ -2,20 +2,237 @@ package fastlike
 
 import (
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 )
 
-func (i *Instance) addBackend(name string, h http.Handler) {
-	i.backends[name] = h
+// Backend describes a backend the guest can send requests to. Only Name and Handler are needed to
+// send requests; the rest is what the guest sees when it inspects the backend with the fastly_backend
+// hostcalls.
+type Backend struct {
+	Name    string
+	Handler http.Handler
+
+	// Target is the address of the backend, as host:port. The port defaults to 443 if UseSSL is set,
+	// or 80 otherwise.
+	Target string
+
+	// HostOverride, if set, is the Host header the backend expects
+	HostOverride string
+
+	// The timeouts for the backend. Any that aren't set are reported as Fastly's defaults.
+	ConnectTimeout      time.Duration
+	FirstByteTimeout    time.Duration
+	BetweenBytesTimeout time.Duration
+
+	// UseSSL means the backend is reached over TLS, with versions between SSLMinVersion and
+	// SSLMaxVersion, as tls.VersionTLS10 and so on
+	UseSSL        bool
+	SSLMinVersion uint16
+	SSLMaxVersion uint16
+
+	// Health reports whether the backend is healthy. If it's nil, the health is BackendHealthUnknown.
+	Health func() BackendHealth
+}
+
+// BackendHealth is the health of a backend, as reported to the guest
+type BackendHealth uint32
+
+const (
+	BackendHealthUnknown   BackendHealth = 0
+	BackendHealthHealthy   BackendHealth = 1
+	BackendHealthUnhealthy BackendHealth = 2
+)
+
+// The timeouts Fastly uses for backends which don't set their own
+const (
+	defaultConnectTimeout      = 1 * time.Second
+	defaultFirstByteTimeout    = 15 * time.Second
+	defaultBetweenBytesTimeout = 10 * time.Second
+)
+
+func (i *Instance) addBackend(b Backend) {
+	i.backends[b.Name] = &b
 }
 
 func (i *Instance) getBackend(name string) http.Handler {
-	h, ok := i.backends[name]
-	if !ok {
-		return i.defaultBackend(name)
+	b, ok := i.backends[name]
+	if ok {
+		return b.Handler
+	}
+
+	if b := i.getDynamicBackend(name); b != nil {
+		return b.handler
+	}
+
+	return i.defaultBackend(name)
+}
+
+// describeBackend returns the descriptor for the static or dynamic backend identified by name, and
+// whether it's dynamic. Backends which would be handled by the default backend don't exist, as far as
+// the guest is concerned.
+func (i *Instance) describeBackend(name string) (*Backend, bool, bool) {
+	if b, ok := i.backends[name]; ok {
+		return b, false, true
+	}
+
+	if b := i.getDynamicBackend(name); b != nil {
+		return &Backend{
+			Name:                b.config.Name,
+			Handler:             b.handler,
+			Target:              b.config.Target,
+			HostOverride:        b.config.HostOverride,
+			ConnectTimeout:      b.config.ConnectTimeout,
+			FirstByteTimeout:    b.config.FirstByteTimeout,
+			BetweenBytesTimeout: b.config.BetweenBytesTimeout,
+			UseSSL:              b.config.UseSSL,
+			SSLMinVersion:       b.config.SSLMinVersion,
+			SSLMaxVersion:       b.config.SSLMaxVersion,
+		}, true, true
+	}
+
+	return nil, false, false
+}
+
+// backendHandler returns the handler for the backend identified by name. Dynamic backends only
+// last as long as the request which registered them, so this must be called from the goroutine
+// running the guest.
+func (i *Instance) backendHandler(name string) http.Handler {
+	// If the backend is geolocation, we select the geobackend explicitly
+	if name == "geolocation" {
+		return geoHandler(i.geolookup)
+	}
+	return i.getBackend(name)
+}
+
+// send issues req against handler, the backend identified by name, and returns the response, going
+// through the cache if there is one. It's safe to call from a goroutine other than the one running
+// the guest.
+func (i *Instance) send(name string, handler http.Handler, req *http.Request, meta *fastlyMeta) *http.Response {
+	// The Handler interface is useful for embedders, since often-times they'll be processing wasm
+	// requests in the embedding application, and it's very easy to adapt an http.Handler to an
+	// http.RoundTripper if they want it to go offsite.
+	fetch := func(req *http.Request) *http.Response {
+		return serveResponse(handler, req)
+	}
+
+	if i.cache == nil || name == "geolocation" {
+		return fetch(req)
 	}
 
-	return h
+	if b := i.getDynamicBackend(name); b != nil {
+		name = b.cacheName()
+	}
+
+	return i.cache.serve(name, req, meta, fetch)
+}
+
+// serveResponse runs the handler against req in a new goroutine and returns the response as soon
+// as the handler has written its header, or a 504 if the request's context is done first. The
+// response body is read from the handler as it writes it, so nothing is buffered in between.
+// Closing the response body before reading all of it causes any further writes from the handler to
+// fail.
+func serveResponse(h http.Handler, req *http.Request) *http.Response {
+	pr, pw := io.Pipe()
+	w := &pipeResponseWriter{
+		header: http.Header{},
+		body:   pr,
+		pw:     pw,
+		respch: make(chan *http.Response, 1),
+	}
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				// If the handler panics before writing anything, the guest gets a 502. Otherwise,
+				// the guest sees an error reading the body.
+				w.WriteHeader(http.StatusBadGateway)
+				pw.CloseWithError(fmt.Errorf("backend handler panic: %v", r))
+			}
+		}()
+
+		h.ServeHTTP(w, req)
+
+		// Handlers that never write anything implicitly respond with a 200
+		w.WriteHeader(http.StatusOK)
+		pw.Close()
+	}()
+
+	select {
+	case resp := <-w.respch:
+		return resp
+	case <-req.Context().Done():
+		// Nobody is going to read the response, so make sure the handler doesn't block writing it
+		pr.CloseWithError(req.Context().Err())
+		return &http.Response{
+			Status:        "504 Gateway Timeout",
+			StatusCode:    http.StatusGatewayTimeout,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{},
+			Body:          http.NoBody,
+			ContentLength: 0,
+		}
+	}
+}
+
+// pipeResponseWriter is an http.ResponseWriter which produces an *http.Response as soon as
+// WriteHeader is called, with a body connected to everything written afterwards.
+type pipeResponseWriter struct {
+	header http.Header
+	body   *io.PipeReader
+	pw     *io.PipeWriter
+
+	wroteHeader bool
+	respch      chan *http.Response
+}
+
+// Header implements http.ResponseWriter for a pipeResponseWriter
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader implements http.ResponseWriter for a pipeResponseWriter
+func (w *pipeResponseWriter) WriteHeader(code int) {
+	// Informational responses don't go anywhere, since the guest can only receive one response
+	if w.wroteHeader || (code >= 100 && code < 200) {
+		return
+	}
+	w.wroteHeader = true
+
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%03d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     w.header.Clone(),
+		Body:       w.body,
+
+		ContentLength: -1,
+	}
+
+	if cl, err := strconv.ParseInt(resp.Header.Get("content-length"), 10, 64); err == nil {
+		resp.ContentLength = cl
+	}
+
+	w.respch <- resp
+}
+
+// Write implements http.ResponseWriter for a pipeResponseWriter. It blocks until the guest reads
+// the data or closes the body.
+func (w *pipeResponseWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pw.Write(data)
+}
+
+// Flush implements http.Flusher for a pipeResponseWriter. Writes go straight through to the reader,
+// so there's nothing to do, but handlers which stream responses often expect a Flusher.
+func (w *pipeResponseWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
 }
 
 func defaultBackend(name string) http.Handler {
@@ -0,0 +1,136 @@
+package fastlike
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeResponse(t *testing.T) {
+	t.Parallel()
+
+	get := func(ctx context.Context, h http.HandlerFunc) *http.Response {
+		r, _ := http.NewRequestWithContext(ctx, "GET", "http://backend/", nil)
+		return serveResponse(h, r)
+	}
+
+	t.Run("streams", func(st *testing.T) {
+		st.Parallel()
+
+		release := make(chan struct{})
+		resp := get(context.Background(), func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("first"))
+			<-release
+			w.Write([]byte("second"))
+		})
+
+		// The response comes back while the handler is still blocked
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(resp.Body, buf); resp.StatusCode != http.StatusCreated || err != nil || string(buf) != "first" {
+			st.Fatalf("expected a 201 starting with \"first\", got %d %q (%v)", resp.StatusCode, buf, err)
+		}
+
+		close(release)
+		if rest, err := ioutil.ReadAll(resp.Body); err != nil || string(rest) != "second" {
+			st.Logf("expected the rest of the body, got %q (%v)", rest, err)
+			st.Fail()
+		}
+	})
+
+	t.Run("implicit 200", func(st *testing.T) {
+		st.Parallel()
+
+		resp := get(context.Background(), func(w http.ResponseWriter, r *http.Request) {})
+		body, err := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || err != nil || len(body) != 0 {
+			st.Logf("expected an empty 200, got %d %q (%v)", resp.StatusCode, body, err)
+			st.Fail()
+		}
+	})
+
+	t.Run("informational", func(st *testing.T) {
+		st.Parallel()
+
+		resp := get(context.Background(), func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusEarlyHints)
+			w.WriteHeader(http.StatusNoContent)
+		})
+		if resp.StatusCode != http.StatusNoContent {
+			st.Logf("expected the 1xx to be skipped, got %d", resp.StatusCode)
+			st.Fail()
+		}
+	})
+
+	t.Run("panic before header", func(st *testing.T) {
+		st.Parallel()
+
+		resp := get(context.Background(), func(w http.ResponseWriter, r *http.Request) {
+			panic("oops")
+		})
+		if resp.StatusCode != http.StatusBadGateway {
+			st.Logf("expected a 502, got %d", resp.StatusCode)
+			st.Fail()
+		}
+	})
+
+	t.Run("panic after header", func(st *testing.T) {
+		st.Parallel()
+
+		resp := get(context.Background(), func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			panic("oops")
+		})
+		if _, err := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || err == nil {
+			st.Logf("expected a 200 with a body that fails to read, got %d (%v)", resp.StatusCode, err)
+			st.Fail()
+		}
+	})
+
+	t.Run("close early", func(st *testing.T) {
+		st.Parallel()
+
+		done := make(chan error, 1)
+		resp := get(context.Background(), func(w http.ResponseWriter, r *http.Request) {
+			for {
+				if _, err := w.Write([]byte("more")); err != nil {
+					done <- err
+					return
+				}
+			}
+		})
+		resp.Body.Close()
+
+		select {
+		case err := <-done:
+			if err == nil {
+				st.Log("expected the handler's write to fail")
+				st.Fail()
+			}
+		case <-time.After(time.Second):
+			st.Log("expected closing the body to unblock the handler")
+			st.Fail()
+		}
+	})
+
+	t.Run("cancelled", func(st *testing.T) {
+		st.Parallel()
+
+		release := make(chan struct{})
+		defer close(release)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		resp := get(ctx, func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		})
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			st.Logf("expected a 504, got %d", resp.StatusCode)
+			st.Fail()
+		}
+	})
+}
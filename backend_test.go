@@ -0,0 +1,96 @@
+package fastlike_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Khan/fastlike"
+)
+
+// backendGuest returns a guest which calls one of the fastly_backend hostcalls on a backend, with the
+// name and then the given args, and responds with the result. The hostcall writes to 32, and length
+// says how many of the bytes there to respond with.
+func backendGuest(fn, params, backend, args, length string) string {
+	return guest(
+		fmt.Sprintf(`(import "fastly_backend" "%s" (func $fn (param %s) (result i32)))`, fn, params),
+		fmt.Sprintf(`
+	(data (i32.const 1024) "%s")
+	(func (export "_start")
+		(call $respond_result
+			(call $fn (i32.const 1024) (i32.const %d) (i32.const 32) %s)
+			(i32.const 32)
+			%s))`, backend, len(backend), args, length),
+	)
+}
+
+func TestBackendIntrospection(t *testing.T) {
+	t.Parallel()
+
+	var healthy int32 = 1
+	origin := fastlike.WithBackendConfig(fastlike.Backend{
+		Name:           "origin",
+		Handler:        http.NotFoundHandler(),
+		Target:         "origin.example:8080",
+		HostOverride:   "www.example",
+		ConnectTimeout: 250 * time.Millisecond,
+		UseSSL:         true,
+		SSLMinVersion:  tls.VersionTLS12,
+		Health: func() fastlike.BackendHealth {
+			if atomic.LoadInt32(&healthy) == 1 {
+				return fastlike.BackendHealthHealthy
+			}
+			return fastlike.BackendHealthUnhealthy
+		},
+	})
+	plain := fastlike.WithBackend("plain", http.NotFoundHandler())
+
+	// How each kind of hostcall is called, and how many bytes of what it writes to send back
+	const (
+		u32 = "i32 i32 i32"
+		str = "i32 i32 i32 i32 i32"
+	)
+	u32Args, u32Len := "", "(i32.const 4)"
+	strArgs, strLen := "(i32.const 64) (i32.const 20)", "(i32.load (i32.const 20))"
+
+	// Each case checks one property of a backend, as the hostcall reports it. Properties which
+	// aren't set are reported with a status rather than a value.
+	cases := []struct {
+		name     string
+		fn       string
+		params   string
+		args     string
+		length   string
+		backend  string
+		status   int32
+		expected string
+	}{
+		{"exists", "exists", u32, u32Args, u32Len, "origin", fastlike.XqdStatusOK, "\x01\x00\x00\x00"},
+		{"doesn't exist", "exists", u32, u32Args, u32Len, "missing", fastlike.XqdStatusOK, "\x00\x00\x00\x00"},
+		{"healthy", "is_healthy", u32, u32Args, u32Len, "origin", fastlike.XqdStatusOK, "\x01\x00\x00\x00"},
+		{"unknown health", "is_healthy", u32, u32Args, u32Len, "plain", fastlike.XqdStatusOK, "\x00\x00\x00\x00"},
+		{"missing health", "is_healthy", u32, u32Args, u32Len, "missing", fastlike.XqdErrInvalidArgument, ""},
+		{"host", "get_host", str, strArgs, strLen, "origin", fastlike.XqdStatusOK, "origin.example"},
+		{"override host", "get_override_host", str, strArgs, strLen, "origin", fastlike.XqdStatusOK, "www.example"},
+		{"no override host", "get_override_host", str, strArgs, strLen, "plain", fastlike.XqdErrNone, ""},
+		{"port", "get_port", u32, u32Args, "(i32.const 2)", "origin", fastlike.XqdStatusOK, "\x90\x1f"},
+		{"connect timeout", "get_connect_timeout_ms", u32, u32Args, u32Len, "origin", fastlike.XqdStatusOK, "\xfa\x00\x00\x00"},
+		{"default timeout", "get_first_byte_timeout_ms", u32, u32Args, u32Len, "origin", fastlike.XqdStatusOK, "\x98\x3a\x00\x00"},
+		{"ssl", "is_ssl", u32, u32Args, u32Len, "origin", fastlike.XqdStatusOK, "\x01\x00\x00\x00"},
+		{"ssl min version", "get_ssl_min_version", u32, u32Args, u32Len, "origin", fastlike.XqdStatusOK, "\x02\x00\x00\x00"},
+		{"no ssl max version", "get_ssl_max_version", u32, u32Args, u32Len, "origin", fastlike.XqdErrNone, ""},
+		{"static", "is_dynamic", u32, u32Args, u32Len, "origin", fastlike.XqdStatusOK, "\x00\x00\x00\x00"},
+	}
+
+	for _, c := range cases {
+		h := newGuest(t, backendGuest(c.fn, c.params, c.backend, c.args, c.length), origin, plain)
+		expectResponse(t, c.name, h, resultCode(c.status), c.expected)
+	}
+
+	// The health is checked each time the guest asks
+	atomic.StoreInt32(&healthy, 0)
+	expectResponse(t, "unhealthy", newGuest(t, backendGuest("is_healthy", u32, "origin", u32Args, u32Len), origin), http.StatusOK, "\x02\x00\x00\x00")
+}
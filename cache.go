@@ -0,0 +1,442 @@
+package fastlike
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tag bits for the cache overrides a guest can set on a request
+const (
+	cacheOverridePass                 = 1 << 0
+	cacheOverrideTTL                  = 1 << 1
+	cacheOverrideStaleWhileRevalidate = 1 << 2
+	cacheOverridePCI                  = 1 << 3
+)
+
+// defaultCacheTTL is how long responses are cached for when neither the guest nor the backend say
+// otherwise, which is the same default Fastly uses
+const defaultCacheTTL = time.Hour
+
+// cacheableStatus holds the response status codes which Fastly caches by default
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusFound:                true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// CachedResponse is a backend response held in a Cache
+type CachedResponse struct {
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// Vary holds the values of the request headers named by the response's Vary header, which must
+	// match for the response to be used
+	Vary http.Header
+
+	// Stored is when the response was fetched from the backend, adjusted for any age it already had
+	Stored time.Time
+
+	// TTL is how long the response is fresh for, and StaleWhileRevalidate is how much longer after
+	// that the stale response may be used while it's revalidated in the background
+	TTL                  time.Duration
+	StaleWhileRevalidate time.Duration
+
+	// SurrogateKeys are the keys the response can be purged by
+	SurrogateKeys []string
+
+	// PCI is set when the guest asked for the response not to be written to disk. Stores which
+	// persist responses should not persist this one.
+	PCI bool
+}
+
+// Age returns how long the response has been in the cache at the supplied time
+func (c *CachedResponse) Age(now time.Time) time.Duration {
+	return now.Sub(c.Stored)
+}
+
+// Fresh returns true if the response can be used without revalidating it
+func (c *CachedResponse) Fresh(now time.Time) bool {
+	return c.Age(now) < c.TTL
+}
+
+// Usable returns true if the response can be used, either because it's fresh or because it's within
+// its stale-while-revalidate period
+func (c *CachedResponse) Usable(now time.Time) bool {
+	return c.Age(now) < c.TTL+c.StaleWhileRevalidate
+}
+
+// matches returns true if req has the same values for each of the headers the response varies on
+func (c *CachedResponse) matches(req *http.Request) bool {
+	for name, values := range c.Vary {
+		if strings.Join(req.Header.Values(name), ",") != strings.Join(values, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// response builds an http.Response for req out of the cached response
+func (c *CachedResponse) response(req *http.Request, xcache string, now time.Time) *http.Response {
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%03d %s", c.StatusCode, http.StatusText(c.StatusCode)),
+		StatusCode: c.StatusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     c.Header.Clone(),
+		Body:       ioutil.NopCloser(bytes.NewReader(c.Body)),
+
+		ContentLength: int64(len(c.Body)),
+	}
+
+	if req.Method == http.MethodHead {
+		resp.Body = http.NoBody
+	}
+
+	resp.Header.Set("Age", strconv.Itoa(int(c.Age(now).Seconds())))
+	resp.Header.Set("X-Cache", xcache)
+	return resp
+}
+
+// CacheStore is the storage behind a Cache. Implementations must be safe for concurrent use.
+type CacheStore interface {
+	// Get returns the response stored under key, or nil if there isn't one
+	Get(key string) *CachedResponse
+
+	// Set stores resp under key, replacing anything already there
+	Set(key string, resp *CachedResponse)
+
+	// Delete removes the response stored under key, if there is one
+	Delete(key string)
+
+	// Range calls fn for each stored response, stopping early if it returns false. It's used for
+	// purging, so fn may call Set or Delete.
+	Range(fn func(key string, resp *CachedResponse) bool)
+}
+
+// memoryCacheStore is a CacheStore which holds everything in memory
+type memoryCacheStore struct {
+	mu      sync.RWMutex
+	entries map[string]*CachedResponse
+}
+
+// NewMemoryCacheStore returns a CacheStore which holds responses in memory. Nothing is ever evicted
+// other than by purging, so it's best suited to development and tests.
+func NewMemoryCacheStore() CacheStore {
+	return &memoryCacheStore{entries: map[string]*CachedResponse{}}
+}
+
+func (s *memoryCacheStore) Get(key string) *CachedResponse {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.entries[key]
+}
+
+func (s *memoryCacheStore) Set(key string, resp *CachedResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = resp
+}
+
+func (s *memoryCacheStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+func (s *memoryCacheStore) Range(fn func(key string, resp *CachedResponse) bool) {
+	// Take a snapshot, so that fn is free to modify the store
+	s.mu.RLock()
+	entries := make(map[string]*CachedResponse, len(s.entries))
+	for k, v := range s.entries {
+		entries[k] = v
+	}
+	s.mu.RUnlock()
+
+	for k, v := range entries {
+		if !fn(k, v) {
+			return
+		}
+	}
+}
+
+// Cache is an HTTP cache which sits in front of backends, so that subrequests from the guest are
+// cached the way they would be on Fastly. It respects the Surrogate-Control, Cache-Control, and
+// Expires headers from the backend as well as any cache overrides set by the guest, and marks each
+// response the guest sees with an X-Cache header of HIT or MISS.
+// Only GET and HEAD requests are served from the cache, and responses are buffered in full before
+// they're stored.
+// A Cache is safe to share between instances, and is usually shared by every instance of a Fastlike.
+type Cache struct {
+	store CacheStore
+	now   func() time.Time
+
+	// revalidating holds the keys of stale responses which are being revalidated in the background
+	mu           sync.Mutex
+	revalidating map[string]bool
+}
+
+// NewCache returns a Cache backed by store. If store is nil, responses are held in memory.
+func NewCache(store CacheStore) *Cache {
+	if store == nil {
+		store = NewMemoryCacheStore()
+	}
+
+	return &Cache{
+		store:        store,
+		now:          time.Now,
+		revalidating: map[string]bool{},
+	}
+}
+
+// cacheKey returns the key a request's response to the named backend is stored under. Responses
+// from different backends are kept apart, as are responses for different hosts.
+func cacheKey(backend string, req *http.Request) string {
+	return backend + "\x00" + cacheURL(req)
+}
+
+// cacheURL returns the URL a request's response is stored as, which uses the Host header the guest
+// set on the request, if any, rather than the host in the URL
+func cacheURL(req *http.Request) string {
+	u := *req.URL
+	if host := req.Header.Get("Host"); host != "" {
+		u.Host = host
+	} else if req.Host != "" {
+		u.Host = req.Host
+	}
+	return u.String()
+}
+
+// serve returns the response for req, either from the cache or by calling fetch, which sends it to
+// the named backend
+func (c *Cache) serve(backend string, req *http.Request, meta *fastlyMeta, fetch func(*http.Request) *http.Response) *http.Response {
+	if meta.overrideTag&cacheOverridePass != 0 || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		resp := fetch(req)
+		resp.Header.Set("X-Cache", "MISS")
+		return resp
+	}
+
+	key := cacheKey(backend, req)
+	now := c.now()
+
+	if cached := c.store.Get(key); cached != nil && cached.matches(req) {
+		if cached.Fresh(now) {
+			return cached.response(req, "HIT", now)
+		}
+
+		if cached.Usable(now) {
+			c.revalidate(key, req, meta, fetch)
+			return cached.response(req, "HIT", now)
+		}
+	}
+
+	// A HEAD request doesn't get a body, so there's nothing worth storing
+	if req.Method == http.MethodHead {
+		resp := fetch(req)
+		resp.Header.Set("X-Cache", "MISS")
+		return resp
+	}
+
+	return c.insert(key, req, meta, fetch(req))
+}
+
+// revalidate fetches a fresh copy of a stale response in the background
+func (c *Cache) revalidate(key string, req *http.Request, meta *fastlyMeta, fetch func(*http.Request) *http.Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.revalidating[key] {
+		return
+	}
+	c.revalidating[key] = true
+
+	// The guest may be long gone by the time the backend responds, so the request can't depend on
+	// anything belonging to it
+	req = req.Clone(context.Background())
+	req.Body = http.NoBody
+	override := *meta
+
+	go func() {
+		resp := c.insert(key, req, &override, fetch(req))
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		c.mu.Lock()
+		delete(c.revalidating, key)
+		c.mu.Unlock()
+	}()
+}
+
+// insert stores resp under key if it's cacheable, and returns a response for the guest to use in
+// its place
+func (c *Cache) insert(key string, req *http.Request, meta *fastlyMeta, resp *http.Response) *http.Response {
+	ttl, swr, ok := cachePolicy(resp, meta, c.now())
+	if !ok {
+		resp.Header.Del("Surrogate-Control")
+		resp.Header.Set("X-Cache", "MISS")
+		return resp
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		// Hand the guest what we got, along with the error, rather than caching a partial response
+		resp.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), errorReader{err}))
+		resp.Header.Set("X-Cache", "MISS")
+		return resp
+	}
+
+	now := c.now()
+	if age, err := strconv.Atoi(resp.Header.Get("Age")); err == nil && age > 0 {
+		now = now.Add(-time.Duration(age) * time.Second)
+	}
+
+	cached := &CachedResponse{
+		URL:                  cacheURL(req),
+		StatusCode:           resp.StatusCode,
+		Header:               resp.Header.Clone(),
+		Body:                 body,
+		Vary:                 http.Header{},
+		Stored:               now,
+		TTL:                  ttl,
+		StaleWhileRevalidate: swr,
+		SurrogateKeys:        strings.Fields(meta.surrogateKeys + " " + resp.Header.Get("Surrogate-Key")),
+		PCI:                  meta.overrideTag&cacheOverridePCI != 0,
+	}
+	cached.Header.Del("Surrogate-Control")
+
+	for _, name := range strings.Split(strings.Join(resp.Header.Values("Vary"), ","), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			cached.Vary[name] = req.Header.Values(name)
+		}
+	}
+
+	c.store.Set(key, cached)
+	return cached.response(req, "MISS", c.now())
+}
+
+// cachePolicy decides whether a response can be cached, and if so for how long. The guest's cache
+// overrides take precedence, then Surrogate-Control, then Cache-Control, then Expires, which is
+// relative to now if the response has no Date.
+func cachePolicy(resp *http.Response, meta *fastlyMeta, now time.Time) (ttl time.Duration, swr time.Duration, ok bool) {
+	if !cacheableStatus[resp.StatusCode] {
+		return 0, 0, false
+	}
+
+	// Responses which vary on everything can never be matched
+	for _, v := range resp.Header.Values("Vary") {
+		if strings.Contains(v, "*") {
+			return 0, 0, false
+		}
+	}
+
+	sc := parseCacheControl(resp.Header.Values("Surrogate-Control"))
+	cc := parseCacheControl(resp.Header.Values("Cache-Control"))
+
+	if _, nostore := sc["no-store"]; nostore {
+		return 0, 0, false
+	}
+
+	ttl = defaultCacheTTL
+	if meta.overrideTag&cacheOverrideTTL != 0 {
+		ttl = time.Duration(meta.overrideTTL) * time.Second
+	} else if maxage, ok := sc.seconds("max-age"); ok {
+		ttl = maxage
+	} else {
+		// Without any say from the guest or Surrogate-Control, responses which are private or which
+		// set cookies aren't cached
+		for _, directive := range []string{"private", "no-store", "no-cache"} {
+			if _, ok := cc[directive]; ok {
+				return 0, 0, false
+			}
+		}
+		if len(resp.Header.Values("Set-Cookie")) > 0 {
+			return 0, 0, false
+		}
+
+		if smaxage, ok := cc.seconds("s-maxage"); ok {
+			ttl = smaxage
+		} else if maxage, ok := cc.seconds("max-age"); ok {
+			ttl = maxage
+		} else if expires, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+			date, err := http.ParseTime(resp.Header.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			ttl = expires.Sub(date)
+		}
+	}
+
+	if meta.overrideTag&cacheOverrideStaleWhileRevalidate != 0 {
+		swr = time.Duration(meta.overrideSWR) * time.Second
+	} else if s, ok := sc.seconds("stale-while-revalidate"); ok {
+		swr = s
+	} else if s, ok := cc.seconds("stale-while-revalidate"); ok {
+		swr = s
+	}
+
+	if ttl <= 0 && swr <= 0 {
+		return 0, 0, false
+	}
+
+	return ttl, swr, true
+}
+
+// cacheControl is a parsed Cache-Control or Surrogate-Control header, mapping directives to their
+// values
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := cacheControl{}
+	for _, v := range values {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+
+			name, value := directive, ""
+			if idx := strings.Index(directive, "="); idx >= 0 {
+				name, value = directive[:idx], strings.Trim(directive[idx+1:], `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	return cc
+}
+
+// seconds returns the value of a directive as a duration, if it's present and valid
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// errorReader is an io.Reader which always fails with err
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read(_ []byte) (int, error) {
+	return 0, r.err
+}
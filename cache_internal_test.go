@@ -0,0 +1,37 @@
+package fastlike
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCachePolicyExpires(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	expires := now.Add(time.Hour).Format(http.TimeFormat)
+
+	cases := []struct {
+		name     string
+		date     string
+		expected time.Duration
+	}{
+		{"date", now.Add(-time.Hour).Format(http.TimeFormat), 2 * time.Hour},
+		{"no date", "", time.Hour},
+	}
+
+	for _, c := range cases {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Expires": {expires}}}
+		if c.date != "" {
+			resp.Header.Set("Date", c.date)
+		}
+
+		// Without a Date, Expires is relative to the cache's clock rather than the real one
+		ttl, _, ok := cachePolicy(resp, &fastlyMeta{}, now)
+		if !ok || ttl != c.expected {
+			t.Logf("%s: expected a TTL of %s, got %s (%v)", c.name, c.expected, ttl, ok)
+			t.Fail()
+		}
+	}
+}
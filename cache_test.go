@@ -0,0 +1,151 @@
+package fastlike_test
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Khan/fastlike"
+)
+
+// cachingProxyWat sets the cache override tag, TTL, and stale-while-revalidate given by the format
+// arguments, and then sends downstream whatever the "origin" backend responds with
+const cachingProxyWat = `
+	(data (i32.const 1024) "http://origin/")
+	(data (i32.const 1040) "origin")
+	(func (export "_start")
+		(local $req i32)
+		(local.set $req (call $request (i32.const 1024) (i32.const 14)))
+		(drop (call $cache_override_set (local.get $req) (i32.const %d) (i32.const %d) (i32.const %d)))
+		(call $proxy (local.get $req) (i32.const 1040) (i32.const 6)))`
+
+// cachingProxy returns a cachingProxyWat guest
+func cachingProxy(tag, ttl, swr int) string {
+	return guest(
+		`(import "fastly_http_req" "cache_override_set" (func $cache_override_set (param i32 i32 i32 i32) (result i32)))`,
+		fmt.Sprintf(cachingProxyWat, tag, ttl, swr),
+	)
+}
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name         string
+		cacheControl string
+		tag, ttl     int
+		expected     []string
+		fetches      int32
+	}{
+		{"max-age", "max-age=60", 0, 0, []string{"MISS", "HIT", "HIT"}, 1},
+		{"private", "private, max-age=60", 0, 0, []string{"MISS", "MISS"}, 2},
+		{"pass", "max-age=60", 1, 0, []string{"MISS", "MISS"}, 2},
+		{"ttl-override", "no-store", 2, 60, []string{"MISS", "HIT"}, 1},
+		{"stale-while-revalidate", "max-age=0, stale-while-revalidate=60", 0, 0, []string{"MISS", "HIT"}, 2},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(st *testing.T) {
+			st.Parallel()
+
+			var fetches int32
+			origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&fetches, 1)
+				w.Header().Set("Cache-Control", c.cacheControl)
+				w.Write([]byte("from origin"))
+			})
+
+			f := newGuest(st, cachingProxy(c.tag, c.ttl, 0), fastlike.WithBackend("origin", origin), fastlike.WithCache(fastlike.NewCache(nil)))
+
+			for _, expected := range c.expected {
+				w := serve(f)
+				if w.Body.String() != "from origin" {
+					st.Logf("expected the origin response, got %q", w.Body.String())
+					st.Fail()
+				}
+
+				if actual := w.Header().Get("X-Cache"); actual != expected {
+					st.Logf("expected X-Cache %s, got %s", expected, actual)
+					st.Fail()
+				}
+			}
+
+			// Revalidation happens in the background, so give it a moment to finish
+			deadline := time.Now().Add(time.Second)
+			for atomic.LoadInt32(&fetches) < c.fetches && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if actual := atomic.LoadInt32(&fetches); actual != c.fetches {
+				st.Logf("expected %d fetches from origin, got %d", c.fetches, actual)
+				st.Fail()
+			}
+		})
+	}
+}
+
+// cacheKeyWat sends a request for http://origin/ to the backend given by the format arguments,
+// setting its Host header if one is given, and sends downstream whatever the backend responds with
+const cacheKeyWat = `
+	(data (i32.const 1024) "http://origin/")
+	(data (i32.const 1040) "Host")
+	(data (i32.const 1056) "%s")
+	(data (i32.const 1088) "%s\00")
+	(func (export "_start")
+		(local $req i32)
+		(local.set $req (call $request (i32.const 1024) (i32.const 14)))
+		(if (i32.const %d)
+			(then
+				(drop (call $header_values_set (local.get $req) (i32.const 1040) (i32.const 4) (i32.const 1088) (i32.const %d)))))
+		(call $proxy (local.get $req) (i32.const 1056) (i32.const %d)))`
+
+// cacheKeyGuest returns a cacheKeyWat guest
+func cacheKeyGuest(backend, host string) string {
+	return guest(
+		`(import "fastly_http_req" "header_values_set" (func $header_values_set (param i32 i32 i32 i32 i32) (result i32)))`,
+		fmt.Sprintf(cacheKeyWat, backend, host, len(host), len(host)+1, len(backend)),
+	)
+}
+
+func TestCacheKey(t *testing.T) {
+	t.Parallel()
+
+	cache := fastlike.NewCache(nil)
+	backend := func(name string) fastlike.Option {
+		return fastlike.WithBackend(name, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(name))
+		}))
+	}
+
+	steps := []struct {
+		backend, host string
+		expected      string
+	}{
+		{"a", "", "MISS"},
+		{"b", "", "MISS"},
+		{"a", "example.test", "MISS"},
+		{"a", "", "HIT"},
+		{"b", "", "HIT"},
+		{"a", "example.test", "HIT"},
+	}
+
+	for _, step := range steps {
+		f := newGuest(t, cacheKeyGuest(step.backend, step.host), backend("a"), backend("b"), fastlike.WithCache(cache))
+
+		w := serve(f)
+		if w.Body.String() != step.backend || w.Header().Get("X-Cache") != step.expected {
+			t.Logf("%s %q: expected %s from %s, got %s from %q", step.backend, step.host, step.expected, step.backend, w.Header().Get("X-Cache"), w.Body.String())
+			t.Fail()
+		}
+	}
+
+	// Purging by URL goes by the Host the response was fetched with
+	if purged := cache.PurgeURL("http://example.test/", false); purged != 1 {
+		t.Logf("expected to purge 1 response for example.test, purged %d", purged)
+		t.Fail()
+	}
+}
@@ -0,0 +1,62 @@
+package fastlike
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// prefixTable maps CIDR prefixes to values, and finds the value for the longest prefix which
+// contains an address. Prefixes are added up front, after which it's safe for concurrent lookups.
+type prefixTable struct {
+	entries []prefixEntry
+}
+
+type prefixEntry struct {
+	network *net.IPNet
+	ones    int
+	value   interface{}
+}
+
+// parsePrefix parses a CIDR prefix. A bare address is treated as a prefix containing only itself.
+func parsePrefix(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "CIDR address", Text: s}
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+// add stores value for the prefix. Once everything has been added, call sort.
+func (t *prefixTable) add(network *net.IPNet, value interface{}) {
+	ones, _ := network.Mask.Size()
+	t.entries = append(t.entries, prefixEntry{network, ones, value})
+}
+
+// sort orders the prefixes from longest to shortest, keeping the order they were added in for
+// prefixes of the same length
+func (t *prefixTable) sort() {
+	sort.SliceStable(t.entries, func(a, b int) bool {
+		return t.entries[a].ones > t.entries[b].ones
+	})
+}
+
+// lookup returns the value for the longest prefix containing ip, if there is one
+func (t *prefixTable) lookup(ip net.IP) (interface{}, bool) {
+	for _, e := range t.entries {
+		if e.network.Contains(ip) {
+			return e.value, true
+		}
+	}
+	return nil, false
+}
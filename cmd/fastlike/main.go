@@ -17,6 +17,11 @@ func main() {
 	wasm := flag.String("wasm", "", "wasm program to execute")
 	bind := flag.String("bind", "localhost:5000", "address to bind to")
 	verbosity := flag.Int("v", 0, "verbosity level (0, 1, 2)")
+	cache := flag.Bool("cache", false, "cache backend responses in memory, the way Fastly would")
+	uaParser := flag.String("ua-parser", "", "uap-core regexes.yaml file to parse user agents with. By default, a small set of regexes for common browsers is used.")
+	deviceDetection := flag.String("device-detection", "", "JSON file mapping user agents to device detection data")
+	dynamicBackends := flag.Bool("dynamic-backends", false, "allow the program to register backends of its own while it's running")
+	admin := flag.String("admin", "", "address to bind the cache purging API to, if any (ex: -admin localhost:5001)")
 
 	backends := make(backendFlags)
 	flag.Var(&backends, "backend", "<name=address> specifying backends. Use an empty name to specify a catch-all backend (ex: -backend localhost:2000)")
@@ -25,6 +30,19 @@ func main() {
 	dictionaries := make(dictionaryFlags)
 	flag.Var(&dictionaries, "dictionary", "<name=file.json> specifying dictionaries. The JSON file supplied must only contain string values.")
 	flag.Var(&dictionaries, "d", "alias for -dictionary")
+	flag.Var(&dictionaries, "config-store", "alias for -dictionary")
+
+	kvStores := make(kvStoreFlags)
+	flag.Var(&kvStores, "kv-store", "<name=file.json> specifying KV stores. The JSON file maps keys to either string values or objects with \"data\" and \"metadata\" strings. A directory may be given instead, in which case each file is a value.")
+
+	secretStores := make(secretStoreFlags)
+	flag.Var(&secretStores, "secret-store", "<name=file.json> specifying secret stores. The JSON file supplied must only contain string values. Use <name=env:PREFIX> to read each secret from the environment variable named PREFIX followed by the secret's name instead.")
+
+	acls := make(aclFlags)
+	flag.Var(&acls, "acl", "<name=file.json> specifying ACLs. The JSON file supplied must be in the same format as Fastly's API uses, ex: {\"entries\": [{\"prefix\": \"192.0.2.0/24\", \"action\": \"BLOCK\"}]}")
+
+	geoFiles := geoFlags{}
+	flag.Var(&geoFiles, "geo", "<file> to read geographic data from: a MaxMind .mmdb database, or a .json or .csv file mapping CIDR prefixes to data. May be given more than once, in which case earlier files take precedence.")
 
 	flag.Parse()
 
@@ -48,26 +66,146 @@ func main() {
 				return backend.proxy
 			}))
 		} else {
-			opts = append(opts, fastlike.WithBackend(name, backend.proxy))
+			opts = append(opts, fastlike.WithBackendConfig(fastlike.Backend{
+				Name:    name,
+				Handler: backend.proxy,
+				Target:  backend.target.Host,
+				UseSSL:  backend.target.Scheme == "https",
+			}))
 		}
 	}
 
 	for name, dictionary := range dictionaries {
-		opts = append(opts, fastlike.WithDictionary(name, dictionary.fn))
+		opts = append(opts, fastlike.WithDictionaryLookup(name, dictionary.fn))
+	}
+
+	for name, kvStore := range kvStores {
+		opts = append(opts, fastlike.WithKVStore(name, kvStore.store))
+	}
+
+	for name, acl := range acls {
+		opts = append(opts, fastlike.WithACL(name, acl.entries))
+	}
+
+	for name, secretStore := range secretStores {
+		opts = append(opts, fastlike.WithSecretStore(name, secretStore.fn))
+	}
+
+	if *uaParser != "" {
+		parser, err := fastlike.NewUserAgentParser(*uaParser)
+		if err != nil {
+			fmt.Printf("Error loading user agent parsers, got %s\n", err.Error())
+			os.Exit(1)
+		}
+		opts = append(opts, fastlike.WithUserAgentParser(parser))
+	} else {
+		opts = append(opts, fastlike.WithUserAgentParser(fastlike.DefaultUserAgentParser()))
+	}
+
+	if *deviceDetection != "" {
+		lookup, err := fastlike.NewDeviceDetectionLookup(*deviceDetection)
+		if err != nil {
+			fmt.Printf("Error loading device detection data, got %s\n", err.Error())
+			os.Exit(1)
+		}
+		opts = append(opts, fastlike.WithDeviceDetection(lookup))
+	}
+
+	if len(geoFiles) > 0 {
+		lookup, err := fastlike.NewGeoLookup(geoFiles...)
+		if err != nil {
+			fmt.Printf("Error loading geographic data, got %s\n", err.Error())
+			os.Exit(1)
+		}
+		opts = append(opts, fastlike.WithGeo(lookup))
+	}
+
+	if *cache {
+		opts = append(opts, fastlike.WithCache(fastlike.NewCache(nil)))
+	}
+
+	if *dynamicBackends {
+		opts = append(opts, fastlike.WithDynamicBackends(true))
 	}
 
 	opts = append(opts, fastlike.WithVerbosity(*verbosity))
 
-	fl := fastlike.New(*wasm, opts...)
+	fl, err := fastlike.NewE(*wasm, opts...)
+	if err != nil {
+		fmt.Printf("Error loading wasm program, got %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if *admin != "" {
+		go func() {
+			fmt.Printf("Admin API listening on %s\n", *admin)
+			if err := http.ListenAndServe(*admin, adminHandler(fl)); err != nil {
+				fmt.Printf("Error starting admin server, got %s\n", err.Error())
+			}
+		}()
+	}
 
 	fmt.Printf("Listening on %s\n", *bind)
-	if err := http.ListenAndServe(*bind, fl); err != nil {
+	if err := http.ListenAndServe(*bind, purgeHandler(fl)); err != nil {
 		fmt.Printf("Error starting server, got %s\n", err.Error())
 	}
 }
 
+// purgeHandler serves requests with fl, except for PURGE requests which purge the requested URL from
+// the cache the same way they do on Fastly. Set the Host header to the host of the backend request.
+func purgeHandler(fl *fastlike.Fastlike) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PURGE" {
+			fl.ServeHTTP(w, r)
+			return
+		}
+
+		u := fmt.Sprintf("http://%s%s", r.Host, r.URL.RequestURI())
+		purged := fl.PurgeURL(u, isSoftPurge(r))
+		writePurgeResult(w, purged)
+	})
+}
+
+// adminHandler serves an API for purging the cache modeled on Fastly's:
+//
+//	POST /purge/<surrogate key> purges everything tagged with the surrogate key
+//	POST /purge_all purges everything
+//
+// Send a "Fastly-Soft-Purge: 1" header to mark things as stale rather than removing them.
+func adminHandler(fl *fastlike.Fastlike) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/purge/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		key := strings.TrimPrefix(r.URL.Path, "/purge/")
+		writePurgeResult(w, fl.PurgeSurrogateKey(key, isSoftPurge(r)))
+	})
+	mux.HandleFunc("/purge_all", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writePurgeResult(w, fl.PurgeAll(isSoftPurge(r)))
+	})
+	return mux
+}
+
+func isSoftPurge(r *http.Request) bool {
+	return r.Header.Get("Fastly-Soft-Purge") == "1"
+}
+
+func writePurgeResult(w http.ResponseWriter, purged int) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "purged": purged})
+}
+
 type backend struct {
 	address string
+	target  *url.URL
 	proxy   http.Handler
 }
 type backendFlags map[string]backend
@@ -105,14 +243,14 @@ func (f *backendFlags) Set(v string) error {
 
 	proxy := httputil.NewSingleHostReverseProxy(dest)
 
-	(*f)[name] = backend{address: addr, proxy: proxy}
+	(*f)[name] = backend{address: addr, target: dest, proxy: proxy}
 	return nil
 }
 
 type dictionary struct {
 	name     string
 	filename string
-	fn       fastlike.LookupFunc
+	fn       fastlike.DictionaryLookupFunc
 }
 type dictionaryFlags map[string]dictionary
 
@@ -144,12 +282,170 @@ func (f *dictionaryFlags) Set(v string) error {
 		return fmt.Errorf("error parsing dictionary file %s, got %s", filename, err.Error())
 	}
 
-	(*f)[name] = dictionary{name: name, filename: filename, fn: func(key string) string {
-		if v, ok := content[key]; !ok {
-			return ""
-		} else {
-			return v
+	(*f)[name] = dictionary{name: name, filename: filename, fn: func(key string) (string, bool) {
+		v, ok := content[key]
+		return v, ok
+	}}
+	return nil
+}
+
+type kvStore struct {
+	name  string
+	path  string
+	store fastlike.KVStore
+}
+type kvStoreFlags map[string]kvStore
+
+func (f *kvStoreFlags) String() string {
+	rv := make([]string, len(*f))
+	for name, s := range *f {
+		rv = append(rv, fmt.Sprintf("%s=%s", name, s.path))
+	}
+	return strings.Join(rv, ", ")
+}
+
+func (f *kvStoreFlags) Set(v string) error {
+	parts := strings.Split(v, "=")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid kv store %s specified", v)
+	}
+
+	name := parts[0]
+	path := parts[1]
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("error opening kv store %s, got %s", path, err.Error())
+	}
+
+	// Directories are used as they are, so that changes made by the guest are kept
+	if info.IsDir() {
+		(*f)[name] = kvStore{name: name, path: path, store: fastlike.NewDirKVStore(path)}
+		return nil
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening kv store file %s, got %s", path, err.Error())
+	}
+	defer fd.Close()
+
+	content := map[string]json.RawMessage{}
+	if err := json.NewDecoder(fd).Decode(&content); err != nil {
+		return fmt.Errorf("error parsing kv store file %s, got %s", path, err.Error())
+	}
+
+	store := fastlike.NewMemoryKVStore()
+	for key, raw := range content {
+		var entry struct {
+			Data     string `json:"data"`
+			Metadata string `json:"metadata"`
+		}
+		if err := json.Unmarshal(raw, &entry.Data); err != nil {
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				return fmt.Errorf("error parsing key %s in kv store file %s, got %s", key, path, err.Error())
+			}
 		}
+
+		store.Insert(key, []byte(entry.Data), fastlike.KVInsertOptions{Metadata: entry.Metadata})
+	}
+
+	(*f)[name] = kvStore{name: name, path: path, store: store}
+	return nil
+}
+
+type secretStore struct {
+	name   string
+	source string
+	fn     fastlike.SecretLookupFunc
+}
+type secretStoreFlags map[string]secretStore
+
+func (f *secretStoreFlags) String() string {
+	rv := make([]string, len(*f))
+	for name, s := range *f {
+		rv = append(rv, fmt.Sprintf("%s=%s", name, s.source))
+	}
+	return strings.Join(rv, ", ")
+}
+
+func (f *secretStoreFlags) Set(v string) error {
+	parts := strings.Split(v, "=")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid secret store %s specified", v)
+	}
+
+	name := parts[0]
+	source := parts[1]
+
+	// secrets are read from the environment when they're looked up, rather than up front
+	if strings.HasPrefix(source, "env:") {
+		prefix := strings.TrimPrefix(source, "env:")
+		(*f)[name] = secretStore{name: name, source: source, fn: func(key string) ([]byte, bool) {
+			v, ok := os.LookupEnv(prefix + key)
+			return []byte(v), ok
+		}}
+		return nil
+	}
+
+	fd, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("error opening secret store file %s, got %s", source, err.Error())
+	}
+	defer fd.Close()
+
+	content := map[string]string{}
+	if err := json.NewDecoder(fd).Decode(&content); err != nil {
+		return fmt.Errorf("error parsing secret store file %s, got %s", source, err.Error())
+	}
+
+	(*f)[name] = secretStore{name: name, source: source, fn: func(key string) ([]byte, bool) {
+		v, ok := content[key]
+		return []byte(v), ok
 	}}
 	return nil
 }
+
+type geoFlags []string
+
+func (f *geoFlags) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *geoFlags) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+type acl struct {
+	name     string
+	filename string
+	entries  []fastlike.ACLEntry
+}
+type aclFlags map[string]acl
+
+func (f *aclFlags) String() string {
+	rv := make([]string, len(*f))
+	for name, a := range *f {
+		rv = append(rv, fmt.Sprintf("%s=%s", name, a.filename))
+	}
+	return strings.Join(rv, ", ")
+}
+
+func (f *aclFlags) Set(v string) error {
+	parts := strings.Split(v, "=")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid acl %s specified", v)
+	}
+
+	name := parts[0]
+	filename := parts[1]
+
+	entries, err := fastlike.ReadACL(filename)
+	if err != nil {
+		return fmt.Errorf("error reading acl file %s, got %s", filename, err.Error())
+	}
+
+	(*f)[name] = acl{name: name, filename: filename, entries: entries}
+	return nil
+}
@@ -0,0 +1,500 @@
+package fastlike
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// coreCache is the store behind the fastly_cache hostcalls, which let guests cache arbitrary data
+// rather than HTTP responses. It's shared by every instance of a Fastlike.
+type coreCache struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*coreCacheEntry
+
+	// swept is when entries with nothing usable in them were last swept away
+	swept time.Time
+}
+
+// coreCacheSweepInterval is how often the core cache sweeps away entries whose objects have expired
+const coreCacheSweepInterval = time.Minute
+
+var (
+	errCacheBodyAbandoned = errors.New("cached body was abandoned before it was finished")
+	errCacheBodyLength    = errors.New("cached body doesn't match its declared length")
+)
+
+// coreCacheEntry holds the object cached under a key, along with the transaction which is
+// responsible for filling it, if there is one
+type coreCacheEntry struct {
+	object *cacheObject
+
+	// pending is closed once the responsible transaction inserts, updates, or gives up on the object.
+	// Transactions which find nothing usable wait on it rather than all going off to produce the
+	// same object, which is how requests are collapsed.
+	pending chan struct{}
+}
+
+func newCoreCache() *coreCache {
+	return &coreCache{now: time.Now, entries: map[string]*coreCacheEntry{}}
+}
+
+// entry returns the entry for key, creating it if necessary. The caller must hold c.mu.
+func (c *coreCache) entry(key string) *coreCacheEntry {
+	e, ok := c.entries[key]
+	if !ok {
+		e = &coreCacheEntry{}
+		c.entries[key] = e
+	}
+	return e
+}
+
+// release removes the entry for key if there's nothing left in it. The caller must hold c.mu.
+func (c *coreCache) release(key string, e *coreCacheEntry) {
+	if e.object == nil && e.pending == nil {
+		delete(c.entries, key)
+	}
+}
+
+// sweep removes the objects which can no longer be used, along with their entries if nothing is
+// pending on them. It does so at most once every coreCacheSweepInterval. The caller must hold c.mu.
+func (c *coreCache) sweep(now time.Time) {
+	if now.Sub(c.swept) < coreCacheSweepInterval {
+		return
+	}
+	c.swept = now
+
+	for key, e := range c.entries {
+		if e.object != nil && !e.object.Usable(now) {
+			e.object = nil
+		}
+		c.release(key, e)
+	}
+}
+
+// usable returns the entry's object if it can be used for a request with the supplied headers. The
+// caller must hold c.mu.
+func (e *coreCacheEntry) usable(headers http.Header, now time.Time) *cacheObject {
+	if e.object == nil || !e.object.matches(headers) || !e.object.Usable(now) {
+		return nil
+	}
+	return e.object
+}
+
+// lookup returns the usable object for key, or nil if there isn't one
+func (c *coreCache) lookup(key string, headers http.Header) *cacheObject {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	obj := e.usable(headers, c.now())
+	if obj != nil {
+		atomic.AddUint64(obj.hits, 1)
+	}
+	return obj
+}
+
+// insert stores obj under key, replacing anything already there
+func (c *coreCache) insert(key string, obj *cacheObject) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(c.now())
+	c.entry(key).object = obj
+}
+
+// drop removes the object with the supplied body from key, if it's still cached there
+func (c *coreCache) drop(key string, body *cacheBody) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	if e.object != nil && e.object.body == body {
+		e.object = nil
+	}
+	c.release(key, e)
+}
+
+// writer returns the writer for the body of an object being inserted under key. If the body can't
+// be finished, the object is dropped so that it isn't served to anyone else.
+func (c *coreCache) writer(key string, body *cacheBody) io.WriteCloser {
+	return &cacheBodyWriter{cache: c, key: key, body: body}
+}
+
+// transactionLookup returns the usable object for key, if there is one, along with a transaction if
+// the caller is now responsible for inserting or updating it. That happens when nothing usable is
+// cached, or when what's cached is stale and nobody else is already revalidating it.
+// If another transaction is already responsible for a key with nothing usable cached, this waits
+// until that transaction is done, or ctx is cancelled.
+func (c *coreCache) transactionLookup(ctx context.Context, key string, headers http.Header) (*cacheObject, *cacheTransaction, error) {
+	for {
+		c.mu.Lock()
+		now := c.now()
+		c.sweep(now)
+
+		// The entry is only stored once there's a transaction pending on it
+		e, ok := c.entries[key]
+		if !ok {
+			e = &coreCacheEntry{}
+		}
+
+		obj := e.usable(headers, now)
+		if obj != nil {
+			atomic.AddUint64(obj.hits, 1)
+		}
+
+		if obj != nil && obj.Fresh(now) {
+			c.mu.Unlock()
+			return obj, nil, nil
+		}
+
+		if e.pending == nil {
+			e.pending = make(chan struct{})
+			c.entries[key] = e
+			tx := &cacheTransaction{cache: c, key: key, done: e.pending}
+			c.mu.Unlock()
+			return obj, tx, nil
+		}
+
+		if obj != nil {
+			// Someone else is already revalidating the stale object, which can be used meanwhile
+			c.mu.Unlock()
+			return obj, nil, nil
+		}
+
+		pending := e.pending
+		c.mu.Unlock()
+
+		select {
+		case <-pending:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// purge removes (or, for a soft purge, marks stale) every object for which match returns true, and
+// returns how many there were
+func (c *coreCache) purge(soft bool, match func(*cacheObject) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	purged := 0
+	for key, e := range c.entries {
+		if e.object == nil || !match(e.object) {
+			continue
+		}
+		purged++
+
+		if !soft {
+			e.object = nil
+			c.release(key, e)
+		} else if e.object.Fresh(now) {
+			stale := e.object.copy()
+			stale.maxAge = stale.Age(now)
+			e.object = stale
+		}
+	}
+	return purged
+}
+
+// purgeSurrogateKey purges every object tagged with the surrogate key
+func (c *coreCache) purgeSurrogateKey(key string, soft bool) int {
+	return c.purge(soft, func(obj *cacheObject) bool {
+		for _, k := range obj.surrogateKeys {
+			if k == key {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// cacheTransaction is the obligation to insert or update an object, handed out by
+// transactionLookup. Exactly one of insert, update, or cancel should be called.
+type cacheTransaction struct {
+	cache *coreCache
+	key   string
+	done  chan struct{}
+	once  sync.Once
+}
+
+// insert stores obj and completes the transaction
+func (t *cacheTransaction) insert(obj *cacheObject) {
+	t.finish(func(e *coreCacheEntry) {
+		e.object = obj
+	})
+}
+
+// cancel gives up on the transaction, so that someone else can take it on
+func (t *cacheTransaction) cancel() {
+	t.finish(func(_ *coreCacheEntry) {})
+}
+
+func (t *cacheTransaction) finish(fn func(*coreCacheEntry)) {
+	t.once.Do(func() {
+		t.cache.mu.Lock()
+		defer t.cache.mu.Unlock()
+
+		e := t.cache.entry(t.key)
+		fn(e)
+		if e.pending == t.done {
+			e.pending = nil
+		}
+		t.cache.release(t.key, e)
+		close(t.done)
+	})
+}
+
+// cacheObject is an object in the core cache. The body is shared by any updated copies of the
+// object, while the rest is fixed once the object is inserted.
+type cacheObject struct {
+	inserted   time.Time
+	maxAge     time.Duration
+	initialAge time.Duration
+	swr        time.Duration
+
+	// vary holds the values of the request headers named by the vary rule when the object was
+	// inserted, which must match for the object to be used
+	vary http.Header
+
+	surrogateKeys []string
+	userMetadata  []byte
+	sensitive     bool
+
+	// hits counts how many times the object has been found, and is shared by soft purged copies
+	hits *uint64
+
+	body *cacheBody
+}
+
+// Age returns how old the object is at the supplied time
+func (o *cacheObject) Age(now time.Time) time.Duration {
+	return o.initialAge + now.Sub(o.inserted)
+}
+
+// Fresh returns true if the object can be used without being revalidated
+func (o *cacheObject) Fresh(now time.Time) bool {
+	return o.Age(now) < o.maxAge
+}
+
+// Usable returns true if the object is fresh or within its stale-while-revalidate period
+func (o *cacheObject) Usable(now time.Time) bool {
+	return o.Age(now) < o.maxAge+o.swr
+}
+
+// matches returns true if the request headers match those the object was inserted with, for each
+// header in the vary rule
+func (o *cacheObject) matches(headers http.Header) bool {
+	for name, values := range o.vary {
+		if strings.Join(headers.Values(name), ",") != strings.Join(values, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// Hits returns how many times the object has been found by a lookup
+func (o *cacheObject) Hits() uint64 {
+	return atomic.LoadUint64(o.hits)
+}
+
+// copy returns a copy of the object which shares its body and hit count
+func (o *cacheObject) copy() *cacheObject {
+	c := *o
+	return &c
+}
+
+// cacheBody is the body of a cached object. It can be read while it's still being written, with
+// readers waiting for more to arrive until the writer closes it.
+type cacheBody struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	data     []byte
+	length   int64
+	complete bool
+
+	// err is set if the body was abandoned, and is returned to readers in place of io.EOF
+	err error
+}
+
+func newCacheBody(length int64) *cacheBody {
+	b := &cacheBody{length: length}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Write implements io.Writer for a cacheBody
+func (b *cacheBody) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.complete {
+		return 0, io.ErrClosedPipe
+	}
+
+	b.data = append(b.data, p...)
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+// Close finishes writing the body. If it was declared with a length and that isn't what was
+// written, the body is abandoned instead.
+func (b *cacheBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.complete {
+		return b.err
+	}
+
+	if b.length >= 0 && b.length != int64(len(b.data)) {
+		b.fail(errCacheBodyLength)
+		return b.err
+	}
+
+	b.complete = true
+	b.length = int64(len(b.data))
+	b.cond.Broadcast()
+	return nil
+}
+
+// abandon stops writing the body without finishing it. Readers get err once they've read
+// everything that was written.
+func (b *cacheBody) abandon(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.complete {
+		b.fail(err)
+	}
+}
+
+// fail marks the body as done with err. The caller must hold b.mu.
+func (b *cacheBody) fail(err error) {
+	b.complete = true
+	b.err = err
+	b.cond.Broadcast()
+}
+
+// Length returns the length of the body, or -1 if it isn't known yet
+func (b *cacheBody) Length() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.length
+}
+
+// Reader returns a reader for the bytes from `from` up to and including `to`. A negative `to` reads
+// to the end of the body. Waiting for more of the body to be written stops once ctx is done. If
+// block isn't nil, it's called whenever the reader has to wait, and the function it returns is
+// called once it's done waiting.
+func (b *cacheBody) Reader(ctx context.Context, from, to int64, block func() func()) io.ReadCloser {
+	return &cacheBodyReader{body: b, ctx: ctx, offset: from, to: to, block: block}
+}
+
+// cacheBodyReader reads a range of a cacheBody, waiting for it to be written if necessary
+type cacheBodyReader struct {
+	body   *cacheBody
+	ctx    context.Context
+	offset int64
+	to     int64
+	block  func() func()
+}
+
+// Read implements io.Reader for a cacheBodyReader
+func (r *cacheBodyReader) Read(p []byte) (int, error) {
+	b := r.body
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if r.offset >= int64(len(b.data)) && !b.complete {
+		if r.block != nil {
+			unblock := r.block()
+			defer unblock()
+		}
+
+		// Wake up the wait below if ctx is done before the body is. The broadcast needs b.mu, so it
+		// can't happen between checking ctx and waiting.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-r.ctx.Done():
+				b.mu.Lock()
+				b.cond.Broadcast()
+				b.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+	for r.offset >= int64(len(b.data)) && !b.complete {
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+		b.cond.Wait()
+	}
+
+	if r.offset >= int64(len(b.data)) && b.err != nil {
+		return 0, b.err
+	}
+
+	end := int64(len(b.data))
+	if r.to >= 0 && r.to+1 < end {
+		end = r.to + 1
+	}
+	if r.offset >= end {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b.data[r.offset:end])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// Close implements io.Closer for a cacheBodyReader
+func (r *cacheBodyReader) Close() error {
+	return nil
+}
+
+// cacheBodyWriter is the writer for the body of an object being inserted under key. Closing it
+// finishes the body, and abandoning it leaves the body unfinished. Either way, if the body isn't
+// complete the object is dropped from the cache.
+type cacheBodyWriter struct {
+	cache *coreCache
+	key   string
+	body  *cacheBody
+}
+
+// Write implements io.Writer for a cacheBodyWriter
+func (w *cacheBodyWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+// Close implements io.Closer for a cacheBodyWriter
+func (w *cacheBodyWriter) Close() error {
+	err := w.body.Close()
+	if err != nil {
+		w.cache.drop(w.key, w.body)
+	}
+	return err
+}
+
+// abandon is used in place of Close when the guest is torn down without closing the body
+func (w *cacheBodyWriter) abandon() {
+	w.body.abandon(errCacheBodyAbandoned)
+	w.cache.drop(w.key, w.body)
+}
@@ -0,0 +1,97 @@
+package fastlike
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestCacheBodyReader(t *testing.T) {
+	t.Parallel()
+
+	t.Run("abandoned", func(st *testing.T) {
+		st.Parallel()
+
+		c := newCoreCache()
+		body := newCacheBody(-1)
+		c.insert("k", &cacheObject{maxAge: time.Minute, inserted: c.now(), hits: new(uint64), body: body})
+
+		w := c.writer("k", body)
+		w.Write([]byte("half"))
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			b, err := ioutil.ReadAll(body.Reader(context.Background(), 0, -1, nil))
+			if string(b) != "half" || err != errCacheBodyAbandoned {
+				st.Logf("expected what was written and then an error, got %q (%v)", b, err)
+				st.Fail()
+			}
+		}()
+
+		w.(*cacheBodyWriter).abandon()
+		<-done
+
+		if obj := c.lookup("k", nil); obj != nil || len(c.entries) != 0 {
+			st.Logf("expected the abandoned object to be dropped, got %v with %d entries", obj, len(c.entries))
+			st.Fail()
+		}
+	})
+
+	t.Run("cancelled", func(st *testing.T) {
+		st.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			_, err := ioutil.ReadAll(newCacheBody(-1).Reader(ctx, 0, -1, nil))
+			done <- err
+		}()
+		cancel()
+
+		select {
+		case err := <-done:
+			if err != context.Canceled {
+				st.Logf("expected the read to be cancelled, got %v", err)
+				st.Fail()
+			}
+		case <-time.After(time.Second):
+			st.Log("expected cancelling the context to stop the read waiting")
+			st.Fail()
+		}
+	})
+}
+
+func TestCoreCacheEntries(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newCoreCache()
+	c.now = func() time.Time { return now }
+
+	// Transactions which are given up on don't leave an entry behind
+	for _, key := range []string{"a", "b", "c"} {
+		_, tx, err := c.transactionLookup(context.Background(), key, nil)
+		if err != nil || tx == nil {
+			t.Fatalf("expected a transaction for %q, got %v", key, err)
+		}
+		tx.cancel()
+	}
+	if len(c.entries) != 0 {
+		t.Logf("expected no entries after cancelling, got %d", len(c.entries))
+		t.Fail()
+	}
+
+	c.insert("expires", &cacheObject{inserted: now, maxAge: time.Second, hits: new(uint64), body: newCacheBody(0)})
+	c.insert("lasts", &cacheObject{inserted: now, maxAge: time.Hour, hits: new(uint64), body: newCacheBody(0)})
+
+	// Inserting sweeps away objects which have expired
+	now = now.Add(coreCacheSweepInterval)
+	c.insert("new", &cacheObject{inserted: now, maxAge: time.Hour, hits: new(uint64), body: newCacheBody(0)})
+
+	if _, ok := c.entries["expires"]; ok || len(c.entries) != 2 {
+		t.Logf("expected the expired object to be swept away, got %d entries", len(c.entries))
+		t.Fail()
+	}
+}
@@ -0,0 +1,144 @@
+package fastlike_test
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// coreCacheWat uses a cache transaction to look up "k". If it has to insert the object, it does so
+// with a 60s max age, tagged with the "k1" surrogate key, and responds with a 201. Either way, the
+// response body is whatever's in the cache.
+var coreCacheWat = guest(`
+	(import "fastly_cache" "transaction_lookup" (func $tx_lookup (param i32 i32 i32 i32 i32) (result i32)))
+	(import "fastly_cache" "transaction_insert_and_stream_back" (func $tx_insert (param i32 i32 i32 i32 i32) (result i32)))
+	(import "fastly_cache" "get_state" (func $get_state (param i32 i32) (result i32)))
+	(import "fastly_cache" "get_body" (func $get_body (param i32 i32 i32 i32) (result i32)))`, `
+	(data (i32.const 1024) "k")
+	(data (i32.const 1040) "cached body")
+	(data (i32.const 1056) "k1")
+	(func (export "_start")
+		(local $h i32)
+		(local $status i32)
+		(local.set $status (i32.const 200))
+		(drop (call $tx_lookup (i32.const 1024) (i32.const 1) (i32.const 0) (i32.const 0) (i32.const 0)))
+		(drop (call $get_state (i32.load (i32.const 0)) (i32.const 4)))
+		(local.set $h (i32.load (i32.const 0)))
+		(if (i32.and (i32.load (i32.const 4)) (i32.const 8))
+			(then
+				(i64.store (i32.const 64) (i64.const 60000000000))
+				(i32.store (i32.const 104) (i32.const 1056))
+				(i32.store (i32.const 108) (i32.const 2))
+				(drop (call $tx_insert (local.get $h) (i32.const 32) (i32.const 64) (i32.const 8) (i32.const 12)))
+				(drop (call $body_write (i32.load (i32.const 8)) (i32.const 1040) (i32.const 11) (i32.const 0) (i32.const 24)))
+				(drop (call $body_close (i32.load (i32.const 8))))
+				(local.set $h (i32.load (i32.const 12)))
+				(local.set $status (i32.const 201))))
+		(drop (call $get_body (local.get $h) (i32.const 0) (i32.const 0) (i32.const 16)))
+		(call $respond (local.get $status) (i32.load (i32.const 16))))`)
+
+func TestCoreCache(t *testing.T) {
+	t.Parallel()
+
+	f := newGuest(t, coreCacheWat)
+
+	get := func() (int, string) {
+		w := serve(f)
+		return w.Code, w.Body.String()
+	}
+
+	for _, expected := range []int{http.StatusCreated, http.StatusOK, http.StatusOK} {
+		code, body := get()
+		if code != expected || body != "cached body" {
+			t.Logf("expected %d with the cached body, got %d: %q", expected, code, body)
+			t.Fail()
+		}
+	}
+
+	if purged := f.PurgeSurrogateKey("k1", false); purged != 1 {
+		t.Logf("expected 1 object purged, got %d", purged)
+		t.Fail()
+	}
+
+	// Once purged, concurrent lookups are collapsed so that only one of them inserts the object
+	var wg sync.WaitGroup
+	var inserted int32
+	for j := 0; j < 4; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, body := get()
+			if code == http.StatusCreated {
+				atomic.AddInt32(&inserted, 1)
+			}
+			if body != "cached body" {
+				t.Logf("expected the cached body, got %q", body)
+				t.Fail()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if inserted != 1 {
+		t.Logf("expected the object to be inserted once, got %d", inserted)
+		t.Fail()
+	}
+}
+
+// partialCacheWat responds with the body cached under "p" if there is one. Otherwise it inserts the
+// object with the write options in mask, which can declare a length of 10, writes 5 bytes of the
+// body, and then does whatever finish says.
+func partialCacheWat(mask, finish string) string {
+	return guest(`
+	(import "fastly_cache" "lookup" (func $lookup (param i32 i32 i32 i32 i32) (result i32)))
+	(import "fastly_cache" "transaction_lookup" (func $tx_lookup (param i32 i32 i32 i32 i32) (result i32)))
+	(import "fastly_cache" "transaction_insert" (func $tx_insert (param i32 i32 i32 i32) (result i32)))
+	(import "fastly_cache" "get_state" (func $get_state (param i32 i32) (result i32)))
+	(import "fastly_cache" "get_body" (func $get_body (param i32 i32 i32 i32) (result i32)))`, `
+	(data (i32.const 1024) "p")
+	(data (i32.const 1040) "hello")
+	(func (export "_start")
+		(drop (call $lookup (i32.const 1024) (i32.const 1) (i32.const 0) (i32.const 0) (i32.const 0)))
+		(drop (call $get_state (i32.load (i32.const 0)) (i32.const 4)))
+		(if (i32.and (i32.load (i32.const 4)) (i32.const 1))
+			(then
+				(drop (call $get_body (i32.load (i32.const 0)) (i32.const 0) (i32.const 0) (i32.const 16)))
+				(call $respond (i32.const 200) (i32.load (i32.const 16)))
+				(return)))
+		(drop (call $tx_lookup (i32.const 1024) (i32.const 1) (i32.const 0) (i32.const 0) (i32.const 0)))
+		(i64.store (i32.const 64) (i64.const 60000000000))
+		(i64.store (i32.const 112) (i64.const 10))
+		(drop (call $tx_insert (i32.load (i32.const 0)) (i32.const `+mask+`) (i32.const 64) (i32.const 8)))
+		(drop (call $body_write (i32.load (i32.const 8)) (i32.const 1040) (i32.const 5) (i32.const 0) (i32.const 24)))
+		`+finish+`)`)
+}
+
+func TestCoreCachePartialBody(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		mask     string
+		finish   string
+		expected int
+	}{
+		// The guest traps with the body still open, so it's abandoned rather than closed
+		{"trap", "0", `(unreachable)`, http.StatusInternalServerError},
+		// The guest closes the body, but it's shorter than the length it was declared with
+		{"short", "64", `(drop (call $body_close (i32.load (i32.const 8)))) (call $respond (i32.const 201) (call $body))`, http.StatusCreated},
+	}
+
+	for _, c := range cases {
+		f := newGuest(t, partialCacheWat(c.mask, c.finish))
+
+		// Nothing is left in the cache, so the second request has to insert the object again rather
+		// than being served the partial body
+		for j := 0; j < 2; j++ {
+			if w := serve(f); w.Code != c.expected {
+				t.Logf("%s: expected request %d to get a %d, got %d: %q", c.name, j, c.expected, w.Code, w.Body.String())
+				t.Fail()
+			}
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package fastlike
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// DeviceLookupFunc returns the device detection data for a user agent, as JSON, and whether there is
+// any. The data is handed to the guest as it is, so it should be in the same shape as Fastly's.
+type DeviceLookupFunc func(ua string) ([]byte, bool)
+
+func defaultDeviceLookup(_ string) ([]byte, bool) {
+	return nil, false
+}
+
+// NewDeviceDetectionLookup returns a function for WithDeviceDetection which reads device detection
+// data from a JSON file. The file is an object mapping user agents to the data for them:
+//
+//	{"Mozilla/5.0 (iPhone; ...)": {"device": {"name": "iPhone", "is_mobile": true}}}
+func NewDeviceDetectionLookup(path string) (DeviceLookupFunc, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	content := map[string]json.RawMessage{}
+	if err := json.NewDecoder(fd).Decode(&content); err != nil {
+		return nil, err
+	}
+
+	return func(ua string) ([]byte, bool) {
+		data, ok := content[ua]
+		return data, ok
+	}, nil
+}
@@ -0,0 +1,57 @@
+package fastlike_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Khan/fastlike"
+)
+
+// deviceDetectionWat looks up the device detection data for a user agent using a buffer of the given
+// size, and responds with the result. Use it with fmt.Sprintf, supplying the user agent, its length,
+// and the buffer size.
+var deviceDetectionWat = guest(`(import "fastly_device_detection" "lookup" (func $lookup (param i32 i32 i32 i32 i32) (result i32)))`, `
+	(data (i32.const 1024) "%s")
+	(func (export "_start")
+		(call $respond_result
+			(call $lookup (i32.const 1024) (i32.const %d) (i32.const 2048) (i32.const %d) (i32.const 16))
+			(i32.const 2048)
+			(i32.load (i32.const 16))))`)
+
+func TestDeviceDetection(t *testing.T) {
+	t.Parallel()
+
+	data := `{"Fastlike/1.0": {"device": {"name": "Fastlike", "is_mobile": true}}}`
+	path := filepath.Join(t.TempDir(), "devices.json")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("expected no error, got %s", err.Error())
+	}
+
+	lookup, err := fastlike.NewDeviceDetectionLookup(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err.Error())
+	}
+
+	cases := []struct {
+		name   string
+		ua     string
+		size   int
+		status int32
+	}{
+		{"found", "Fastlike/1.0", 1024, fastlike.XqdStatusOK},
+		{"too small", "Fastlike/1.0", 8, fastlike.XqdErrBufferLength},
+		{"missing", "Other/1.0", 1024, fastlike.XqdErrNone},
+	}
+
+	for _, c := range cases {
+		expected := ""
+		if c.status == fastlike.XqdStatusOK {
+			expected = `{"device": {"name": "Fastlike", "is_mobile": true}}`
+		}
+
+		h := newGuest(t, fmt.Sprintf(deviceDetectionWat, c.ua, len(c.ua), c.size), fastlike.WithDeviceDetection(lookup))
+		expectResponse(t, c.name, h, resultCode(c.status), expected)
+	}
+}
@@ -1,8 +1,21 @@
 package fastlike
 
+// LookupFunc returns the value for key in a dictionary. It can't tell the guest that a key is
+// missing, so every key is found, and missing ones are empty. Use a DictionaryLookupFunc to tell the
+// two apart.
 type LookupFunc func(key string) string
 
-func (i *Instance) addDictionary(name string, fn LookupFunc) {
+// DictionaryLookupFunc returns the value for key in a dictionary, and whether the key exists
+type DictionaryLookupFunc func(key string) (string, bool)
+
+// toDictionaryLookupFunc adapts a LookupFunc, which finds every key
+func (fn LookupFunc) toDictionaryLookupFunc() DictionaryLookupFunc {
+	return func(key string) (string, bool) {
+		return fn(key), true
+	}
+}
+
+func (i *Instance) addDictionary(name string, fn DictionaryLookupFunc) {
 	if i.dictionaries == nil {
 		i.dictionaries = []dictionary{}
 	}
@@ -20,8 +33,8 @@ func (i *Instance) getDictionaryHandle(name string) int {
 	return HandleInvalid
 }
 
-func (i *Instance) getDictionary(handle int) LookupFunc {
-	if handle > len(i.dictionaries)-1 {
+func (i *Instance) getDictionary(handle int) DictionaryLookupFunc {
+	if handle < 0 || handle > len(i.dictionaries)-1 {
 		return nil
 	}
 
@@ -30,5 +43,5 @@ func (i *Instance) getDictionary(handle int) LookupFunc {
 
 type dictionary struct {
 	name string
-	get  LookupFunc
+	get  DictionaryLookupFunc
 }
@@ -0,0 +1,68 @@
+package fastlike_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Khan/fastlike"
+)
+
+// configStoreWat looks up a key in the "config" config store using a buffer of the given size, and
+// responds with the result. Use it with fmt.Sprintf, supplying the key, its length, and the buffer
+// size.
+var configStoreWat = guest(`
+	(import "fastly_config_store" "open" (func $open (param i32 i32 i32) (result i32)))
+	(import "fastly_config_store" "get" (func $get (param i32 i32 i32 i32 i32 i32) (result i32)))`, `
+	(data (i32.const 1024) "config")
+	(data (i32.const 1040) "%s")
+	(func (export "_start")
+		(drop (call $open (i32.const 1024) (i32.const 6) (i32.const 0)))
+		(call $respond_result
+			(call $get (i32.load (i32.const 0)) (i32.const 1040) (i32.const %d) (i32.const 2048) (i32.const %d) (i32.const 16))
+			(i32.const 2048)
+			(i32.load (i32.const 16))))`)
+
+func TestConfigStore(t *testing.T) {
+	t.Parallel()
+
+	values := map[string]string{"key": "value", "empty": ""}
+	lookup := func(key string) (string, bool) {
+		v, ok := values[key]
+		return v, ok
+	}
+	legacy := func(key string) string {
+		return values[key]
+	}
+
+	modern := fastlike.WithDictionaryLookup("config", lookup)
+
+	// Keys which are found respond with their value from values
+	cases := []struct {
+		name   string
+		opt    fastlike.Option
+		key    string
+		size   int
+		status int32
+	}{
+		{"found", modern, "key", 256, fastlike.XqdStatusOK},
+		{"empty", modern, "empty", 256, fastlike.XqdStatusOK},
+		{"missing", modern, "other", 256, fastlike.XqdErrNone},
+		{"too small", modern, "key", 2, fastlike.XqdErrBufferLength},
+		// Dictionaries and config stores are the same thing, so either option will do
+		{"dictionary", fastlike.WithDictionary("config", legacy), "key", 256, fastlike.XqdStatusOK},
+		{"config store", fastlike.WithConfigStore("config", legacy), "key", 256, fastlike.XqdStatusOK},
+		// Without a way to tell, missing keys are found and empty, as they always were
+		{"legacy empty", fastlike.WithDictionary("config", legacy), "empty", 256, fastlike.XqdStatusOK},
+		{"legacy missing", fastlike.WithDictionary("config", legacy), "other", 256, fastlike.XqdStatusOK},
+	}
+
+	for _, c := range cases {
+		expected := ""
+		if c.status == fastlike.XqdStatusOK {
+			expected = values[c.key]
+		}
+
+		h := newGuest(t, fmt.Sprintf(configStoreWat, c.key, len(c.key), c.size), c.opt)
+		expectResponse(t, c.name, h, resultCode(c.status), expected)
+	}
+}
@@ -0,0 +1,236 @@
+package fastlike
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// DynamicBackend describes a backend registered by the guest while it's running, rather than up
+// front with WithBackend
+type DynamicBackend struct {
+	// Name is what the guest sends requests to the backend as
+	Name string
+
+	// Target is the address of the backend, as host:port
+	Target string
+
+	// HostOverride, if set, is used as the Host header of requests to the backend
+	HostOverride string
+
+	ConnectTimeout      time.Duration
+	FirstByteTimeout    time.Duration
+	BetweenBytesTimeout time.Duration
+
+	// UseSSL means the backend is reached over TLS, with the rest of these settings
+	UseSSL        bool
+	SSLMinVersion uint16
+	SSLMaxVersion uint16
+
+	// CertHostname is the hostname the backend's certificate is checked against, if it's not the
+	// SNIHostname
+	CertHostname string
+	SNIHostname  string
+
+	// CACert is a PEM encoded certificate to trust instead of the system roots
+	CACert string
+
+	// Ciphers is an OpenSSL cipher list. Go doesn't let you choose from nearly as many ciphers, so
+	// it's only kept for reference.
+	Ciphers string
+
+	// DontPool means connections to the backend aren't reused
+	DontPool bool
+}
+
+// DynamicBackendPolicy is called whenever the guest registers a dynamic backend, and may veto it by
+// returning an error
+type DynamicBackendPolicy func(b DynamicBackend) error
+
+// ErrDynamicBackendsDisabled is reported when the guest tries to register a dynamic backend without
+// WithDynamicBackends
+var ErrDynamicBackendsDisabled = errors.New("dynamic backends are disabled")
+
+// dynamicBackend is a dynamic backend which has been registered, along with the handler requests to
+// it are sent to, and the transport the handler uses
+type dynamicBackend struct {
+	config    DynamicBackend
+	handler   http.Handler
+	transport *http.Transport
+}
+
+// tlsVersions maps the TLS versions guests use to Go's
+var tlsVersions = map[uint32]uint16{
+	0: tls.VersionTLS10,
+	1: tls.VersionTLS11,
+	2: tls.VersionTLS12,
+	3: tls.VersionTLS13,
+}
+
+// addDynamicBackend registers a dynamic backend. Its name mustn't be in use by any other backend.
+func (i *Instance) addDynamicBackend(b DynamicBackend) error {
+	if !i.dynamicBackendsAllowed {
+		return ErrDynamicBackendsDisabled
+	}
+
+	if i.dynamicBackendPolicy != nil {
+		if err := i.dynamicBackendPolicy(b); err != nil {
+			return err
+		}
+	}
+
+	handler, transport, err := dynamicBackendProxy(b)
+	if err != nil {
+		return err
+	}
+
+	i.dynamicMu.Lock()
+	defer i.dynamicMu.Unlock()
+
+	if _, ok := i.backends[b.Name]; ok {
+		return errBackendNameInUse
+	} else if _, ok := i.dynamicBackends[b.Name]; ok {
+		return errBackendNameInUse
+	}
+
+	i.dynamicBackends[b.Name] = &dynamicBackend{config: b, handler: handler, transport: transport}
+	return nil
+}
+
+var errBackendNameInUse = errors.New("backend name is already in use")
+
+// cacheName returns the name responses from the backend are cached under. A dynamic backend only
+// lasts as long as the instance which registered it, and the next one to use the name may send
+// requests somewhere else entirely, so the name includes where they're sent.
+func (b *dynamicBackend) cacheName() string {
+	scheme := "http"
+	if b.config.UseSSL {
+		scheme = "https"
+	}
+	return b.config.Name + "\x00" + scheme + "://" + b.config.Target + "\x00" + b.config.HostOverride
+}
+
+// getDynamicBackend returns the dynamic backend registered with name, or nil if there isn't one.
+// Requests are sent to backends in their own goroutines, so this is safe to call concurrently with
+// addDynamicBackend.
+func (i *Instance) getDynamicBackend(name string) *dynamicBackend {
+	i.dynamicMu.RLock()
+	defer i.dynamicMu.RUnlock()
+	return i.dynamicBackends[name]
+}
+
+// dynamicBackendProxy returns a handler which proxies requests to the dynamic backend, along with
+// the transport it uses, so its connections can be closed once the backend is gone
+func dynamicBackendProxy(b DynamicBackend) (http.Handler, *http.Transport, error) {
+	target := &url.URL{Scheme: "http", Host: b.Target}
+
+	dialer := &net.Dialer{Timeout: b.ConnectTimeout}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil || b.BetweenBytesTimeout == 0 {
+				return conn, err
+			}
+			return &idleTimeoutConn{conn, b.BetweenBytesTimeout}, nil
+		},
+		ResponseHeaderTimeout: b.FirstByteTimeout,
+		DisableKeepAlives:     b.DontPool,
+
+		// Requests still in flight when the backend is dropped leave their connections behind, so
+		// make sure those don't stick around forever
+		IdleConnTimeout: 90 * time.Second,
+	}
+
+	if b.UseSSL {
+		target.Scheme = "https"
+
+		config, err := dynamicBackendTLSConfig(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		transport.TLSClientConfig = config
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		if b.HostOverride != "" {
+			req.Host = b.HostOverride
+		}
+	}
+
+	return proxy, transport, nil
+}
+
+// dynamicBackendTLSConfig returns the TLS settings for connecting to the dynamic backend
+func dynamicBackendTLSConfig(b DynamicBackend) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: b.SSLMinVersion,
+		MaxVersion: b.SSLMaxVersion,
+		ServerName: b.SNIHostname,
+	}
+
+	if config.ServerName == "" {
+		config.ServerName = b.CertHostname
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(b.Target)
+	}
+
+	if b.CACert != "" {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM([]byte(b.CACert)) {
+			return nil, errors.New("invalid CA certificate")
+		}
+	}
+
+	// Go checks the certificate against the SNI hostname, so checking it against anything else means
+	// doing the verification ourselves
+	if b.CertHostname != "" && b.CertHostname != config.ServerName {
+		roots := config.RootCAs
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("no certificate")
+			}
+
+			opts := x509.VerifyOptions{
+				DNSName:       b.CertHostname,
+				Roots:         roots,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+
+	return config, nil
+}
+
+// idleTimeoutConn is a net.Conn which fails reads that wait for longer than timeout
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// Read implements io.Reader for an idleTimeoutConn
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
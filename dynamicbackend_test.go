@@ -0,0 +1,218 @@
+package fastlike_test
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Khan/fastlike"
+)
+
+// dynamicBackendWat registers a dynamic backend named "dyn" with a host override of "example.test",
+// and sends downstream whatever it responds with. If registering the backend fails, it responds with
+// 200 plus the status instead. Use it with fmt.Sprintf, supplying the target and its length.
+var dynamicBackendWat = guest(`(import "fastly_http_req" "register_dynamic_backend" (func $register (param i32 i32 i32 i32 i32 i32) (result i32)))`, `
+	(data (i32.const 1024) "http://dyn/")
+	(data (i32.const 1040) "dyn")
+	(data (i32.const 1056) "%s")
+	(data (i32.const 1100) "example.test")
+	(func (export "_start")
+		(local $status i32)
+		(i32.store (i32.const 2048) (i32.const 1100))
+		(i32.store (i32.const 2052) (i32.const 12))
+		(local.set $status (call $register (i32.const 1040) (i32.const 3) (i32.const 1056) (i32.const %d) (i32.const 2) (i32.const 2048)))
+		(if (local.get $status)
+			(then
+				(call $respond (i32.add (i32.const 200) (local.get $status)) (call $body))
+				(return)))
+		(call $proxy (call $request (i32.const 1024) (i32.const 11)) (i32.const 1040) (i32.const 3)))`)
+
+func TestDynamicBackends(t *testing.T) {
+	t.Parallel()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("host=" + r.Host))
+	}))
+	defer origin.Close()
+
+	target := strings.TrimPrefix(origin.URL, "http://")
+	wat := fmt.Sprintf(dynamicBackendWat, target, len(target))
+
+	veto := fastlike.WithDynamicBackendPolicy(func(b fastlike.DynamicBackend) error {
+		if b.Target == target && b.HostOverride == "example.test" {
+			return errors.New("not allowed")
+		}
+		return nil
+	})
+	static := fastlike.WithBackend("dyn", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Log("expected the static backend to be left alone")
+		t.Fail()
+	}))
+
+	cases := []struct {
+		name     string
+		options  []fastlike.Option
+		code     int
+		expected string
+	}{
+		{"allowed", []fastlike.Option{fastlike.WithDynamicBackends(true)}, 200, "host=example.test"},
+		{"disabled", nil, 205, ""},
+		{"vetoed", []fastlike.Option{fastlike.WithDynamicBackends(true), veto}, 202, ""},
+		{"name in use", []fastlike.Option{fastlike.WithDynamicBackends(true), static}, 202, ""},
+	}
+
+	for _, c := range cases {
+		f := newGuest(t, wat, c.options...)
+
+		// Run each case twice, so the second request reuses the instance with the backend already
+		// registered on it
+		for n := 0; n < 2; n++ {
+			expectResponse(t, c.name, f, c.code, c.expected)
+		}
+	}
+}
+
+func TestDynamicBackendCache(t *testing.T) {
+	t.Parallel()
+
+	origin := func(name string) string {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(s.Close)
+		return strings.TrimPrefix(s.URL, "http://")
+	}
+
+	// Both guests register a backend named "dyn" and send it the same request, but to different
+	// targets, so neither should be served the other's cached response
+	cache := fastlike.NewCache(nil)
+	for _, name := range []string{"a", "b", "a"} {
+		target := origin(name)
+		f := newGuest(t, fmt.Sprintf(dynamicBackendWat, target, len(target)), fastlike.WithDynamicBackends(true), fastlike.WithCache(cache))
+
+		if w := serve(f); w.Body.String() != name || w.Header().Get("X-Cache") != "MISS" {
+			t.Logf("expected a MISS from %s, got %s from %q", name, w.Header().Get("X-Cache"), w.Body.String())
+			t.Fail()
+		}
+	}
+}
+
+// dynamicBoundsWat registers a dynamic backend with a connect timeout, and the config at the address
+// given by the format argument. It responds with 200 plus the status.
+var dynamicBoundsWat = guest(`(import "fastly_http_req" "register_dynamic_backend" (func $register (param i32 i32 i32 i32 i32 i32) (result i32)))`, `
+	(data (i32.const 1040) "dyn")
+	(data (i32.const 1056) "localhost:80")
+	(func (export "_start")
+		(call $respond
+			(i32.add (i32.const 200) (call $register (i32.const 1040) (i32.const 3) (i32.const 1056) (i32.const 12) (i32.const 4) (i32.const %d)))
+			(call $body)))`)
+
+func TestDynamicBackendConfigBounds(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		addr   int
+		status int32
+	}{
+		{"in bounds", 2048, fastlike.XqdStatusOK},
+		{"past the end", 65530, fastlike.XqdErrInvalidArgument},
+		{"negative", -8, fastlike.XqdErrInvalidArgument},
+	}
+
+	for _, c := range cases {
+		h := newGuest(t, fmt.Sprintf(dynamicBoundsWat, c.addr), fastlike.WithDynamicBackends(true))
+		expectResponse(t, c.name, h, resultCode(c.status), "")
+	}
+}
+
+// dynamicConfigWat registers a dynamic backend named "dyn" with the target, config mask, cert
+// hostname and CA certificate given by the format arguments, and a first byte timeout of 50ms. It
+// checks that the backend is dynamic before sending downstream whatever it responds with. If
+// registering the backend fails, it responds with 200 plus the status instead.
+var dynamicConfigWat = guest(`
+	(import "fastly_http_req" "register_dynamic_backend" (func $register (param i32 i32 i32 i32 i32 i32) (result i32)))
+	(import "fastly_backend" "is_dynamic" (func $is_dynamic (param i32 i32 i32) (result i32)))`, `
+	(data (i32.const 1024) "http://dyn/")
+	(data (i32.const 1040) "dyn")
+	(data (i32.const 1056) "%s")
+	(data (i32.const 1100) "%s")
+	(data (i32.const 4096) "%s")
+	(func (export "_start")
+		(local $status i32)
+		(i32.store (i32.const 2060) (i32.const 50))
+		(i32.store (i32.const 2076) (i32.const 1100))
+		(i32.store (i32.const 2080) (i32.const %d))
+		(i32.store (i32.const 2084) (i32.const 4096))
+		(i32.store (i32.const 2088) (i32.const %d))
+		(local.set $status (call $register (i32.const 1040) (i32.const 3) (i32.const 1056) (i32.const %d) (i32.const %d) (i32.const 2048)))
+		(if (local.get $status)
+			(then
+				(call $respond (i32.add (i32.const 200) (local.get $status)) (call $body))
+				(return)))
+		(drop (call $is_dynamic (i32.const 1040) (i32.const 3) (i32.const 32)))
+		(if (i32.ne (i32.load (i32.const 32)) (i32.const 1))
+			(then
+				(call $respond (i32.const 500) (call $body))
+				(return)))
+		(call $proxy (call $request (i32.const 1024) (i32.const 11)) (i32.const 1040) (i32.const 3)))`)
+
+func TestDynamicBackendConfig(t *testing.T) {
+	t.Parallel()
+
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer secure.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: secure.Certificate().Raw}))
+	secureTarget := strings.TrimPrefix(secure.URL, "https://")
+	slowTarget := strings.TrimPrefix(slow.URL, "http://")
+
+	// Bits of the config mask
+	const (
+		firstByte    = 1 << 3
+		useSSL       = 1 << 5
+		certHostname = 1 << 8
+		caCert       = 1 << 9
+	)
+
+	cases := []struct {
+		name     string
+		target   string
+		mask     int
+		hostname string
+		caLen    int
+		code     int
+		expected string
+	}{
+		{"tls", secureTarget, useSSL | caCert, "", len(ca), 200, "secure"},
+		{"untrusted", secureTarget, useSSL, "", len(ca), 502, ""},
+		{"cert hostname", secureTarget, useSSL | caCert | certHostname, "example.com", len(ca), 200, "secure"},
+		{"wrong cert hostname", secureTarget, useSSL | caCert | certHostname, "wrong.example", len(ca), 502, ""},
+		{"out of bounds", secureTarget, useSSL | caCert, "", 1 << 30, resultCode(fastlike.XqdErrInvalidArgument), ""},
+		{"first byte timeout", slowTarget, firstByte, "", 0, 502, ""},
+		{"no timeout", slowTarget, 0, "", 0, 200, "slow"},
+	}
+
+	for _, c := range cases {
+		wat := fmt.Sprintf(dynamicConfigWat, c.target, c.hostname, watBytes([]byte(ca)), len(c.hostname), c.caLen, len(c.target), c.mask)
+		w := serve(newGuest(t, wat, fastlike.WithDynamicBackends(true)))
+		if w.Code != c.code || (c.code == 200 && w.Body.String() != c.expected) {
+			t.Logf("%s: expected %d %q, got %d %q", c.name, c.code, c.expected, w.Code, w.Body.String())
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package fastlike
+
+import "fmt"
+
+// ReadError is returned when the wasm program can't be read
+type ReadError struct {
+	Err error
+}
+
+func (e *ReadError) Error() string {
+	return fmt.Sprintf("reading wasm program: %s", e.Err.Error())
+}
+
+// Unwrap returns the underlying error
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// CompileError is returned when the wasm program isn't a valid module
+type CompileError struct {
+	Err error
+}
+
+func (e *CompileError) Error() string {
+	return fmt.Sprintf("compiling wasm program: %s", e.Err.Error())
+}
+
+// Unwrap returns the underlying error
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+// LinkError is returned when the wasm program can't be instantiated, most often because it imports
+// a host function fastlike doesn't implement
+type LinkError struct {
+	Err error
+}
+
+func (e *LinkError) Error() string {
+	return fmt.Sprintf("linking wasm program: %s", e.Err.Error())
+}
+
+// Unwrap returns the underlying error
+func (e *LinkError) Unwrap() error {
+	return e.Err
+}
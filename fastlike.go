@@ -2,6 +2,8 @@ package fastlike
 
 import (
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"net/http"
 	"runtime"
@@ -9,24 +11,93 @@ import (
 )
 
 // Fastlike is the entrypoint to the package, used to construct new instances ready to serve
-// incoming HTTP requests. It maintains a pool of compiled and linked wasm modules to amortize
-// startup costs across multiple requests. In the case of a spike of incoming requests, new
-// instances will be constructed on-demand and thrown away when the request is finished to avoid an
-// ever-increasing memory cost.
+// incoming HTTP requests. The wasm program is compiled once and shared by every instance, and a
+// pool of linked instances is maintained to amortize startup costs across multiple requests. In the
+// case of a spike of incoming requests, new instances will be constructed on-demand and thrown away
+// when the request is finished to avoid an ever-increasing memory cost.
 type Fastlike struct {
 	instances chan *Instance
 
 	// instancefn is called when a new instance must be created from scratch
 	instancefn func(opts ...Option) *Instance
+
+	// cache is the cache shared by the instances, if they have one
+	cache *Cache
+
+	// coreCache is the core cache shared by the instances
+	coreCache *coreCache
 }
 
-// New returns a new Fastlike ready to create new instances from
+// New returns a new Fastlike ready to create new instances from.
+// It panics if the wasm program can't be read, compiled, or linked. Use NewE to handle those errors
+// instead.
 func New(wasmfile string, instanceOpts ...Option) *Fastlike {
-	var f = &Fastlike{}
+	f, err := NewE(wasmfile, instanceOpts...)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
 
-	// read in the file and store the bytes
+// NewE returns a new Fastlike ready to create new instances from, or an error if the wasm program
+// can't be read (a *ReadError), compiled (a *CompileError), or linked (a *LinkError).
+// The file may contain either a compiled WebAssembly module or WebAssembly text.
+func NewE(wasmfile string, instanceOpts ...Option) (*Fastlike, error) {
 	wasmbytes, err := ioutil.ReadFile(wasmfile)
-	check(err)
+	if err != nil {
+		return nil, &ReadError{err}
+	}
+
+	return newFastlike(wasmbytes, instanceOpts...)
+}
+
+// NewFromBytes returns a new Fastlike for the wasm program in wasmbytes, which may be either a
+// compiled WebAssembly module or WebAssembly text. This is handy for programs embedded with
+// `//go:embed`, and for tests with tiny inline guests.
+func NewFromBytes(wasmbytes []byte, instanceOpts ...Option) (*Fastlike, error) {
+	return newFastlike(wasmbytes, instanceOpts...)
+}
+
+// NewFromReader returns a new Fastlike for the wasm program read from r
+func NewFromReader(r io.Reader, instanceOpts ...Option) (*Fastlike, error) {
+	wasmbytes, err := io.ReadAll(r)
+	if err != nil {
+		return nil, &ReadError{err}
+	}
+
+	return newFastlike(wasmbytes, instanceOpts...)
+}
+
+// NewFromFS returns a new Fastlike for the wasm program at path within fsys, such as an
+// `embed.FS`
+func NewFromFS(fsys fs.FS, path string, instanceOpts ...Option) (*Fastlike, error) {
+	wasmbytes, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return nil, &ReadError{err}
+	}
+
+	return newFastlike(wasmbytes, instanceOpts...)
+}
+
+func newFastlike(wasmbytes []byte, instanceOpts ...Option) (*Fastlike, error) {
+	var f = &Fastlike{coreCache: newCoreCache()}
+	var rateLimiter = NewRateLimiter(nil)
+
+	// Every instance shares the same core cache and rate limiter, the way they would on a Fastly POP
+	instanceOpts = append([]Option{func(i *Instance) {
+		i.coreCache = f.coreCache
+		i.rateLimiter = rateLimiter
+	}}, instanceOpts...)
+
+	// compile the program once, up front, so new instances only need to be linked
+	// The memory limit is baked into the compiled program, so it has to be known up front
+	cfg := configure(instanceOpts...)
+	engine, module, err := compile(wasmbytes, cfg.memoryLimit, cfg.log)
+	if err != nil {
+		return nil, err
+	}
+
+	f.cache = cfg.cache
 
 	var size = runtime.NumCPU()
 
@@ -38,12 +109,25 @@ func New(wasmfile string, instanceOpts ...Option) *Fastlike {
 
 	f.instances = make(chan *Instance, size)
 	f.instancefn = func(opts ...Option) *Instance {
-		// merge the original options with any supplied options
-		opts = append(instanceOpts, opts...)
-		return NewInstance(wasmbytes, opts...)
+		// merge the original options with any supplied options, without writing into the shared
+		// backing array of instanceOpts
+		opts = append(append([]Option{}, instanceOpts...), opts...)
+		return newInstance(engine, module, opts...)
 	}
 
-	return f
+	// Make sure the program can actually be linked before handing it back. The instance we use to
+	// check is as good as any other, so it goes into the pool.
+	i := f.instancefn()
+	if err := i.check(); err != nil {
+		return nil, err
+	}
+	select {
+	case f.instances <- i:
+	default:
+		i.discard()
+	}
+
+	return f, nil
 }
 
 // ServeHTTP implements http.Handler for a Fastlike module. It's a convenience function over
@@ -56,6 +140,7 @@ func (f *Fastlike) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	select {
 	case f.instances <- i:
 	default:
+		i.discard()
 	}
 }
 
@@ -70,9 +155,11 @@ func (f *Fastlike) Warmup(n int) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			i := f.instancefn()
 			select {
-			case f.instances <- f.instancefn():
+			case f.instances <- i:
 			default:
+				i.discard()
 			}
 		}()
 	}
@@ -94,9 +181,3 @@ func (f *Fastlike) Instantiate(opts ...Option) *Instance {
 		return f.instancefn(opts...)
 	}
 }
-
-func check(err error) {
-	if err != nil {
-		panic(err)
-	}
-}
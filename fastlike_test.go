@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/Khan/fastlike"
@@ -119,6 +122,89 @@ func TestFastlike(t *testing.T) {
 		}
 	})
 
+	t.Run("echo", func(st *testing.T) {
+		st.Parallel()
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://localhost:1337/echo", ioutil.NopCloser(strings.NewReader("echo, echo")))
+		i := f.Instantiate(fastlike.WithDefaultBackend(failingBackendHandler(st)))
+		i.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			st.Fail()
+		}
+
+		if w.Body.String() != "echo, echo" {
+			st.Fail()
+		}
+	})
+
+	t.Run("echo-too-large", func(st *testing.T) {
+		st.Parallel()
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://localhost:1337/echo", strings.NewReader("echo, echo"))
+		i := f.Instantiate(
+			fastlike.WithDefaultBackend(failingBackendHandler(st)),
+			fastlike.WithMaxRequestBodySize(4),
+		)
+		i.ServeHTTP(w, r)
+
+		if w.Code != http.StatusRequestEntityTooLarge {
+			st.Logf("expected 413, got %d", w.Code)
+			st.Fail()
+		}
+	})
+
+	t.Run("async", func(st *testing.T) {
+		st.Parallel()
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost:1337/async", ioutil.NopCloser(bytes.NewBuffer(nil)))
+		i := f.Instantiate(fastlike.WithDefaultBackend(testBackendHandler(st, func(w http.ResponseWriter, r *http.Request) {
+			// Make the first request finish last, so that select returns the second one first. The
+			// pending_req_* hostcalls are covered in more detail by TestAsyncRequests.
+			if r.URL.Path == "/async/a" {
+				<-time.After(50 * time.Millisecond)
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(r.URL.Path))
+		})))
+		i.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			st.Fail()
+		}
+
+		actual := w.Body.String()
+		expected := "/async/b\n/async/a"
+		if actual != expected {
+			st.Logf("expected %q, got %q", expected, actual)
+			st.Fail()
+		}
+	})
+
+	t.Run("stream", func(st *testing.T) {
+		st.Parallel()
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost:1337/stream", ioutil.NopCloser(bytes.NewBuffer(nil)))
+		i := f.Instantiate(fastlike.WithDefaultBackend(failingBackendHandler(st)))
+		i.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			st.Fail()
+		}
+
+		if !w.Flushed {
+			st.Log("expected streaming response to be flushed")
+			st.Fail()
+		}
+
+		actual := w.Body.String()
+		expected := "chunk 1\nchunk 2\nchunk 3\n"
+		if actual != expected {
+			st.Logf("expected %q, got %q", expected, actual)
+			st.Fail()
+		}
+	})
+
 	t.Run("append-header", func(st *testing.T) {
 		st.Parallel()
 		// Assert that we can carry headers via subrequests
@@ -290,6 +376,214 @@ func TestFastlike(t *testing.T) {
 	})
 }
 
+func TestNewErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := fastlike.NewE("testdata/does-not-exist.wasm")
+	var readErr *fastlike.ReadError
+	if !errors.As(err, &readErr) {
+		t.Errorf("expected a ReadError, got %v", err)
+	}
+
+	_, err = fastlike.NewInstanceE([]byte("not a wasm program"))
+	var compileErr *fastlike.CompileError
+	if !errors.As(err, &compileErr) {
+		t.Errorf("expected a CompileError, got %v", err)
+	}
+
+	// A program which imports a hostcall that doesn't exist compiles, but can't be linked
+	_, err = fastlike.NewInstanceE([]byte(guest(`(import "fastly_nope" "nope" (func))`, `(func (export "_start"))`)))
+	var linkErr *fastlike.LinkError
+	if !errors.As(err, &linkErr) {
+		t.Errorf("expected a LinkError, got %v", err)
+	}
+
+	_, err = fastlike.NewFromBytes([]byte(`(module (func (export "_start")))`))
+	if !errors.As(err, &linkErr) {
+		t.Errorf("expected a LinkError for a program without memory, got %v", err)
+	}
+}
+
+var helloWat = guest("", `
+	(data (i32.const 1024) "Hello from wat!")
+	(func (export "_start")
+		(call $respond_with (i32.const 200) (i32.const 1024) (i32.const 15)))`)
+
+func TestNewFrom(t *testing.T) {
+	t.Parallel()
+
+	constructors := map[string]func() (*fastlike.Fastlike, error){
+		"bytes": func() (*fastlike.Fastlike, error) {
+			return fastlike.NewFromBytes([]byte(helloWat))
+		},
+		"reader": func() (*fastlike.Fastlike, error) {
+			return fastlike.NewFromReader(strings.NewReader(helloWat))
+		},
+		"fs": func() (*fastlike.Fastlike, error) {
+			fsys := fstest.MapFS{"hello.wat": &fstest.MapFile{Data: []byte(helloWat)}}
+			return fastlike.NewFromFS(fsys, "hello.wat")
+		},
+	}
+
+	for name, fn := range constructors {
+		fn := fn
+		t.Run(name, func(st *testing.T) {
+			st.Parallel()
+			f, err := fn()
+			if err != nil {
+				st.Fatalf("expected no error, got %s", err.Error())
+			}
+
+			w := serve(f)
+			if w.Code != http.StatusOK {
+				st.Fail()
+			}
+
+			actual := w.Body.String()
+			expected := "Hello from wat!"
+			if actual != expected {
+				st.Logf("expected %q, got %q", expected, actual)
+				st.Fail()
+			}
+		})
+	}
+}
+
+// BenchmarkInstantiate measures the per-request cost of a fresh instance, which is what each request
+// pays for when the instance pool is empty.
+func BenchmarkInstantiate(b *testing.B) {
+	if _, perr := os.Stat(wasmfile); os.IsNotExist(perr) {
+		b.Skip("wasm test file does not exist. Try running `cargo build` in ./testdata")
+	}
+
+	f := fastlike.New(wasmfile)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost:1337/simple-response", ioutil.NopCloser(bytes.NewBuffer(nil)))
+
+		// Instances are never returned to the pool, so this always creates a new one
+		i := f.Instantiate()
+		i.ServeHTTP(w, r)
+	}
+}
+
+// BenchmarkServeHTTP measures the per-request cost when instances are reused from the pool
+func BenchmarkServeHTTP(b *testing.B) {
+	if _, perr := os.Stat(wasmfile); os.IsNotExist(perr) {
+		b.Skip("wasm test file does not exist. Try running `cargo build` in ./testdata")
+	}
+
+	f := fastlike.New(wasmfile)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost:1337/simple-response", ioutil.NopCloser(bytes.NewBuffer(nil)))
+		f.ServeHTTP(w, r)
+	}
+}
+
+// guest returns a guest written in WebAssembly text, for testing hostcalls without building a Rust
+// program. It has the imports, funcs, and data given, along with the hostcalls for requests and
+// responses, one page of memory, and these helpers:
+//
+//	$body returns a new, empty body
+//	$respond sends a response downstream with a status and body
+//	$respond_with sends a response downstream with a status and the bytes at an address
+//	$respond_result responds with 200 plus a hostcall's status and, if the hostcall succeeded, the
+//	  bytes it wrote at an address
+//	$request returns a new request for the URI at an address
+//	$proxy sends a request to the backend named at an address, and its response downstream
+//
+// The helpers use memory from 512 to 544.
+func guest(imports, funcs string) string {
+	return `(module
+	(import "fastly_http_body" "new" (func $body_new (param i32) (result i32)))
+	(import "fastly_http_body" "write" (func $body_write (param i32 i32 i32 i32 i32) (result i32)))
+	(import "fastly_http_body" "close" (func $body_close (param i32) (result i32)))
+	(import "fastly_http_req" "new" (func $req_new (param i32) (result i32)))
+	(import "fastly_http_req" "uri_set" (func $uri_set (param i32 i32 i32) (result i32)))
+	(import "fastly_http_req" "send" (func $send (param i32 i32 i32 i32 i32 i32) (result i32)))
+	(import "fastly_http_resp" "new" (func $resp_new (param i32) (result i32)))
+	(import "fastly_http_resp" "status_set" (func $status_set (param i32 i32) (result i32)))
+	(import "fastly_http_resp" "send_downstream" (func $send_downstream (param i32 i32 i32) (result i32)))
+	` + imports + `
+	(memory (export "memory") 1)
+	(func $body (result i32)
+		(drop (call $body_new (i32.const 512)))
+		(i32.load (i32.const 512)))
+	(func $respond (param $status i32) (param $body i32)
+		(drop (call $resp_new (i32.const 516)))
+		(drop (call $status_set (i32.load (i32.const 516)) (local.get $status)))
+		(drop (call $send_downstream (i32.load (i32.const 516)) (local.get $body) (i32.const 0))))
+	(func $respond_with (param $status i32) (param $addr i32) (param $len i32)
+		(local $body i32)
+		(local.set $body (call $body))
+		(drop (call $body_write (local.get $body) (local.get $addr) (local.get $len) (i32.const 0) (i32.const 520)))
+		(call $respond (local.get $status) (local.get $body)))
+	(func $respond_result (param $status i32) (param $addr i32) (param $len i32)
+		(if (local.get $status)
+			(then
+				(call $respond (i32.add (i32.const 200) (local.get $status)) (call $body)))
+			(else
+				(call $respond_with (i32.const 200) (local.get $addr) (local.get $len)))))
+	(func $request (param $addr i32) (param $len i32) (result i32)
+		(drop (call $req_new (i32.const 524)))
+		(drop (call $uri_set (i32.load (i32.const 524)) (local.get $addr) (local.get $len)))
+		(i32.load (i32.const 524)))
+	(func $proxy (param $req i32) (param $addr i32) (param $len i32)
+		(drop (call $send (local.get $req) (call $body) (local.get $addr) (local.get $len) (i32.const 528) (i32.const 532)))
+		(drop (call $send_downstream (i32.load (i32.const 528)) (i32.load (i32.const 532)) (i32.const 0))))
+	` + funcs + `)`
+}
+
+// newGuest compiles a guest, failing the test if it can't
+func newGuest(t testing.TB, wat string, opts ...fastlike.Option) *fastlike.Fastlike {
+	t.Helper()
+	f, err := fastlike.NewFromBytes([]byte(wat), opts...)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err.Error())
+	}
+	return f
+}
+
+// serve sends h a GET request and returns its response
+func serve(h http.Handler) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost:1337/", ioutil.NopCloser(bytes.NewBuffer(nil)))
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// expectResponse sends h a GET request and checks the status code and body of its response, which
+// it returns for anything else the caller wants to check
+func expectResponse(t testing.TB, name string, h http.Handler, code int, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := serve(h)
+	if w.Code != code || w.Body.String() != body {
+		t.Logf("%s: expected %d %q, got %d %q", name, code, body, w.Code, w.Body.String())
+		t.Fail()
+	}
+	return w
+}
+
+// resultCode is the status code a guest responds with using $respond_result, when the hostcall it
+// called returned status
+func resultCode(status int32) int {
+	return http.StatusOK + int(status)
+}
+
+// watBytes escapes b for use in a WAT string
+func watBytes(b []byte) string {
+	var s strings.Builder
+	for _, c := range b {
+		fmt.Fprintf(&s, "\\%02x", c)
+	}
+	return s.String()
+}
+
 func failingBackendHandler(t *testing.T) func(string) http.Handler {
 	return func(_ string) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
@@ -47,6 +47,8 @@ func defaultGeoLookup(ip net.IP) Geo {
 	}
 }
 
+// geoHandler serves geographic lookups for older SDKs, which send them as requests to a backend named
+// "geolocation" with the IP address in a header. Newer SDKs use the fastly_geo hostcalls instead.
 func geoHandler(fn func(ip net.IP) Geo) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		addr := net.ParseIP(r.Header.Get("fastly-xqd-arg1"))
@@ -0,0 +1,62 @@
+package fastlike_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/Khan/fastlike"
+)
+
+// geoWat looks up the geographic data for some address octets using a buffer of the given size, and
+// responds with the result. Use it with fmt.Sprintf, supplying the octets as a WebAssembly string, how
+// many there are, and the buffer size.
+var geoWat = guest(`(import "fastly_geo" "lookup" (func $lookup (param i32 i32 i32 i32 i32) (result i32)))`, `
+	(data (i32.const 1024) "%s")
+	(func (export "_start")
+		(call $respond_result
+			(call $lookup (i32.const 1024) (i32.const %d) (i32.const 2048) (i32.const %d) (i32.const 16))
+			(i32.const 2048)
+			(i32.load (i32.const 16))))`)
+
+func TestGeo(t *testing.T) {
+	t.Parallel()
+
+	geo := fastlike.WithGeo(func(ip net.IP) fastlike.Geo {
+		return fastlike.Geo{City: ip.String()}
+	})
+
+	// The lookup responds with the address as the city, so each case can tell that the right
+	// address was looked up
+	cases := []struct {
+		name   string
+		addr   []byte
+		size   int
+		status int32
+	}{
+		{"ipv4", net.ParseIP("127.0.0.1").To4(), 1024, fastlike.XqdStatusOK},
+		{"ipv6", net.ParseIP("2001:db8::1"), 1024, fastlike.XqdStatusOK},
+		{"too small", net.ParseIP("127.0.0.1").To4(), 8, fastlike.XqdErrBufferLength},
+		{"invalid", []byte{127, 0, 0}, 1024, fastlike.XqdErrInvalidArgument},
+	}
+
+	for _, c := range cases {
+		w := serve(newGuest(t, fmt.Sprintf(geoWat, watBytes(c.addr), len(c.addr), c.size), geo))
+		if w.Code != resultCode(c.status) {
+			t.Logf("%s: expected %d, got %d", c.name, resultCode(c.status), w.Code)
+			t.Fail()
+			continue
+		}
+
+		if c.status != fastlike.XqdStatusOK {
+			continue
+		}
+
+		var actual fastlike.Geo
+		if err := json.Unmarshal(w.Body.Bytes(), &actual); err != nil || actual.City != net.IP(c.addr).String() {
+			t.Logf("%s: expected the data for %s, got %q", c.name, net.IP(c.addr), w.Body.String())
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package fastlike
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewGeoLookup returns a function for WithGeo which reads geographic data from the supplied files,
+// based on their extension: ".mmdb" files are read with NewMMDBGeoLookup, ".csv" and ".json" files
+// with NewCIDRGeoLookup.
+// When there's more than one file, each field comes from the first file which has a value for it, so
+// that (for instance) a city database and an ASN database can be used together.
+func NewGeoLookup(paths ...string) (func(net.IP) Geo, error) {
+	lookups := []func(net.IP) Geo{}
+	for _, path := range paths {
+		var fn func(net.IP) Geo
+		var err error
+
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".mmdb":
+			fn, err = NewMMDBGeoLookup(path)
+		case ".csv", ".json":
+			fn, err = NewCIDRGeoLookup(path)
+		default:
+			err = fmt.Errorf("geo: unknown file type %s", path)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		lookups = append(lookups, fn)
+	}
+
+	return func(ip net.IP) Geo {
+		var geo Geo
+		for _, fn := range lookups {
+			mergeGeo(&geo, fn(ip))
+		}
+		return geo
+	}, nil
+}
+
+// mergeGeo sets each empty field of dst to the value of the field in src
+func mergeGeo(dst *Geo, src Geo) {
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src)
+	for j := 0; j < d.NumField(); j++ {
+		if d.Field(j).IsZero() {
+			d.Field(j).Set(s.Field(j))
+		}
+	}
+}
+
+// NewMMDBGeoLookup returns a function for WithGeo which reads geographic data from a MaxMind DB
+// file, such as a GeoIP2 or GeoLite2 City, Country, ASN, Connection-Type, or Anonymous-IP database.
+// Fields the database doesn't have are left empty, as are addresses it doesn't contain.
+func NewMMDBGeoLookup(path string) (func(net.IP) Geo, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openMMDB(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ip net.IP) Geo {
+		record, err := db.lookup(ip)
+		if err != nil {
+			return Geo{}
+		}
+		return mmdbGeo(record)
+	}, nil
+}
+
+// mmdbGeo fills in a Geo from a record in a MaxMind DB
+func mmdbGeo(record interface{}) Geo {
+	str := func(path ...interface{}) string {
+		s, _ := mmdbPath(record, path...).(string)
+		return s
+	}
+	num := func(path ...interface{}) float64 {
+		switch n := mmdbPath(record, path...).(type) {
+		case uint64:
+			return float64(n)
+		case int64:
+			return float64(n)
+		case float64:
+			return n
+		}
+		return 0
+	}
+	is := func(path ...interface{}) bool {
+		b, _ := mmdbPath(record, path...).(bool)
+		return b
+	}
+
+	geo := Geo{
+		ASName:      str("autonomous_system_organization"),
+		ASNumber:    int(num("autonomous_system_number")),
+		City:        str("city", "names", "en"),
+		Continent:   str("continent", "code"),
+		CountryCode: str("country", "iso_code"),
+		CountryName: str("country", "names", "en"),
+		Latitude:    num("location", "latitude"),
+		Longitude:   num("location", "longitude"),
+		MetroCode:   int(num("location", "metro_code")),
+		PostalCode:  str("postal", "code"),
+		Region:      str("subdivisions", 0, "iso_code"),
+	}
+
+	geo.CountryCode3 = countryCodes3[geo.CountryCode]
+
+	if geo.ASName == "" {
+		geo.ASName = str("traits", "autonomous_system_organization")
+		geo.ASNumber = int(num("traits", "autonomous_system_number"))
+	}
+
+	if tz := str("location", "time_zone"); tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			_, offset := time.Now().In(loc).Zone()
+			geo.UTCOffset = utcOffset(offset)
+		}
+	}
+
+	connection := str("connection_type")
+	if connection == "" {
+		connection = str("traits", "connection_type")
+	}
+	switch connection {
+	case "Cable/DSL":
+		geo.ConnSpeed, geo.ConnType = "broadband", "wired"
+	case "Cellular":
+		geo.ConnSpeed, geo.ConnType = "mobile", "mobile"
+	case "Corporate":
+		geo.ConnSpeed, geo.ConnType = "t1", "wired"
+	case "Satellite":
+		geo.ConnSpeed, geo.ConnType = "satellite", "satellite"
+	}
+
+	// Anonymous-IP databases have these at the top level, while Insights has them under traits
+	flag := func(name string) bool {
+		return is(name) || is("traits", name)
+	}
+	switch {
+	case flag("is_tor_exit_node"):
+		geo.ProxyType, geo.ProxyDescription = "anonymous", "tor-exit"
+	case flag("is_anonymous_vpn"):
+		geo.ProxyType, geo.ProxyDescription = "anonymous", "vpn"
+	case flag("is_hosting_provider"):
+		geo.ProxyType, geo.ProxyDescription = "hosting", "cloud"
+	case flag("is_public_proxy"):
+		geo.ProxyType, geo.ProxyDescription = "public", "?"
+	case flag("is_anonymous"):
+		geo.ProxyType, geo.ProxyDescription = "anonymous", "?"
+	}
+
+	return geo
+}
+
+// mmdbPath follows a path of map keys and array indexes through a decoded MaxMind DB value
+func mmdbPath(v interface{}, path ...interface{}) interface{} {
+	for _, p := range path {
+		switch k := p.(type) {
+		case string:
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			v = m[k]
+		case int:
+			a, ok := v.([]interface{})
+			if !ok || k >= len(a) {
+				return nil
+			}
+			v = a[k]
+		}
+	}
+	return v
+}
+
+// utcOffset formats an offset in seconds the way Fastly does, as hours and minutes (ex: -500 for
+// five hours behind UTC)
+func utcOffset(seconds int) int {
+	minutes := seconds / 60
+	return minutes/60*100 + minutes%60
+}
+
+// NewCIDRGeoLookup returns a function for WithGeo which reads geographic data for CIDR prefixes from
+// a JSON or CSV file. Addresses get the data for the longest prefix which contains them, or no data
+// if there isn't one.
+//
+// The country_code3 field is filled in from country_code if it's missing.
+//
+// A JSON file is an object mapping prefixes to objects with the same fields as a Geo:
+//
+//	{"192.0.2.0/24": {"city": "London", "country_code": "GB"}}
+//
+// A CSV file has a header row naming the columns, one of which must be "cidr" and the rest of which
+// are the same as the JSON fields:
+//
+//	cidr,city,country_code
+//	192.0.2.0/24,London,GB
+func NewCIDRGeoLookup(path string) (func(net.IP) Geo, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var table *prefixTable
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		table, err = readGeoCSV(fd)
+	} else {
+		table, err = readGeoJSON(fd)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("geo: error reading %s, %s", path, err.Error())
+	}
+
+	return func(ip net.IP) Geo {
+		if geo, ok := table.lookup(ip); ok {
+			return geo.(Geo)
+		}
+		return Geo{}
+	}, nil
+}
+
+func readGeoJSON(r io.Reader) (*prefixTable, error) {
+	content := map[string]Geo{}
+	if err := json.NewDecoder(r).Decode(&content); err != nil {
+		return nil, err
+	}
+
+	table := &prefixTable{}
+	for prefix, geo := range content {
+		network, err := parsePrefix(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if geo.CountryCode3 == "" {
+			geo.CountryCode3 = countryCodes3[geo.CountryCode]
+		}
+		table.add(network, geo)
+	}
+
+	table.sort()
+	return table, nil
+}
+
+func readGeoCSV(r io.Reader) (*prefixTable, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	// Work out which field of a Geo each column goes in, using the JSON names
+	fields := map[string]int{}
+	t := reflect.TypeOf(Geo{})
+	for j := 0; j < t.NumField(); j++ {
+		name := strings.Split(t.Field(j).Tag.Get("json"), ",")[0]
+		fields[name] = j
+	}
+
+	columns := make([]int, len(header))
+	cidr := -1
+	for j, name := range header {
+		name = strings.TrimSpace(name)
+		if name == "cidr" {
+			cidr = j
+			continue
+		}
+
+		field, ok := fields[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		columns[j] = field
+	}
+
+	if cidr < 0 {
+		return nil, fmt.Errorf("no cidr column")
+	}
+
+	table := &prefixTable{}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		network, err := parsePrefix(row[cidr])
+		if err != nil {
+			return nil, err
+		}
+
+		var geo Geo
+		v := reflect.ValueOf(&geo).Elem()
+		for j, value := range row {
+			if j == cidr || value == "" {
+				continue
+			}
+
+			field := v.Field(columns[j])
+			switch field.Kind() {
+			case reflect.String:
+				field.SetString(value)
+			case reflect.Int:
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s %q", header[j], value)
+				}
+				field.SetInt(int64(n))
+			case reflect.Float64:
+				n, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s %q", header[j], value)
+				}
+				field.SetFloat(n)
+			}
+		}
+
+		if geo.CountryCode3 == "" {
+			geo.CountryCode3 = countryCodes3[geo.CountryCode]
+		}
+		table.add(network, geo)
+	}
+
+	table.sort()
+	return table, nil
+}
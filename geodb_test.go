@@ -0,0 +1,51 @@
+package fastlike_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Khan/fastlike"
+)
+
+func TestGeoLookup(t *testing.T) {
+	t.Parallel()
+
+	lookup, err := fastlike.NewGeoLookup("testdata/example-geo.mmdb", "testdata/example-geo.json", "testdata/example-geo.csv")
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err.Error())
+	}
+
+	cases := []struct {
+		ip       string
+		expected fastlike.Geo
+	}{
+		{"81.2.69.160", fastlike.Geo{
+			ASName: "Andrews & Arnold Ltd", ASNumber: 20712, City: "London", Continent: "EU",
+			CountryCode: "GB", CountryCode3: "GBR", CountryName: "United Kingdom",
+			Latitude: 51.5142, Longitude: -0.0931, PostalCode: "EC2V", Region: "ENG",
+			ConnSpeed: "broadband", ConnType: "wired",
+		}},
+		{"2001:db8::1", fastlike.Geo{
+			City: "Tokyo", Continent: "AS", CountryCode: "JP", CountryCode3: "JPN", CountryName: "Japan",
+			Latitude: 35.6895, Longitude: 139.6917, UTCOffset: 900,
+			ProxyType: "anonymous", ProxyDescription: "vpn",
+		}},
+		{"192.0.2.1", fastlike.Geo{City: "London", Continent: "EU", CountryCode: "GB", CountryCode3: "GBR", CountryName: "United Kingdom"}},
+		{"192.0.2.200", fastlike.Geo{City: "Manchester", Continent: "EU", CountryCode: "GB", CountryCode3: "GBR", CountryName: "United Kingdom"}},
+		{"198.51.100.1", fastlike.Geo{ASNumber: 64500, City: "Paris", Continent: "EU", CountryCode: "FR", CountryCode3: "FRA", CountryName: "France", Latitude: 48.8566, Longitude: 2.3522}},
+		{"198.51.100.7", fastlike.Geo{ASNumber: 64501, City: "Lyon", Continent: "EU", CountryCode: "FR", CountryCode3: "FRA", CountryName: "France", Latitude: 45.764, Longitude: 4.8357}},
+		{"203.0.113.1", fastlike.Geo{}},
+	}
+
+	for _, c := range cases {
+		if actual := lookup(net.ParseIP(c.ip)); actual != c.expected {
+			t.Logf("%s: expected %+v, got %+v", c.ip, c.expected, actual)
+			t.Fail()
+		}
+	}
+
+	if _, err := fastlike.NewGeoLookup("testdata/example-dictionary.txt"); err == nil {
+		t.Logf("expected an error for an unknown file type")
+		t.Fail()
+	}
+}
@@ -1,5 +1,5 @@
 module github.com/Khan/fastlike
 
-go 1.14
+go 1.16
 
 require github.com/bytecodealliance/wasmtime-go v0.29.0
@@ -2,13 +2,26 @@ package fastlike
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"sync"
+	"sync/atomic"
 )
 
-type fastlyMeta struct{}
+// fastlyMeta holds the Fastly-specific settings for a request, which have no equivalent on an
+// http.Request
+type fastlyMeta struct {
+	// overrideTag is a combination of the cacheOverride* bits, and overrideTTL and overrideSWR are
+	// the values (in seconds) for the corresponding bits
+	overrideTag uint32
+	overrideTTL uint32
+	overrideSWR uint32
+
+	// surrogateKeys is a space-separated list of surrogate keys for the response
+	surrogateKeys string
+}
 
 // RequestHandle is an http.Request with extra metadata
 // Notably, the request body is ignored and instead the guest will provide a BodyHandle to use
@@ -36,7 +49,7 @@ func (rhs *RequestHandles) Get(id int) *RequestHandle {
 
 // New creates a new RequestHandle and returns its handle id and the handle itself.
 func (rhs *RequestHandles) New() (int, *RequestHandle) {
-	rh := &RequestHandle{Request: &http.Request{}}
+	rh := &RequestHandle{Request: &http.Request{}, fastlyMeta: &fastlyMeta{}}
 	rhs.handles = append(rhs.handles, rh)
 	return len(rhs.handles) - 1, rh
 }
@@ -71,6 +84,168 @@ func (rhs *ResponseHandles) New() (int, *ResponseHandle) {
 	return len(rhs.handles) - 1, rh
 }
 
+// PendingRequest is a subrequest which has been sent to a backend asynchronously. The done channel
+// is closed once the backend has produced a response, which is then available in resp.
+type PendingRequest struct {
+	done chan struct{}
+	resp *http.Response
+}
+
+// Done returns true if the backend has finished producing a response.
+func (p *PendingRequest) Done() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// PendingRequestHandles is a slice of PendingRequest with functions to get and create
+type PendingRequestHandles struct {
+	handles []*PendingRequest
+}
+
+// Get returns the PendingRequest identified by id or nil if one does not exist or has already been
+// completed.
+func (phs *PendingRequestHandles) Get(id int) *PendingRequest {
+	if id < 0 || id >= len(phs.handles) {
+		return nil
+	}
+
+	return phs.handles[id]
+}
+
+// New creates a new PendingRequest and returns its handle id and the pending request itself.
+func (phs *PendingRequestHandles) New() (int, *PendingRequest) {
+	ph := &PendingRequest{done: make(chan struct{})}
+	phs.handles = append(phs.handles, ph)
+	return len(phs.handles) - 1, ph
+}
+
+// Complete removes the PendingRequest identified by id, so that the response is only handed to the
+// guest once.
+func (phs *PendingRequestHandles) Complete(id int) {
+	if id < 0 || id >= len(phs.handles) {
+		return
+	}
+
+	phs.handles[id] = nil
+}
+
+// CacheHandle is the result of looking up a key in the core cache
+type CacheHandle struct {
+	key string
+
+	// object is what was found, or nil if nothing usable was
+	object *cacheObject
+
+	// tx is set when the guest is responsible for inserting or updating the object
+	tx *cacheTransaction
+}
+
+// CacheHandles is a slice of CacheHandle with functions to get and create
+type CacheHandles struct {
+	handles []*CacheHandle
+}
+
+// Get returns the CacheHandle identified by id or nil if one does not exist or has been closed.
+func (chs *CacheHandles) Get(id int) *CacheHandle {
+	if id < 0 || id >= len(chs.handles) {
+		return nil
+	}
+
+	return chs.handles[id]
+}
+
+// New creates a new CacheHandle and returns its handle id and the handle itself.
+func (chs *CacheHandles) New(key string, object *cacheObject, tx *cacheTransaction) (int, *CacheHandle) {
+	ch := &CacheHandle{key: key, object: object, tx: tx}
+	chs.handles = append(chs.handles, ch)
+	return len(chs.handles) - 1, ch
+}
+
+// Close removes the CacheHandle identified by id, giving up on its transaction if the guest didn't
+// finish it.
+func (chs *CacheHandles) Close(id int) {
+	ch := chs.Get(id)
+	if ch == nil {
+		return
+	}
+
+	if ch.tx != nil {
+		ch.tx.cancel()
+	}
+	chs.handles[id] = nil
+}
+
+// KVPending is the result of a KV store operation, which the guest collects with one of the *_wait
+// hostcalls. Operations on local stores are quick enough that they're done straight away.
+type KVPending struct {
+	entry KVEntry
+	list  []byte
+	err   error
+}
+
+// KVPendingHandles is a slice of KVPending with functions to get and create
+type KVPendingHandles struct {
+	handles []*KVPending
+}
+
+// Get returns the KVPending identified by id or nil if one does not exist or has already been
+// collected.
+func (khs *KVPendingHandles) Get(id int) *KVPending {
+	if id < 0 || id >= len(khs.handles) {
+		return nil
+	}
+
+	return khs.handles[id]
+}
+
+// New adds the result of an operation and returns its handle id.
+func (khs *KVPendingHandles) New(kp *KVPending) int {
+	khs.handles = append(khs.handles, kp)
+	return len(khs.handles) - 1
+}
+
+// Complete removes the KVPending identified by id, so that the result is only handed to the guest
+// once.
+func (khs *KVPendingHandles) Complete(id int) {
+	if id < 0 || id >= len(khs.handles) {
+		return
+	}
+
+	khs.handles[id] = nil
+}
+
+// SecretHandles is a slice of secret values with functions to get and create. Secrets are kept
+// apart from other bytes so that they're only handed to the guest when it asks for the plaintext.
+type SecretHandles struct {
+	handles [][]byte
+}
+
+// Get returns the secret identified by id or nil if one does not exist
+func (shs *SecretHandles) Get(id int) []byte {
+	if id < 0 || id >= len(shs.handles) {
+		return nil
+	}
+
+	return shs.handles[id]
+}
+
+// New adds a secret and returns its handle id. The value is never nil, so that empty secrets can be
+// told apart from invalid handles.
+func (shs *SecretHandles) New(value []byte) int {
+	shs.handles = append(shs.handles, append([]byte{}, value...))
+	return len(shs.handles) - 1
+}
+
+// abandoner is implemented by body writers which need to tell being closed by the guest apart from
+// being torn down with the instance, since closing them means the body is complete
+type abandoner interface {
+	abandon()
+}
+
 // BodyHandle represents a body. It could be readable or writable, but not both.
 // For cases where it's already connected to a request or response body, the reader or writer
 // properties will reference the original request or response respectively.
@@ -86,7 +261,8 @@ type BodyHandle struct {
 	// reader/writer/closer wrap it
 	buf *bytes.Buffer
 
-	// length is the number of bytes in the body
+	// length is the number of bytes in the body, or -1 if it isn't known ahead of time (such as when
+	// it's being streamed in from somewhere else)
 	length int64
 }
 
@@ -106,14 +282,14 @@ func (b *BodyHandle) Read(p []byte) (int, error) {
 // Write implements io.Writer for a BodyHandle
 func (b *BodyHandle) Write(p []byte) (int, error) {
 	n, e := b.writer.Write(p)
-	b.length += int64(n)
+	if b.length >= 0 {
+		b.length += int64(n)
+	}
 	return n, e
 }
 
+// Size returns the number of bytes in the body, or -1 if it isn't known
 func (b *BodyHandle) Size() int64 {
-	if b.length == 0 {
-		return -1
-	}
 	return b.length
 }
 
@@ -157,9 +333,10 @@ func (bhs *BodyHandles) NewBuffer() (int, *BodyHandle) {
 	return bhs.addBodyHandle(bh)
 }
 
-// NewReader creates a BodyHandle whose reader and closer is connected to the supplied ReadCloser
+// NewReader creates a BodyHandle whose reader and closer is connected to the supplied ReadCloser.
+// The size of the body is unknown unless the caller sets it.
 func (bhs *BodyHandles) NewReader(rdr io.ReadCloser) (int, *BodyHandle) {
-	bh := &BodyHandle{}
+	bh := &BodyHandle{length: -1}
 	bh.reader = rdr
 	bh.closer = rdr
 	bh.writer = ioutil.Discard
@@ -167,9 +344,19 @@ func (bhs *BodyHandles) NewReader(rdr io.ReadCloser) (int, *BodyHandle) {
 	return bhs.addBodyHandle(bh)
 }
 
+// NewWriteCloser creates a BodyHandle whose writer and closer are connected to the supplied
+// WriteCloser
+func (bhs *BodyHandles) NewWriteCloser(w io.WriteCloser) (int, *BodyHandle) {
+	bh := &BodyHandle{length: -1}
+	bh.writer = w
+	bh.closer = w
+
+	return bhs.addBodyHandle(bh)
+}
+
 // NewWriter creates a BodyHandle whose writer is connected to the supplied Writer
 func (bhs *BodyHandles) NewWriter(w io.Writer) (int, *BodyHandle) {
-	bh := &BodyHandle{}
+	bh := &BodyHandle{length: -1}
 	bh.writer = w
 
 	return bhs.addBodyHandle(bh)
@@ -189,3 +376,78 @@ func (bhs *BodyHandles) Close(id int) error {
 
 	return bh.Close()
 }
+
+// downstreamWriter is the writer behind a streaming body handle. Each write is forwarded to the
+// downstream response and flushed immediately, so the user agent sees data as soon as the guest
+// writes it.
+type downstreamWriter struct {
+	w      http.ResponseWriter
+	closed bool
+}
+
+// Write implements io.Writer for a downstreamWriter
+func (d *downstreamWriter) Write(p []byte) (int, error) {
+	if d.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n, err := d.w.Write(p)
+	d.Flush()
+	return n, err
+}
+
+// Flush sends any buffered data downstream, if the underlying ResponseWriter supports it
+func (d *downstreamWriter) Flush() {
+	if f, ok := d.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the streaming body. Any further writes will fail.
+func (d *downstreamWriter) Close() error {
+	if !d.closed {
+		d.closed = true
+		d.Flush()
+	}
+	return nil
+}
+
+// errBodyTooLarge is returned when reading a downstream request body that exceeds the configured
+// maximum size
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedBody is a request body which fails once more than max bytes have been read from it. Unlike
+// an io.LimitedReader, it remembers that the limit was exceeded so that the instance can respond
+// accordingly once the guest is done.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  int32
+}
+
+// Read implements io.Reader for a limitedBody
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+
+	// Read one byte more than we're allowed, so we can tell the difference between a body that's
+	// exactly at the limit and one which is over it
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		atomic.StoreInt32(&l.exceeded, 1)
+		return 0, errBodyTooLarge
+	}
+
+	return n, err
+}
+
+// Exceeded returns true if the body turned out to be larger than the limit
+func (l *limitedBody) Exceeded() bool {
+	return atomic.LoadInt32(&l.exceeded) == 1
+}
@@ -1,7 +1,8 @@
 package fastlike
 
 import (
-	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/bytecodealliance/wasmtime-go"
 )
@@ -25,9 +27,17 @@ type Instance struct {
 	interrupt *wasmtime.InterruptHandle
 	memory    *Memory
 
+	// growFailed is set by the guest once it fails to grow its memory, if the guest was compiled
+	// with a memory limit and could be hooked to do so
+	growFailed *wasmtime.Global
+
 	requests  *RequestHandles
 	responses *ResponseHandles
 	bodies    *BodyHandles
+	pending   *PendingRequestHandles
+	caches    *CacheHandles
+	kvPending *KVPendingHandles
+	secrets   *SecretHandles
 
 	// ds_request represents the downstream request, ie the one originated from the user agent
 	ds_request *http.Request
@@ -35,10 +45,43 @@ type Instance struct {
 	// ds_response represents the downstream response, where we're going to write the final output
 	ds_response http.ResponseWriter
 
+	// ds_body is the downstream request body when it's subject to a maximum size
+	ds_body *limitedBody
+
+	// maxBodySize is the largest downstream request body the guest is allowed to read, or 0 if
+	// there's no limit
+	maxBodySize int64
+
+	// limits bound how long the guest may run for each request, and meter tracks how much of them
+	// the current request has used
+	limits ExecutionLimits
+	meter  *executionMeter
+
+	// memoryLimit is the largest the guest's linear memory may grow to, or 0 if there's no limit
+	memoryLimit int64
+
+	// ds_sent is set once the guest has sent a response downstream, whether or not it's streaming
+	ds_sent bool
+
+	// cache, if set, sits in front of the backends
+	cache *Cache
+
+	// coreCache holds the objects guests cache using the fastly_cache hostcalls
+	coreCache *coreCache
+
+	// rateLimiter holds the rate counters and penalty boxes used by the fastly_erl hostcalls
+	rateLimiter *RateLimiter
+
 	// backends is used to issue subrequests
-	backends       map[string]http.Handler
+	backends       map[string]*Backend
 	defaultBackend func(name string) http.Handler
 
+	// dynamicBackends are registered by the guest while handling a request, if it's allowed to
+	dynamicBackendsAllowed bool
+	dynamicBackendPolicy   DynamicBackendPolicy
+	dynamicMu              sync.RWMutex
+	dynamicBackends        map[string]*dynamicBackend
+
 	// loggers is used to write log output from the wasm program
 	loggers       []logger
 	defaultLogger func(name string) io.Writer
@@ -46,31 +89,90 @@ type Instance struct {
 	// dictionaries are used to look up string values using string keys
 	dictionaries []dictionary
 
+	// kvStores are the KV stores available to the guest
+	kvStores []kvStore
+
+	// acls are used to match addresses against lists of prefixes
+	acls []acl
+
+	// secretStores are used to look up secrets, which are kept out of the abi log
+	secretStores []secretStore
+
 	// geolookup is a function that accepts a net.IP and returns a Geo
 	geolookup func(net.IP) Geo
 
 	uaparser UserAgentParser
 
+	// deviceLookup returns device detection data for a user agent
+	deviceLookup DeviceLookupFunc
+
 	// secureFn is used to determine if a request should be considered secure
 	secureFn func(*http.Request) bool
 
+	// err is set when the instance couldn't be prepared, and is reported for every request
+	err error
+
+	// lastMemorySize is the size of the guest's linear memory at the end of the last request
+	lastMemorySize int
+
 	log    *log.Logger
 	abilog *log.Logger
 }
 
 // NewInstance returns an http.Handler that can handle a single request.
+// It panics if the wasm program can't be compiled or linked. Use NewInstanceE to handle those errors
+// instead.
 func NewInstance(wasmbytes []byte, opts ...Option) *Instance {
+	i, err := NewInstanceE(wasmbytes, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return i
+}
+
+// NewInstanceE returns an http.Handler that can handle a single request, or an error if the wasm
+// program can't be compiled (a *CompileError) or linked (a *LinkError).
+func NewInstanceE(wasmbytes []byte, opts ...Option) (*Instance, error) {
+	i := configure(opts...)
+	engine, module, err := compile(wasmbytes, i.memoryLimit, i.log)
+	if err != nil {
+		return nil, err
+	}
+
+	i.err = i.prepare(engine, module)
+	if err := i.check(); err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+// newInstance returns an Instance for a module which has already been compiled. If the instance
+// can't be prepared, the error is reported when it tries to serve a request.
+func newInstance(engine *wasmtime.Engine, module *wasmtime.Module, opts ...Option) *Instance {
+	i := configure(opts...)
+	i.err = i.prepare(engine, module)
+	return i
+}
+
+// configure returns an Instance with the default configuration and the supplied options applied,
+// which isn't yet linked to a wasm program
+func configure(opts ...Option) *Instance {
 	i := new(Instance)
-	i.compile(wasmbytes)
 
 	i.requests = &RequestHandles{}
 	i.bodies = NewBodyHandles()
 	i.responses = &ResponseHandles{}
+	i.pending = &PendingRequestHandles{}
+	i.caches = &CacheHandles{}
+	i.kvPending = &KVPendingHandles{}
+	i.secrets = &SecretHandles{}
 
 	i.log = log.New(ioutil.Discard, "[fastlike] ", log.Lshortfile)
 	i.abilog = log.New(ioutil.Discard, "[fastlike abi] ", log.Lshortfile)
 
-	i.backends = map[string]http.Handler{}
+	i.backends = map[string]*Backend{}
+	i.dynamicBackends = map[string]*dynamicBackend{}
 	i.loggers = []logger{}
 	i.dictionaries = []dictionary{}
 
@@ -88,6 +190,18 @@ func NewInstance(wasmbytes []byte, opts ...Option) *Instance {
 		return UserAgent{}
 	}
 
+	// By default, there's no device detection data for any user agent
+	i.deviceLookup = defaultDeviceLookup
+
+	// By default, each instance has its own core cache. Fastlike shares one between its instances.
+	i.coreCache = newCoreCache()
+
+	// Likewise, each instance has its own rate limiter, and Fastlike shares one between its instances
+	i.rateLimiter = NewRateLimiter(nil)
+
+	// By default, the guest's memory is limited in the same way as it is in production
+	i.memoryLimit = DefaultMemoryLimit
+
 	// By default, requests are "secure" if they have TLS info
 	i.secureFn = func(r *http.Request) bool {
 		return r.TLS != nil
@@ -112,8 +226,30 @@ func (i *Instance) reset() {
 			w.Body.Close()
 		}
 	}
+	for _, p := range i.pending.handles {
+		if p == nil {
+			continue
+		}
+
+		// The backend may still be running, so wait for it in the background before closing the
+		// response body
+		go func(p *PendingRequest) {
+			<-p.done
+			if p.resp.Body != nil {
+				p.resp.Body.Close()
+			}
+		}(p)
+	}
+	for id := range i.caches.handles {
+		// Give up on any transactions the guest didn't finish, so nobody waits on them forever
+		i.caches.Close(id)
+	}
 	for _, b := range i.bodies.handles {
-		if b.closer != nil {
+		// Bodies the guest never closed may be unfinished, and those which would otherwise be
+		// taken as complete are abandoned instead
+		if a, ok := b.closer.(abandoner); ok {
+			a.abandon()
+		} else if b.closer != nil {
 			b.closer.Close()
 		}
 		if b.buf != nil {
@@ -124,32 +260,109 @@ func (i *Instance) reset() {
 	// reset the handles, but we can reuse the already allocated space
 	*i.requests = RequestHandles{}
 	*i.responses = ResponseHandles{}
+	*i.pending = PendingRequestHandles{}
+	*i.caches = CacheHandles{}
+	*i.kvPending = KVPendingHandles{}
+	*i.secrets = SecretHandles{}
 	*i.bodies = *NewBodyHandles()
 
+	// Dynamic backends only last as long as the request which registered them
+	i.dynamicMu.Lock()
+	for _, b := range i.dynamicBackends {
+		b.transport.CloseIdleConnections()
+	}
+	i.dynamicBackends = map[string]*dynamicBackend{}
+	i.dynamicMu.Unlock()
+
 	i.ds_response = nil
 	i.ds_request = nil
+	i.ds_sent = false
+	i.ds_body = nil
+	i.meter.stop()
+	i.meter = nil
+
+	// Drop the store along with everything in it, so that pooled instances don't hold on to the
+	// memory used by previous requests
+	if i.memory != nil {
+		i.lastMemorySize = i.memory.Len()
+	}
 	i.wasm = nil
 	i.memory = nil
+	i.growFailed = nil
+	i.interrupt = nil
+	if i.wasmctx != nil {
+		i.wasmctx.store = nil
+	}
 }
 
-func (i *Instance) setup() {
+// discard releases the instance's linker when it's not going back into the pool. The host functions
+// defined in the linker refer back to the instance, so without this neither one can be garbage
+// collected.
+func (i *Instance) discard() {
+	if i.wasmctx != nil {
+		i.wasmctx.linker = nil
+	}
+}
+
+// check makes sure the instance is able to serve requests by instantiating the wasm program once,
+// without running it
+func (i *Instance) check() error {
+	if err := i.setup(); err != nil {
+		return err
+	}
+	i.reset()
+	return nil
+}
+
+func (i *Instance) setup() error {
+	if i.err != nil {
+		return i.err
+	}
+
+	i.wasmctx.store = i.wasmctx.newStore()
+
 	var err error
 	i.wasm, err = i.wasmctx.linker.Instantiate(i.wasmctx.store, i.wasmctx.module)
-	check(err)
+	if err != nil {
+		return &LinkError{err}
+	}
 
 	i.interrupt, err = i.wasmctx.store.InterruptHandle()
-	check(err)
+	if err != nil {
+		return &LinkError{err}
+	}
+
+	mem := i.wasm.GetExport(i.wasmctx.store, "memory")
+	if mem == nil || mem.Memory() == nil {
+		return &LinkError{errors.New("wasm program does not export memory")}
+	}
+
+	entry := i.wasm.GetExport(i.wasmctx.store, "_start")
+	if entry == nil || entry.Func() == nil {
+		return &LinkError{errors.New("wasm program does not export _start")}
+	}
 
 	i.memory = &Memory{&wasmMemory{
 		store: i.wasmctx.store,
-		mem:   i.wasm.GetExport(i.wasmctx.store, "memory").Memory(),
+		mem:   mem.Memory(),
 	}}
+
+	if flag := i.wasm.GetExport(i.wasmctx.store, growFailedExport); flag != nil {
+		i.growFailed = flag.Global()
+	}
+
+	return nil
 }
 
 // ServeHTTP serves the supplied request and response pair. This is not safe to call twice.
 func (i *Instance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	i.setup()
 	defer i.reset()
+	if err := i.setup(); err != nil {
+		i.log.Printf("Error instantiating wasm program: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error instantiating wasm program. There may be more in your server logs.\n"))
+		return
+	}
 
 	loops, ok := r.Header[http.CanonicalHeaderKey("cdn-loop")]
 	if !ok {
@@ -170,30 +383,57 @@ func (i *Instance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if i.maxBodySize > 0 && r.ContentLength > i.maxBodySize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte("Request body too large.\n"))
+		return
+	}
+
 	i.ds_request = r
 	i.ds_response = w
 
-	// Start a goroutine which will wait for the context to cancel or wait until the wasm calls are
-	// complete
-	donech := make(chan struct{}, 1)
-	go func(ctx context.Context) {
-		select {
-		case <-ctx.Done():
-			// If the context cancels before we write to the donech it's a timeout/deadline/client
-			// hung up and we should interrupt the wasm program.
-			i.interrupt.Interrupt()
-		case <-donech:
-			// Otherwise, we're good and don't need to do anything else.
-		}
-	}(r.Context())
+	if i.limits.WallClock > 0 || i.limits.Active > 0 {
+		i.meter = newExecutionMeter(i.limits)
+	}
+
+	// Start a goroutine which will interrupt the wasm program if the context cancels or it runs into
+	// its execution limits before the wasm calls are complete
+	donech := make(chan struct{})
+	go i.meter.watch(r.Context(), donech, i.interrupt.Interrupt)
 
 	// The entrypoint for a fastly compute program takes no arguments and returns nothing or an
 	// error. The program itself is responsible for getting a handle on the downstream request
 	// and sending a response downstream.
 	entry := i.wasm.GetExport(i.wasmctx.store, "_start").Func()
 	_, err := entry.Call(i.wasmctx.store)
-	donech <- struct{}{}
-	if err != nil {
+	close(donech)
+
+	// If the guest tried to read more of the body than it's allowed, that takes precedence over
+	// anything else that happened (most likely, the guest fails when it can't read the body)
+	if i.bodyTooLarge() {
+		return
+	}
+
+	if err != nil && i.meter.Exceeded() != limitNone {
+		i.limitExceeded()
+		return
+	}
+
+	if err != nil && i.outOfMemory() {
+		i.log.Printf("Wasm program ran out of memory (%d of %d bytes): %s", i.memory.Len(), i.memoryLimit, err.Error())
+		if !i.ds_sent {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Wasm program ran out of memory.\n"))
+		}
+		return
+	}
+
+	if err != nil && i.ds_sent {
+		// The response has already (at least partially) made it downstream, so the best we can do
+		// is log the error
+		i.log.Printf("Error running wasm program after sending response: %s", err.Error())
+		return
+	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Error running wasm program.\n"))
 		w.Write([]byte("Below is a useless blob of wasm backtrace. There may be more in your server logs.\n"))
@@ -201,3 +441,61 @@ func (i *Instance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// bodyTooLarge returns true if more of the downstream request body was read than the maximum
+// allowed. If nothing has been sent downstream yet, it responds with a 413.
+func (i *Instance) bodyTooLarge() bool {
+	if i.ds_body == nil || !i.ds_body.Exceeded() {
+		return false
+	}
+
+	if i.ds_sent {
+		return true
+	}
+	i.ds_sent = true
+
+	i.log.Printf("Request body exceeded %d bytes", i.maxBodySize)
+	i.ds_response.WriteHeader(http.StatusRequestEntityTooLarge)
+	i.ds_response.Write([]byte("Request body too large.\n"))
+	return true
+}
+
+// limitExceeded reports a guest which was interrupted for running into one of its execution limits.
+// If nothing has been sent downstream yet, it responds with a 504 for the wall-clock limit or a 503
+// for the active time limit.
+func (i *Instance) limitExceeded() {
+	i.log.Printf("Wasm program interrupted after exceeding its %s", i.meter.String())
+	if i.ds_sent {
+		return
+	}
+	i.ds_sent = true
+
+	if i.meter.Exceeded() == limitWallClock {
+		i.ds_response.WriteHeader(http.StatusGatewayTimeout)
+	} else {
+		i.ds_response.WriteHeader(http.StatusServiceUnavailable)
+	}
+	i.ds_response.Write([]byte(fmt.Sprintf("Wasm program exceeded its %s.\n", i.meter.String())))
+}
+
+// outOfMemory returns true if the guest tried and failed to grow its memory during this request,
+// which is most likely why it failed
+func (i *Instance) outOfMemory() bool {
+	if i.growFailed == nil {
+		return false
+	}
+
+	return i.growFailed.Get(i.wasmctx.store).I32() != 0
+}
+
+// MemorySize returns the size, in bytes, of the guest's linear memory. While a request is being
+// served, this is the current size. Otherwise, it's the size the guest's memory had grown to by the
+// end of the last request. Since each request gets a fresh store, this memory is released as soon as
+// the request is done.
+func (i *Instance) MemorySize() int {
+	if i.memory != nil {
+		return i.memory.Len()
+	}
+
+	return i.lastMemorySize
+}
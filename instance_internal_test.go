@@ -0,0 +1,40 @@
+package fastlike
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTPSetupError(t *testing.T) {
+	t.Parallel()
+
+	// An instance which couldn't be prepared reports that when it's asked to serve a request
+	i := configure()
+	i.err = &LinkError{errors.New("secret internals")}
+
+	var logs bytes.Buffer
+	i.log.SetOutput(&logs)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost:1337/", nil)
+	i.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Logf("expected a 500, got %d", w.Code)
+		t.Fail()
+	}
+
+	if strings.Contains(w.Body.String(), "secret internals") {
+		t.Logf("expected the error to be kept out of the response, got %q", w.Body.String())
+		t.Fail()
+	}
+
+	if !strings.Contains(logs.String(), "secret internals") {
+		t.Logf("expected the error to be logged, got %q", logs.String())
+		t.Fail()
+	}
+}
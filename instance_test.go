@@ -0,0 +1,51 @@
+package fastlike_test
+
+import (
+	"encoding/binary"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// freshWat grows memory by two pages, and bumps both a global and a counter in memory. It responds
+// with the global, the counter and the memory size in pages, as a list of i32s.
+var freshWat = guest("", `
+	(global $count (mut i32) (i32.const 0))
+	(data (i32.const 1024) "\00\00\00\00")
+	(func (export "_start")
+		(drop (memory.grow (i32.const 2)))
+		(global.set $count (i32.add (global.get $count) (i32.const 1)))
+		(i32.store (i32.const 1024) (i32.add (i32.load (i32.const 1024)) (i32.const 1)))
+		(i32.store (i32.const 2048) (global.get $count))
+		(i32.store (i32.const 2052) (i32.load (i32.const 1024)))
+		(i32.store (i32.const 2056) (memory.size))
+		(call $respond_with (i32.const 200) (i32.const 2048) (i32.const 12)))`)
+
+func TestInstanceReuse(t *testing.T) {
+	t.Parallel()
+
+	// The instance checked when the guest was compiled is already in the pool, so this is it
+	i := newGuest(t, freshWat).Instantiate()
+
+	for n := 0; n < 5; n++ {
+		w := serve(i)
+		if w.Code != http.StatusOK || w.Body.Len() != 12 {
+			t.Fatalf("request %d: expected the results, got %d %q", n, w.Code, w.Body.String())
+		}
+
+		actual := make([]int32, 3)
+		binary.Read(w.Body, binary.LittleEndian, actual)
+
+		// Every request starts from the module's initial state, so nothing left behind by the last
+		// one is visible, and memory doesn't keep growing
+		if expected := []int32{1, 1, 3}; !reflect.DeepEqual(actual, expected) {
+			t.Logf("request %d: expected %v, got %v", n, expected, actual)
+			t.Fail()
+		}
+
+		if size := i.MemorySize(); size != 3*64*1024 {
+			t.Logf("request %d: expected a memory size of 3 pages, got %d bytes", n, size)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package fastlike
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrKVNotFound is returned by a KVStore when the key doesn't exist
+	ErrKVNotFound = errors.New("kv store: key not found")
+
+	// ErrKVPreconditionFailed is returned by a KVStore when an insert's conditions aren't met, such
+	// as adding a key that already exists or a generation that doesn't match
+	ErrKVPreconditionFailed = errors.New("kv store: precondition failed")
+)
+
+// KVEntry is a value in a KVStore along with everything stored alongside it
+type KVEntry struct {
+	Value    []byte
+	Metadata string
+
+	// Generation changes every time the value is written
+	Generation uint64
+}
+
+// KVInsertMode describes how an insert treats an existing value
+type KVInsertMode int
+
+const (
+	// KVOverwrite replaces any existing value
+	KVOverwrite KVInsertMode = iota
+	// KVAdd only inserts the value if the key doesn't exist yet
+	KVAdd
+	// KVAppend adds the value to the end of any existing value
+	KVAppend
+	// KVPrepend adds the value to the start of any existing value
+	KVPrepend
+)
+
+// KVInsertOptions controls how a value is inserted into a KVStore
+type KVInsertOptions struct {
+	Mode     KVInsertMode
+	Metadata string
+
+	// TTL is how long the value lives for, or 0 for forever
+	TTL time.Duration
+
+	// IfGenerationMatch, if set, means the insert only happens if the existing value has this
+	// generation
+	IfGenerationMatch *uint64
+}
+
+// KVStore is a key-value store guests can use with the fastly_kv_store and fastly_object_store
+// hostcalls, registered with WithKVStore. Implementations must be safe for concurrent use.
+type KVStore interface {
+	// Lookup returns the entry for key, or ErrKVNotFound
+	Lookup(key string) (KVEntry, error)
+
+	// Insert stores value under key
+	Insert(key string, value []byte, opts KVInsertOptions) error
+
+	// Delete removes key, or returns ErrKVNotFound
+	Delete(key string) error
+
+	// List returns every key which starts with prefix, in sorted order
+	List(prefix string) ([]string, error)
+}
+
+// insertKV works out the entry which results from inserting value on top of existing, which is nil
+// if the key doesn't exist
+func insertKV(existing *KVEntry, value []byte, opts KVInsertOptions, generation uint64) (KVEntry, error) {
+	if opts.IfGenerationMatch != nil && (existing == nil || existing.Generation != *opts.IfGenerationMatch) {
+		return KVEntry{}, ErrKVPreconditionFailed
+	}
+
+	entry := KVEntry{Value: value, Metadata: opts.Metadata, Generation: generation}
+	if existing == nil {
+		return entry, nil
+	}
+
+	switch opts.Mode {
+	case KVAdd:
+		return KVEntry{}, ErrKVPreconditionFailed
+	case KVAppend:
+		entry.Value = append(append([]byte{}, existing.Value...), value...)
+	case KVPrepend:
+		entry.Value = append(append([]byte{}, value...), existing.Value...)
+	}
+
+	return entry, nil
+}
+
+// memoryKVStore is a KVStore which holds everything in memory
+type memoryKVStore struct {
+	mu         sync.RWMutex
+	entries    map[string]memoryKVEntry
+	generation uint64
+}
+
+type memoryKVEntry struct {
+	KVEntry
+	expires time.Time
+}
+
+// NewMemoryKVStore returns an empty KVStore which holds everything in memory
+func NewMemoryKVStore() KVStore {
+	return &memoryKVStore{entries: map[string]memoryKVEntry{}}
+}
+
+// get returns the entry for key if it exists and hasn't expired. The caller must hold s.mu.
+func (s *memoryKVStore) get(key string) (memoryKVEntry, bool) {
+	e, ok := s.entries[key]
+	if !ok || (!e.expires.IsZero() && time.Now().After(e.expires)) {
+		return memoryKVEntry{}, false
+	}
+	return e, true
+}
+
+func (s *memoryKVStore) Lookup(key string) (KVEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.get(key)
+	if !ok {
+		return KVEntry{}, ErrKVNotFound
+	}
+	return e.KVEntry, nil
+}
+
+func (s *memoryKVStore) Insert(key string, value []byte, opts KVInsertOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var existing *KVEntry
+	if e, ok := s.get(key); ok {
+		existing = &e.KVEntry
+	}
+
+	s.generation++
+	entry, err := insertKV(existing, value, opts, s.generation)
+	if err != nil {
+		return err
+	}
+
+	var expires time.Time
+	if opts.TTL > 0 {
+		expires = time.Now().Add(opts.TTL)
+	}
+
+	s.entries[key] = memoryKVEntry{entry, expires}
+	return nil
+}
+
+func (s *memoryKVStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.get(key); !ok {
+		return ErrKVNotFound
+	}
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *memoryKVStore) List(prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []string{}
+	for key := range s.entries {
+		if _, ok := s.get(key); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// dirKVStore is a KVStore which keeps each value in a file in a directory
+type dirKVStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// dirKVMeta is what's stored alongside a value in a dirKVStore
+type dirKVMeta struct {
+	Metadata   string    `json:"metadata,omitempty"`
+	Expires    time.Time `json:"expires,omitempty"`
+	Generation uint64    `json:"generation,omitempty"`
+}
+
+const (
+	// dirKVMetaDir is the subdirectory of a dirKVStore which holds metadata. Escaped keys never
+	// have a % which isn't followed by two hex digits, so no key can have the same name.
+	dirKVMetaDir = ".%metadata"
+
+	// dirKVGenerationFile is the file in dirKVMetaDir which holds the last generation written
+	dirKVGenerationFile = "generation"
+)
+
+// NewDirKVStore returns a KVStore which keeps each value in a file in dir, named after its
+// (escaped) key. Metadata is kept in a hidden subdirectory, along with a counter which gives each
+// write its generation. Files added to dir by hand have a generation of 0.
+func NewDirKVStore(dir string) KVStore {
+	return &dirKVStore{dir: dir}
+}
+
+func (s *dirKVStore) path(key string) string {
+	return filepath.Join(s.dir, url.PathEscape(key))
+}
+
+func (s *dirKVStore) metaPath(key string) string {
+	return filepath.Join(s.dir, dirKVMetaDir, url.PathEscape(key)+".json")
+}
+
+// read returns the entry for key if it exists and hasn't expired. The caller must hold s.mu.
+func (s *dirKVStore) read(key string) (KVEntry, error) {
+	_, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return KVEntry{}, ErrKVNotFound
+	} else if err != nil {
+		return KVEntry{}, err
+	}
+
+	var meta dirKVMeta
+	if data, err := ioutil.ReadFile(s.metaPath(key)); err == nil {
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return KVEntry{}, err
+		}
+	}
+
+	if !meta.Expires.IsZero() && time.Now().After(meta.Expires) {
+		return KVEntry{}, ErrKVNotFound
+	}
+
+	value, err := ioutil.ReadFile(s.path(key))
+	if err != nil {
+		return KVEntry{}, err
+	}
+
+	return KVEntry{Value: value, Metadata: meta.Metadata, Generation: meta.Generation}, nil
+}
+
+// nextGeneration counts up from the last generation written to the store, and returns the new one.
+// The counter is kept in the directory, so that it carries on where it left off. The caller must
+// hold s.mu.
+func (s *dirKVStore) nextGeneration() (uint64, error) {
+	path := filepath.Join(s.dir, dirKVMetaDir, dirKVGenerationFile)
+
+	var generation uint64
+	if data, err := ioutil.ReadFile(path); err == nil {
+		generation, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	generation++
+	return generation, ioutil.WriteFile(path, []byte(strconv.FormatUint(generation, 10)), 0644)
+}
+
+func (s *dirKVStore) Lookup(key string) (KVEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(key)
+}
+
+func (s *dirKVStore) Insert(key string, value []byte, opts KVInsertOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var existing *KVEntry
+	e, err := s.read(key)
+	if err == nil {
+		existing = &e
+	} else if err != ErrKVNotFound {
+		return err
+	}
+
+	entry, err := insertKV(existing, value, opts, 0)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(s.dir, dirKVMetaDir), 0755); err != nil {
+		return err
+	}
+
+	generation, err := s.nextGeneration()
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(s.path(key), entry.Value, 0644); err != nil {
+		return err
+	}
+
+	meta := dirKVMeta{Metadata: entry.Metadata, Generation: generation}
+	if opts.TTL > 0 {
+		meta.Expires = time.Now().Add(opts.TTL)
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.metaPath(key), data, 0644)
+}
+
+func (s *dirKVStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.read(key); err != nil {
+		return err
+	}
+
+	os.Remove(s.metaPath(key))
+	return os.Remove(s.path(key))
+}
+
+func (s *dirKVStore) List(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		key, err := url.PathUnescape(f.Name())
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if _, err := s.read(key); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (i *Instance) addKVStore(name string, store KVStore) {
+	i.kvStores = append(i.kvStores, kvStore{name, store})
+}
+
+func (i *Instance) getKVStoreHandle(name string) int {
+	for j, s := range i.kvStores {
+		if s.name == name {
+			return j
+		}
+	}
+
+	return HandleInvalid
+}
+
+func (i *Instance) getKVStore(handle int) KVStore {
+	if handle < 0 || handle > len(i.kvStores)-1 {
+		return nil
+	}
+
+	return i.kvStores[handle].store
+}
+
+type kvStore struct {
+	name  string
+	store KVStore
+}
@@ -0,0 +1,100 @@
+package fastlike_test
+
+import (
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/Khan/fastlike"
+)
+
+// kvStoreWat looks up "hello" in the "store" KV store and responds with its value. If it isn't there,
+// it inserts "inserted" and responds with a 404.
+var kvStoreWat = guest(`
+	(import "fastly_object_store" "open" (func $open (param i32 i32 i32) (result i32)))
+	(import "fastly_object_store" "lookup" (func $lookup (param i32 i32 i32 i32) (result i32)))
+	(import "fastly_object_store" "insert" (func $insert (param i32 i32 i32 i32) (result i32)))`, `
+	(data (i32.const 1024) "store")
+	(data (i32.const 1040) "hello")
+	(data (i32.const 1056) "inserted")
+	(func (export "_start")
+		(local $body i32)
+		(drop (call $open (i32.const 1024) (i32.const 5) (i32.const 0)))
+		(drop (call $lookup (i32.load (i32.const 0)) (i32.const 1040) (i32.const 5) (i32.const 4)))
+		(if (i32.eq (i32.load (i32.const 4)) (i32.const -2))
+			(then
+				(local.set $body (call $body))
+				(drop (call $body_write (local.get $body) (i32.const 1056) (i32.const 8) (i32.const 0) (i32.const 16)))
+				(drop (call $insert (i32.load (i32.const 0)) (i32.const 1040) (i32.const 5) (local.get $body)))
+				(call $respond (i32.const 404) (call $body))
+				(return)))
+		(call $respond (i32.const 200) (i32.load (i32.const 4))))`)
+
+func TestKVStore(t *testing.T) {
+	t.Parallel()
+
+	stores := map[string]fastlike.KVStore{
+		"memory":    fastlike.NewMemoryKVStore(),
+		"directory": fastlike.NewDirKVStore(t.TempDir()),
+	}
+
+	for name, store := range stores {
+		f := newGuest(t, kvStoreWat, fastlike.WithKVStore("store", store))
+
+		// The first request inserts the value, and the second finds it
+		expectResponse(t, name, f, http.StatusNotFound, "")
+		expectResponse(t, name, f, http.StatusOK, "inserted")
+
+		if err := store.Insert("hello", []byte("!"), fastlike.KVInsertOptions{Mode: fastlike.KVAppend, Metadata: "meta"}); err != nil {
+			t.Fatalf("%s: expected no error, got %s", name, err.Error())
+		}
+
+		entry, err := store.Lookup("hello")
+		if err != nil || string(entry.Value) != "inserted!" || entry.Metadata != "meta" {
+			t.Logf("%s: expected the appended value with metadata, got %+v (%v)", name, entry, err)
+			t.Fail()
+		}
+
+		if err := store.Insert("hello", []byte("x"), fastlike.KVInsertOptions{Mode: fastlike.KVAdd}); err != fastlike.ErrKVPreconditionFailed {
+			t.Logf("%s: expected adding an existing key to fail, got %v", name, err)
+			t.Fail()
+		}
+
+		if keys, _ := store.List("he"); len(keys) != 1 || keys[0] != "hello" {
+			t.Logf("%s: expected to list [hello], got %v", name, keys)
+			t.Fail()
+		}
+
+		if err := store.Delete("hello"); err != nil {
+			t.Logf("%s: expected no error deleting, got %s", name, err.Error())
+			t.Fail()
+		}
+		if _, err := store.Lookup("hello"); err != fastlike.ErrKVNotFound {
+			t.Logf("%s: expected the key to be deleted, got %v", name, err)
+			t.Fail()
+		}
+
+		// Keys don't get mixed up with wherever the store keeps metadata, and each write gets a new
+		// generation which can be checked against
+		for _, value := range []string{"first", "second"} {
+			var opts fastlike.KVInsertOptions
+			if entry, err := store.Lookup(".metadata"); err == nil {
+				opts.IfGenerationMatch = &entry.Generation
+			}
+			if err := store.Insert(".metadata", []byte(value), opts); err != nil {
+				t.Fatalf("%s: expected no error inserting %q, got %s", name, value, err.Error())
+			}
+		}
+
+		stale := uint64(1)
+		entry, err = store.Lookup(".metadata")
+		if err != nil || string(entry.Value) != "second" || entry.Generation <= stale || entry.Generation > math.MaxUint32 {
+			t.Logf("%s: expected the second value with a small generation, got %+v (%v)", name, entry, err)
+			t.Fail()
+		}
+		if err := store.Insert(".metadata", []byte("x"), fastlike.KVInsertOptions{IfGenerationMatch: &stale}); err != fastlike.ErrKVPreconditionFailed {
+			t.Logf("%s: expected inserting over a stale generation to fail, got %v", name, err)
+			t.Fail()
+		}
+	}
+}
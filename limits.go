@@ -0,0 +1,191 @@
+package fastlike
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ExecutionLimits bounds how long a guest may run for a single request, similar to the limits
+// Fastly enforces on Compute programs. A zero value for either limit means it isn't enforced.
+type ExecutionLimits struct {
+	// WallClock is the longest a guest may run for, from the start of the request until the guest
+	// returns, regardless of what it's doing. Guests which exceed it get a 504 Gateway Timeout.
+	WallClock time.Duration
+
+	// Active is the longest a guest may spend running rather than blocked in host calls, such as
+	// waiting on a backend or reading a request body. Guests which exceed it get a 503 Service
+	// Unavailable.
+	//
+	// This is not CPU time. The version of wasmtime we use doesn't support fuel or epoch
+	// interruption, so it's measured as wall-clock time minus time spent blocked, which includes any
+	// time the guest spends waiting for the Go scheduler or the operating system.
+	Active time.Duration
+}
+
+// limitKind identifies which execution limit a guest ran into
+type limitKind int
+
+const (
+	limitNone limitKind = iota
+	limitWallClock
+	limitActive
+)
+
+// executionMeter keeps track of how much of its execution limits a guest has used during a request,
+// and interrupts it once it has used too much
+type executionMeter struct {
+	limits ExecutionLimits
+
+	// ctx is cancelled once a limit is exceeded, so that anything the guest is waiting on gives up
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu           sync.Mutex
+	start        time.Time
+	blocked      time.Duration
+	blockedSince time.Time
+	blocking     int
+	exceeded     limitKind
+}
+
+func newExecutionMeter(limits ExecutionLimits) *executionMeter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &executionMeter{limits: limits, ctx: ctx, cancel: cancel, start: time.Now()}
+}
+
+// Context returns a context which is cancelled once the guest exceeds one of its limits. It's safe
+// to call on a nil meter, in which case the context is never cancelled.
+func (m *executionMeter) Context() context.Context {
+	if m == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// block records that the guest is waiting on the host, and returns a function to call when it's done
+// waiting. Calls may nest or overlap, in which case the guest is blocked until the last of them is
+// done. It's safe to call on a nil meter.
+func (m *executionMeter) block() func() {
+	if m == nil {
+		return func() {}
+	}
+
+	m.mu.Lock()
+	if m.blocking == 0 {
+		m.blockedSince = time.Now()
+	}
+	m.blocking++
+	m.mu.Unlock()
+
+	return func() {
+		m.mu.Lock()
+		m.blocking--
+		if m.blocking == 0 {
+			m.blocked += time.Since(m.blockedSince)
+			m.blockedSince = time.Time{}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// stop releases the meter's context once the guest is done. It's safe to call on a nil meter.
+func (m *executionMeter) stop() {
+	if m != nil {
+		m.cancel()
+	}
+}
+
+// check returns the limit the guest has exceeded, if any, and otherwise how long until it could
+// possibly exceed one
+func (m *executionMeter) check(now time.Time) (limitKind, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elapsed := now.Sub(m.start)
+	used := elapsed - m.blocked
+	if !m.blockedSince.IsZero() {
+		used -= now.Sub(m.blockedSince)
+	}
+
+	var next time.Duration = -1
+	if m.limits.WallClock > 0 {
+		if elapsed >= m.limits.WallClock {
+			m.exceeded = limitWallClock
+			return limitWallClock, 0
+		}
+		next = m.limits.WallClock - elapsed
+	}
+
+	if m.limits.Active > 0 {
+		if used >= m.limits.Active {
+			m.exceeded = limitActive
+			return limitActive, 0
+		}
+		if remaining := m.limits.Active - used; next < 0 || remaining < next {
+			next = remaining
+		}
+	}
+
+	return limitNone, next
+}
+
+// watch interrupts the guest when the context is cancelled or it exceeds its execution limits,
+// whichever comes first. It returns once done is closed.
+// The interrupt only takes effect once the guest is running again, so when a limit is exceeded the
+// meter's context is cancelled too, which wakes the guest if it's waiting on a backend.
+func (m *executionMeter) watch(ctx context.Context, done <-chan struct{}, interrupt func()) {
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	if m != nil {
+		if _, next := m.check(time.Now()); next >= 0 {
+			timer = time.NewTimer(next)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// If the context cancels before we're done it's a timeout/deadline/client hung up and we
+			// should interrupt the wasm program.
+			interrupt()
+			return
+		case <-done:
+			// Otherwise, we're good and don't need to do anything else.
+			return
+		case now := <-timeout:
+			kind, next := m.check(now)
+			if kind != limitNone {
+				interrupt()
+				m.cancel()
+				return
+			}
+			timer.Reset(next)
+		}
+	}
+}
+
+// Exceeded returns the limit the guest ran into, if any. It's safe to call on a nil meter.
+func (m *executionMeter) Exceeded() limitKind {
+	if m == nil {
+		return limitNone
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.exceeded
+}
+
+// String describes the limit which was exceeded, for log messages
+func (m *executionMeter) String() string {
+	switch m.Exceeded() {
+	case limitWallClock:
+		return fmt.Sprintf("wall-clock limit of %s", m.limits.WallClock)
+	case limitActive:
+		return fmt.Sprintf("active time limit of %s", m.limits.Active)
+	}
+	return "no limit"
+}
@@ -0,0 +1,56 @@
+package fastlike_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Khan/fastlike"
+)
+
+// spinWat never finishes
+var spinWat = guest("", `
+	(func (export "_start")
+		(loop $spin (br $spin)))`)
+
+// proxyWat sends downstream whatever the "slow" backend responds with
+var proxyWat = guest("", `
+	(data (i32.const 1024) "http://slow/")
+	(data (i32.const 1040) "slow")
+	(func (export "_start")
+		(call $proxy (call $request (i32.const 1024) (i32.const 12)) (i32.const 1040) (i32.const 4)))`)
+
+func TestExecutionLimits(t *testing.T) {
+	t.Parallel()
+
+	slow := fastlike.WithBackend("slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("slow response"))
+	}))
+
+	cases := []struct {
+		name     string
+		wat      string
+		limits   fastlike.ExecutionLimits
+		expected int
+	}{
+		{"wall-clock", spinWat, fastlike.ExecutionLimits{WallClock: 50 * time.Millisecond}, http.StatusGatewayTimeout},
+		{"active", spinWat, fastlike.ExecutionLimits{Active: 50 * time.Millisecond}, http.StatusServiceUnavailable},
+		{"active-excludes-backend", proxyWat, fastlike.ExecutionLimits{Active: 50 * time.Millisecond}, http.StatusOK},
+		{"wall-clock-includes-backend", proxyWat, fastlike.ExecutionLimits{WallClock: 50 * time.Millisecond}, http.StatusGatewayTimeout},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(st *testing.T) {
+			st.Parallel()
+			f := newGuest(st, c.wat, slow, fastlike.WithExecutionLimits(c.limits))
+
+			w := serve(f)
+			if w.Code != c.expected {
+				st.Logf("expected status %d, got %d: %s", c.expected, w.Code, w.Body.String())
+				st.Fail()
+			}
+		})
+	}
+}
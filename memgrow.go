@@ -0,0 +1,401 @@
+package fastlike
+
+import "errors"
+
+// growFailedExport is the name of the global hookMemoryGrow adds to a module, which is set to 1 as
+// soon as the guest fails to grow its memory
+const growFailedExport = "fastlike:memory_grow_failed"
+
+// The ids of the sections of a wasm module which hookMemoryGrow needs to read or change
+const (
+	typeSectionID     = 1
+	importSectionID   = 2
+	functionSectionID = 3
+	globalSectionID   = 6
+	exportSectionID   = 7
+	codeSectionID     = 10
+)
+
+// sectionOrder is the order known sections must appear in, by id. Custom sections (id 0) can go
+// anywhere.
+var sectionOrder = []byte{1, 2, 3, 4, 5, 13, 6, 7, 8, 9, 12, 10, 11}
+
+var errUnsupportedModule = errors.New("wasm module uses features which can't be hooked")
+
+// hookMemoryGrow rewrites a module so that we can tell when it fails to grow its memory. The version
+// of wasmtime we use can't tell us itself, so every `memory.grow` in the module becomes a call to a
+// new function which does the same thing, but also sets an exported global if it fails.
+// Modules which import their memory, or use instructions we don't know how to read, can't be hooked
+// and return an error. Modules without a memory, or which never grow it, are returned as they are.
+func hookMemoryGrow(sections []wasmSection) ([]wasmSection, error) {
+	find := func(id byte) []byte {
+		for _, s := range sections {
+			if s.id == id {
+				return s.payload
+			}
+		}
+		return nil
+	}
+
+	// Sections which aren't there have no entries
+	count := func(r *wasmReader) uint64 {
+		if len(r.b) == 0 {
+			return 0
+		}
+		return r.leb()
+	}
+
+	var importedFuncs, importedGlobals uint64
+	r := &wasmReader{b: find(importSectionID)}
+	for n := count(r); n > 0 && r.err == nil; n-- {
+		r.skip(r.leb())
+		r.skip(r.leb())
+		switch r.u8() {
+		case 0:
+			importedFuncs++
+			r.leb()
+		case 1:
+			r.valType()
+			r.limits()
+		case 2:
+			return nil, errUnsupportedModule
+		case 3:
+			importedGlobals++
+			r.valType()
+			r.u8()
+		case 4:
+			r.u8()
+			r.leb()
+		default:
+			r.fail()
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// Without a memory, there's nothing to grow. Only 32-bit memories are supported, so that the hook
+	// always takes and returns an i32.
+	r = &wasmReader{b: find(memorySectionID)}
+	if len(r.b) == 0 {
+		return sections, nil
+	} else if r.leb() == 0 || r.u8()&4 != 0 {
+		return nil, errUnsupportedModule
+	}
+
+	types := &wasmReader{b: find(typeSectionID)}
+	typeCount := count(types)
+	typeEntries := types.b
+	for n := typeCount; n > 0 && types.err == nil; n-- {
+		if types.u8() != 0x60 {
+			return nil, errUnsupportedModule
+		}
+		for p := types.leb(); p > 0; p-- {
+			types.valType()
+		}
+		for p := types.leb(); p > 0; p-- {
+			types.valType()
+		}
+	}
+
+	funcs := &wasmReader{b: find(functionSectionID)}
+	funcCount := count(funcs)
+	globals := &wasmReader{b: find(globalSectionID)}
+	globalCount := count(globals)
+	exports := &wasmReader{b: find(exportSectionID)}
+	exportCount := count(exports)
+
+	for _, r := range []*wasmReader{r, types, funcs, globals, exports} {
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+
+	hook := importedFuncs + funcCount
+	flag := importedGlobals + globalCount
+
+	code, found, err := hookCode(find(codeSectionID), hook)
+	if err != nil {
+		return nil, err
+	} else if !found {
+		return sections, nil
+	}
+
+	// The hook is `(func (param i32) (result i32))`, grows the memory, and sets the flag if that
+	// returned -1
+	body := []byte{
+		0x01, 0x01, 0x7f, // one i32 local
+		0x20, 0x00, 0x40, 0x00, 0x22, 0x01, // local.get 0, memory.grow, local.tee 1
+		0x41, 0x7f, 0x46, 0x04, 0x40, // i32.const -1, i32.eq, if
+		0x41, 0x01, 0x24, // i32.const 1, global.set
+	}
+	body = appendLEB(body, flag)
+	body = append(body, 0x0b, 0x20, 0x01, 0x0b) // end, local.get 1, end
+	code = append(appendLEB(code, uint64(len(body))), body...)
+
+	global := []byte{0x7f, 0x01, 0x41, 0x00, 0x0b} // (global (mut i32) (i32.const 0))
+	export := append(appendLEB(nil, uint64(len(growFailedExport))), growFailedExport...)
+	export = append(export, 0x03)
+	export = appendLEB(export, flag)
+
+	sections = replaceSection(sections, typeSectionID, typeCount+1, typeEntries, []byte{0x60, 0x01, 0x7f, 0x01, 0x7f})
+	sections = replaceSection(sections, functionSectionID, funcCount+1, funcs.b, appendLEB(nil, typeCount))
+	sections = replaceSection(sections, globalSectionID, globalCount+1, globals.b, global)
+	sections = replaceSection(sections, exportSectionID, exportCount+1, exports.b, export)
+	sections = replaceSection(sections, codeSectionID, funcCount+1, code, nil)
+
+	return sections, nil
+}
+
+// replaceSection replaces the section with the given id with count entries, made up of entries
+// followed by extra. If there's no such section, it's added in the right place.
+func replaceSection(sections []wasmSection, id byte, count uint64, entries, extra []byte) []wasmSection {
+	payload := appendLEB(nil, count)
+	payload = append(payload, entries...)
+	payload = append(payload, extra...)
+
+	rank := func(id byte) int {
+		for k, o := range sectionOrder {
+			if o == id {
+				return k
+			}
+		}
+		return -1
+	}
+
+	out := make([]wasmSection, 0, len(sections)+1)
+	added := false
+	for _, s := range sections {
+		if s.id == id {
+			out = append(out, wasmSection{id: id, payload: payload})
+			added = true
+			continue
+		}
+		if !added && s.id != 0 && rank(s.id) > rank(id) {
+			out = append(out, wasmSection{id: id, payload: payload})
+			added = true
+		}
+		out = append(out, s)
+	}
+	if !added {
+		out = append(out, wasmSection{id: id, payload: payload})
+	}
+
+	return out
+}
+
+// hookCode replaces every `memory.grow` of the first memory in a code section with a call to the
+// function hook. It returns the function bodies without the count in front of them, and whether it
+// found anything to replace.
+func hookCode(section []byte, hook uint64) ([]byte, bool, error) {
+	r := &wasmReader{b: section}
+
+	var out []byte
+	var found bool
+	for n := r.leb(); n > 0 && r.err == nil; n-- {
+		size := r.leb()
+		if r.err != nil || uint64(len(r.b)) < size {
+			return nil, false, errMalformedModule
+		}
+
+		body, ok, err := hookBody(r.b[:size], hook)
+		if err != nil {
+			return nil, false, err
+		}
+		r.skip(size)
+
+		found = found || ok
+		out = appendLEB(out, uint64(len(body)))
+		out = append(out, body...)
+	}
+
+	if r.err == nil && len(r.b) != 0 {
+		return nil, false, errMalformedModule
+	}
+
+	return out, found, r.err
+}
+
+// hookBody replaces every `memory.grow` of the first memory in a function body with a call to hook
+func hookBody(body []byte, hook uint64) ([]byte, bool, error) {
+	r := &wasmReader{b: body}
+	for n := r.leb(); n > 0 && r.err == nil; n-- {
+		r.leb()
+		r.valType()
+	}
+
+	out := append([]byte{}, body[:len(body)-len(r.b)]...)
+	found := false
+	for len(r.b) > 0 && r.err == nil {
+		start := r.b
+		op := r.u8()
+		if op == 0x40 && r.leb() == 0 {
+			out = append(out, 0x10)
+			out = appendLEB(out, hook)
+			found = true
+			continue
+		} else if op != 0x40 {
+			r.immediates(op)
+		}
+		out = append(out, start[:len(start)-len(r.b)]...)
+	}
+
+	return out, found, r.err
+}
+
+// wasmReader reads the pieces of a wasm module from b. Once it reads something malformed or runs
+// out of bytes, err is set and everything else it reads is zero.
+type wasmReader struct {
+	b   []byte
+	err error
+}
+
+func (r *wasmReader) fail() {
+	if r.err == nil {
+		r.err = errMalformedModule
+	}
+	r.b = nil
+}
+
+// u8 reads a single byte
+func (r *wasmReader) u8() byte {
+	if len(r.b) == 0 {
+		r.fail()
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+// leb reads a LEB128 integer. Signed integers can be skipped over in the same way.
+func (r *wasmReader) leb() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n, err := readLEB(r.b)
+	if err != nil {
+		r.fail()
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+// skip skips over n bytes
+func (r *wasmReader) skip(n uint64) {
+	if uint64(len(r.b)) < n {
+		r.fail()
+		return
+	}
+	r.b = r.b[n:]
+}
+
+// valType skips over a value type, including reference types with a heap type
+func (r *wasmReader) valType() {
+	if c := r.u8(); c == 0x63 || c == 0x64 {
+		r.leb()
+	}
+}
+
+// limits skips over the limits of a table or memory
+func (r *wasmReader) limits() {
+	flags := r.u8()
+	r.leb()
+	if flags&1 == 1 {
+		r.leb()
+	}
+}
+
+// memarg skips over the alignment, memory and offset of a load or store
+func (r *wasmReader) memarg() {
+	if r.leb()&0x40 != 0 {
+		r.leb()
+	}
+	r.leb()
+}
+
+// immediates skips over the immediate arguments of the instruction op. Anything it doesn't
+// recognise is treated as an error, since it can't know how long it is.
+func (r *wasmReader) immediates(op byte) {
+	switch {
+	case op <= 0x01, op == 0x05, op == 0x0a, op == 0x0b, op == 0x0f, op == 0x19, op == 0x1a, op == 0x1b,
+		op == 0xd1, op == 0xd3, op == 0xd5, op >= 0x45 && op <= 0xc4:
+		// no immediates
+	case op >= 0x02 && op <= 0x04, op >= 0x06 && op <= 0x09, op == 0x0c, op == 0x0d, op == 0x10,
+		op == 0x12, op == 0x14, op == 0x15, op == 0x18, op >= 0x20 && op <= 0x26, op >= 0x3f && op <= 0x42,
+		op == 0xd0, op == 0xd2, op == 0xd4, op == 0xd6:
+		r.leb()
+	case op == 0x11, op == 0x13:
+		r.leb()
+		r.leb()
+	case op == 0x0e:
+		for n := r.leb(); n > 0 && r.err == nil; n-- {
+			r.leb()
+		}
+		r.leb()
+	case op == 0x1c:
+		for n := r.leb(); n > 0 && r.err == nil; n-- {
+			r.valType()
+		}
+	case op >= 0x28 && op <= 0x3e:
+		r.memarg()
+	case op == 0x43:
+		r.skip(4)
+	case op == 0x44:
+		r.skip(8)
+	case op == 0xfc:
+		r.miscImmediates(r.leb())
+	case op == 0xfd:
+		r.simdImmediates(r.leb())
+	case op == 0xfe:
+		r.atomicImmediates(r.leb())
+	default:
+		r.fail()
+	}
+}
+
+// miscImmediates skips over the immediates of the 0xfc-prefixed saturating truncation, bulk memory
+// and table instructions
+func (r *wasmReader) miscImmediates(op uint64) {
+	switch {
+	case op <= 7:
+	case op == 9, op == 11, op == 13, op >= 15 && op <= 17:
+		r.leb()
+	case op == 8, op == 10, op == 12, op == 14:
+		r.leb()
+		r.leb()
+	default:
+		r.fail()
+	}
+}
+
+// simdImmediates skips over the immediates of the 0xfd-prefixed SIMD instructions
+func (r *wasmReader) simdImmediates(op uint64) {
+	switch {
+	case op <= 11, op == 92, op == 93:
+		r.memarg()
+	case op == 12, op == 13:
+		r.skip(16)
+	case op >= 21 && op <= 34:
+		r.skip(1)
+	case op >= 84 && op <= 91:
+		r.memarg()
+		r.skip(1)
+	case op <= 0x113:
+	default:
+		r.fail()
+	}
+}
+
+// atomicImmediates skips over the immediates of the 0xfe-prefixed atomic instructions
+func (r *wasmReader) atomicImmediates(op uint64) {
+	switch {
+	case op == 3:
+		r.skip(1)
+	case op <= 2, op >= 0x10 && op <= 0x4e:
+		r.memarg()
+	default:
+		r.fail()
+	}
+}
@@ -0,0 +1,187 @@
+package fastlike
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// DefaultMemoryLimit is the largest the guest's linear memory may grow to unless WithMemoryLimit says
+// otherwise. It matches the heap limit Fastly enforces in production.
+const DefaultMemoryLimit = 128 * 1024 * 1024
+
+// wasmPageSize is the size of a single page of wasm linear memory
+const wasmPageSize = 64 * 1024
+
+// memorySectionID identifies the section of a wasm module which defines its memories
+const memorySectionID = 5
+
+var errMalformedModule = errors.New("malformed wasm module")
+
+// limitMemory rewrites the memory section of a compiled wasm module so that each memory it defines
+// can't grow beyond limit bytes. The version of wasmtime we use doesn't support store limits, so
+// this is how we make `memory.grow` fail inside the guest rather than consuming host memory.
+// Memories which already have a smaller maximum are left alone, as are imported memories.
+// It also hooks `memory.grow` so that the instance can tell when the guest ran out of memory, and
+// logs to logger if it can't.
+func limitMemory(wasmbytes []byte, limit int64, logger *log.Logger) ([]byte, error) {
+	if limit < wasmPageSize {
+		return nil, fmt.Errorf("memory limit of %d bytes is less than a single %d byte page", limit, wasmPageSize)
+	}
+	pages := uint64(limit / wasmPageSize)
+
+	sections, err := readSections(wasmbytes)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, s := range sections {
+		if s.id != memorySectionID {
+			continue
+		}
+
+		sections[k].payload, err = limitMemorySection(s.payload, pages)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A module with instructions we don't know how to read still runs, but running out of memory
+	// is reported like any other failure
+	if hooked, err := hookMemoryGrow(sections); err == nil {
+		sections = hooked
+	} else {
+		logger.Printf("Can't hook memory.grow, so running out of memory won't be reported as such: %s", err.Error())
+	}
+
+	return writeSections(wasmbytes[:8], sections), nil
+}
+
+// wasmSection is one section of a compiled wasm module, without its header
+type wasmSection struct {
+	id      byte
+	payload []byte
+}
+
+// readSections splits a compiled wasm module into its sections, skipping over the magic number and
+// version
+func readSections(wasmbytes []byte) ([]wasmSection, error) {
+	if len(wasmbytes) < 8 {
+		return nil, errMalformedModule
+	}
+
+	var sections []wasmSection
+	r := wasmbytes[8:]
+	for len(r) > 0 {
+		id := r[0]
+		size, n, err := readLEB(r[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		start := 1 + n
+		end := start + int(size)
+		if end > len(r) || end < start {
+			return nil, errMalformedModule
+		}
+
+		sections = append(sections, wasmSection{id: id, payload: r[start:end]})
+		r = r[end:]
+	}
+
+	return sections, nil
+}
+
+// writeSections puts a module back together from its header and sections
+func writeSections(header []byte, sections []wasmSection) []byte {
+	var out bytes.Buffer
+	out.Write(header)
+	for _, s := range sections {
+		out.WriteByte(s.id)
+		out.Write(appendLEB(nil, uint64(len(s.payload))))
+		out.Write(s.payload)
+	}
+	return out.Bytes()
+}
+
+// limitMemorySection rewrites the contents of a memory section so every memory has a maximum of at
+// most pages
+func limitMemorySection(section []byte, pages uint64) ([]byte, error) {
+	count, n, err := readLEB(section)
+	if err != nil {
+		return nil, err
+	}
+	section = section[n:]
+
+	out := appendLEB(nil, count)
+	for j := uint64(0); j < count; j++ {
+		if len(section) == 0 {
+			return nil, errMalformedModule
+		}
+
+		// The low bit of the flags says whether there's a maximum, and the others (shared, 64-bit)
+		// carry through unchanged
+		flags := section[0]
+		min, n, err := readLEB(section[1:])
+		if err != nil {
+			return nil, err
+		}
+		section = section[1+n:]
+
+		max := pages
+		if flags&1 == 1 {
+			var m uint64
+			m, n, err = readLEB(section)
+			if err != nil {
+				return nil, err
+			}
+			section = section[n:]
+
+			if m < max {
+				max = m
+			}
+		}
+
+		if min > max {
+			return nil, fmt.Errorf("wasm program needs at least %d bytes of memory, more than the limit of %d", min*wasmPageSize, max*wasmPageSize)
+		}
+
+		out = append(out, flags|1)
+		out = appendLEB(out, min)
+		out = appendLEB(out, max)
+	}
+
+	if len(section) != 0 {
+		return nil, errMalformedModule
+	}
+
+	return out, nil
+}
+
+// readLEB reads an unsigned LEB128 integer, returning it along with the number of bytes it took up
+func readLEB(b []byte) (uint64, int, error) {
+	var v uint64
+	for n := 0; n < len(b) && n < 10; n++ {
+		v |= uint64(b[n]&0x7f) << (7 * n)
+		if b[n]&0x80 == 0 {
+			return v, n + 1, nil
+		}
+	}
+	return 0, 0, errMalformedModule
+}
+
+// appendLEB appends v to b as an unsigned LEB128 integer
+func appendLEB(b []byte, v uint64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if v == 0 {
+			return b
+		}
+	}
+}
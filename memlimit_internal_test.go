@@ -0,0 +1,309 @@
+package fastlike
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// discard is a logger for the tests which don't care what's logged
+var discard = log.New(ioutil.Discard, "", 0)
+
+func TestLimitMemory(t *testing.T) {
+	t.Parallel()
+
+	wat := func(s string) []byte {
+		b, err := wasmtime.Wat2Wasm(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// memoryMax compiles a module and returns the maximum size, in pages, of the memory it exports
+	memoryMax := func(b []byte) (uint32, error) {
+		module, err := wasmtime.NewModule(wasmtime.NewEngine(), b)
+		if err != nil {
+			return 0, err
+		}
+		for _, e := range module.Type().Exports() {
+			if mt := e.Type().MemoryType(); mt != nil {
+				return mt.Limits().Max, nil
+			}
+		}
+		return 0, errors.New("no memory exported")
+	}
+
+	cases := []struct {
+		name     string
+		wasm     []byte
+		limit    int64
+		expected uint32
+		fails    bool
+	}{
+		{"no maximum", wat(`(module (memory (export "memory") 1))`), 4 * wasmPageSize, 4, false},
+		{"larger maximum", wat(`(module (memory (export "memory") 1 8))`), 4 * wasmPageSize, 4, false},
+		{"smaller maximum", wat(`(module (memory (export "memory") 1 2))`), 4 * wasmPageSize, 2, false},
+		{"partial page", wat(`(module (memory (export "memory") 1))`), 4*wasmPageSize + 100, 4, false},
+		{"minimum over the limit", wat(`(module (memory (export "memory") 8))`), 4 * wasmPageSize, 0, true},
+		{"limit under a page", wat(`(module (memory (export "memory") 0))`), wasmPageSize - 1, 0, true},
+		{"malformed LEB", []byte("\x00asm\x01\x00\x00\x00\x05\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff"), 4 * wasmPageSize, 0, true},
+		{"truncated section", []byte("\x00asm\x01\x00\x00\x00\x05\x10\x01"), 4 * wasmPageSize, 0, true},
+		{"truncated header", []byte("\x00asm"), 4 * wasmPageSize, 0, true},
+	}
+
+	for _, c := range cases {
+		out, err := limitMemory(c.wasm, c.limit, discard)
+		if c.fails {
+			if err == nil {
+				t.Logf("%s: expected an error", c.name)
+				t.Fail()
+			}
+			continue
+		} else if err != nil {
+			t.Logf("%s: expected no error, got %s", c.name, err.Error())
+			t.Fail()
+			continue
+		}
+
+		if max, err := memoryMax(out); err != nil || max != c.expected {
+			t.Logf("%s: expected a maximum of %d pages, got %d (%v)", c.name, c.expected, max, err)
+			t.Fail()
+		}
+	}
+
+	// Modules without any memory of their own are left as they are, and those which grow a memory
+	// they import can't be hooked, which is logged
+	unchanged := []struct {
+		wat    string
+		logged bool
+	}{
+		{`(module)`, false},
+		{`(module (import "env" "memory" (memory 1)) (func (drop (memory.grow (i32.const 1)))))`, true},
+	}
+	for _, c := range unchanged {
+		var logs bytes.Buffer
+		b := wat(c.wat)
+		if out, err := limitMemory(b, 4*wasmPageSize, log.New(&logs, "", 0)); err != nil || string(out) != string(b) {
+			t.Logf("%s: expected the module to be unchanged, got %v", c.wat, err)
+			t.Fail()
+		}
+		if logged := strings.Contains(logs.String(), "memory.grow"); logged != c.logged {
+			t.Logf("%s: expected logging that hooking was skipped to be %t, got %q", c.wat, c.logged, logs.String())
+			t.Fail()
+		}
+	}
+}
+
+func TestHookMemoryGrow(t *testing.T) {
+	t.Parallel()
+
+	// The instructions around memory.grow make sure the ones with immediates are skipped over
+	// correctly, and the global and export make sure the hook's are added after them
+	b, err := wasmtime.Wat2Wasm(`(module
+		(import "env" "f" (func $f))
+		(memory (export "memory") 1)
+		(global $g (mut i64) (i64.const 0))
+		(func (export "grow") (param $pages i32) (result i32)
+			(block $out
+				(br_table $out $out (i32.const 0)))
+			(global.set $g (i64.const 1234567890123))
+			(drop (f64.const 1.5))
+			(memory.fill (i32.const 0) (i32.const 0) (i32.const 0))
+			(i32.store offset=4 (i32.const 0) (i32.const 1))
+			(memory.grow (local.get $pages))))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = limitMemory(b, 2*wasmPageSize, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := wasmtime.NewStore(wasmtime.NewEngine())
+	module, err := wasmtime.NewModule(store.Engine, b)
+	if err != nil {
+		t.Fatalf("expected the hooked module to compile, got %s", err.Error())
+	}
+
+	f := wasmtime.NewFunc(store, wasmtime.NewFuncType(nil, nil), func(*wasmtime.Caller, []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+		return nil, nil
+	})
+	instance, err := wasmtime.NewInstance(store, module, []wasmtime.AsExtern{f})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grow := instance.GetExport(store, "grow").Func()
+	failed := instance.GetExport(store, growFailedExport).Global()
+
+	steps := []struct {
+		pages    int32
+		expected int32
+		failed   int32
+	}{
+		{0, 1, 0},
+		{1, 1, 0},
+		{1, -1, 1},
+	}
+
+	for _, step := range steps {
+		actual, err := grow.Call(store, step.pages)
+		if err != nil || actual.(int32) != step.expected {
+			t.Logf("growing by %d: expected %d, got %v (%v)", step.pages, step.expected, actual, err)
+			t.Fail()
+		}
+
+		if flag := failed.Get(store).I32(); flag != step.failed {
+			t.Logf("growing by %d: expected the flag to be %d, got %d", step.pages, step.failed, flag)
+			t.Fail()
+		}
+	}
+}
+
+// randomGrowModule returns a module whose exported "run" function, and the function it calls, are a
+// random mix of instructions with and without immediates, including memory.grow. It may import a
+// function from "env". Once that's done,
+// "run" grows its memory by two pages, which always fails with a limit of two pages.
+func randomGrowModule(rng *rand.Rand) string {
+	snippets := []func() string{
+		func() string { return fmt.Sprintf("(drop (memory.grow (i32.const %d)))", rng.Intn(2)) },
+		func() string { return "(drop (memory.size))" },
+		func() string { return fmt.Sprintf("(drop (i32.const %d))", rng.Int31()-rng.Int31()) },
+		func() string { return fmt.Sprintf("(drop (i64.const %d))", rng.Int63()-rng.Int63()) },
+		func() string { return fmt.Sprintf("(drop (f32.const %g))", rng.Float32()) },
+		func() string { return fmt.Sprintf("(drop (f64.const %g))", rng.NormFloat64()) },
+		func() string { return fmt.Sprintf("(i32.store offset=%d (i32.const 0) (i32.const 1))", rng.Intn(1000)) },
+		func() string { return fmt.Sprintf("(drop (i64.load offset=%d align=4 (i32.const 0)))", rng.Intn(1000)) },
+		func() string { return fmt.Sprintf("(global.set $g (i64.const %d))", rng.Int63()) },
+		func() string { return fmt.Sprintf("(local.set $l (i32.const %d))", rng.Intn(100)) },
+		func() string { return fmt.Sprintf("(block $b (br_table $b $b $b (i32.const %d)))", rng.Intn(4)) },
+		func() string { return "(if (local.get $l) (then (drop (memory.grow (i32.const 0)))) (else nop))" },
+		func() string { return "(memory.fill (i32.const 0) (i32.const 0) (i32.const 8))" },
+		func() string { return "(memory.copy (i32.const 8) (i32.const 0) (i32.const 8))" },
+		func() string { return "(drop (i32.trunc_sat_f32_s (f32.const 1.5)))" },
+		func() string { return "(drop (call_indirect (type $t) (i32.const 0)))" },
+		func() string { return "(call $other)" },
+	}
+	body := func(n int, skip int) string {
+		var b strings.Builder
+		for j := 0; j < n; j++ {
+			k := rng.Intn(len(snippets))
+			if k == skip {
+				k = 0
+			}
+			b.WriteString(snippets[k]() + "\n")
+		}
+		return b.String()
+	}
+
+	// Modules with and without imports number their functions differently
+	imports := ""
+	if rng.Intn(2) == 0 {
+		imports = `(import "env" "f" (func $f))`
+	}
+
+	other := len(snippets) - 1
+	return `(module
+		(type $t (func (result i32)))
+		` + imports + `
+		(memory (export "memory") 1)
+		(global $g (mut i64) (i64.const 0))
+		(table 1 funcref)
+		(elem (i32.const 0) $size)
+		(func $size (type $t) (memory.size))
+		(func $other (local $l i32)
+			` + body(rng.Intn(20), other) + `)
+		(func (export "run") (result i32) (local $l i32)
+			` + body(rng.Intn(40), -1) + `
+			(memory.grow (i32.const 2))))`
+}
+
+func TestHookMemoryGrowRandom(t *testing.T) {
+	t.Parallel()
+
+	engine := wasmtime.NewEngine()
+	rng := rand.New(rand.NewSource(1))
+
+	for n := 0; n < 200; n++ {
+		src := randomGrowModule(rng)
+		b, err := wasmtime.Wat2Wasm(src)
+		if err != nil {
+			t.Fatalf("expected the random module to be valid, got %s:\n%s", err.Error(), src)
+		}
+
+		hooked, err := limitMemory(b, 2*wasmPageSize, discard)
+		if err != nil {
+			t.Fatalf("expected the module to be hooked, got %s:\n%s", err.Error(), src)
+		}
+
+		store := wasmtime.NewStore(engine)
+		module, err := wasmtime.NewModule(engine, hooked)
+		if err != nil {
+			t.Fatalf("expected the hooked module to compile, got %s:\n%s", err.Error(), src)
+		}
+
+		var imports []wasmtime.AsExtern
+		if len(module.Type().Imports()) > 0 {
+			imports = append(imports, wasmtime.NewFunc(store, wasmtime.NewFuncType(nil, nil), func(*wasmtime.Caller, []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+				return nil, nil
+			}))
+		}
+		instance, err := wasmtime.NewInstance(store, module, imports)
+		if err != nil {
+			t.Fatalf("expected the hooked module to instantiate, got %s:\n%s", err.Error(), src)
+		}
+
+		flag := instance.GetExport(store, growFailedExport)
+		if flag == nil {
+			t.Fatalf("expected the hooked module to export the flag:\n%s", src)
+		}
+
+		result, err := instance.GetExport(store, "run").Func().Call(store)
+		failed := flag.Global().Get(store).I32()
+		if err != nil || result.(int32) != -1 || failed != 1 {
+			t.Logf("expected the last grow to fail and be flagged, got %v, %d (%v):\n%s", result, failed, err, src)
+			t.Fail()
+		}
+	}
+}
+
+func TestLimitMemoryCorrupted(t *testing.T) {
+	t.Parallel()
+
+	engine := wasmtime.NewEngine()
+	rng := rand.New(rand.NewSource(2))
+
+	// Whatever limitMemory makes of a corrupted module, it mustn't panic, and if wasmtime accepts
+	// the module then it has to accept the hooked one too
+	for n := 0; n < 500; n++ {
+		b, err := wasmtime.Wat2Wasm(randomGrowModule(rng))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for flips := rng.Intn(3) + 1; flips > 0; flips-- {
+			b[8+rng.Intn(len(b)-8)] ^= byte(1 << uint(rng.Intn(8)))
+		}
+
+		if _, err := wasmtime.NewModule(engine, b); err != nil {
+			continue
+		}
+
+		hooked, err := limitMemory(b, 2*wasmPageSize, discard)
+		if err != nil {
+			continue
+		}
+		if _, err := wasmtime.NewModule(engine, hooked); err != nil {
+			t.Logf("expected the hooked module to compile, got %s for % x", err.Error(), b)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package fastlike_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Khan/fastlike"
+)
+
+// growWat grows its memory one page at a time until it can't, and then fails
+var growWat = guest("", `
+	(func (export "_start")
+		(loop $grow
+			(br_if $grow (i32.ne (memory.grow (i32.const 1)) (i32.const -1))))
+		(unreachable))`)
+
+// fullWat grows its memory right up to 1MiB, and then fails for some other reason
+var fullWat = guest("", `
+	(func (export "_start")
+		(drop (memory.grow (i32.const 15)))
+		(unreachable))`)
+
+func TestMemoryLimit(t *testing.T) {
+	t.Parallel()
+
+	f := newGuest(t, growWat, fastlike.WithMemoryLimit(1024*1024))
+
+	i := f.Instantiate()
+	w := serve(i)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "out of memory") {
+		t.Logf("expected an out of memory response, got %d: %s", w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	if i.MemorySize() != 1024*1024 {
+		t.Logf("expected memory to stop growing at 1MiB, got %d bytes", i.MemorySize())
+		t.Fail()
+	}
+
+	// Only a failure to grow memory counts as running out of it, however close to the limit the
+	// guest was when it failed
+	w = serve(newGuest(t, fullWat, fastlike.WithMemoryLimit(1024*1024)))
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "out of memory") {
+		t.Logf("expected a plain error response, got %d: %s", w.Code, w.Body.String())
+		t.Fail()
+	}
+}
@@ -0,0 +1,273 @@
+package fastlike
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+// mmdbMetadataMarker comes right before the metadata at the end of a MaxMind DB file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbReader looks up records in a MaxMind DB file, as described by
+// https://maxmind.github.io/MaxMind-DB/
+type mmdbReader struct {
+	tree       []byte
+	data       mmdbDecoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+
+	// ipv4Start is the node to start from when looking up IPv4 addresses in an IPv6 database, which
+	// keeps them under ::/96
+	ipv4Start uint
+}
+
+// openMMDB parses the contents of a MaxMind DB file
+func openMMDB(buf []byte) (*mmdbReader, error) {
+	start := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if start < 0 {
+		return nil, errors.New("mmdb: metadata not found")
+	}
+
+	meta := mmdbDecoder{buf[start+len(mmdbMetadataMarker):]}
+	v, _, err := meta.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: invalid metadata, %s", err.Error())
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("mmdb: invalid metadata")
+	}
+
+	r := &mmdbReader{
+		nodeCount:  mmdbUint(m["node_count"]),
+		recordSize: mmdbUint(m["record_size"]),
+		ipVersion:  mmdbUint(m["ip_version"]),
+	}
+
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", r.recordSize)
+	}
+
+	// The search tree is followed by 16 zero bytes, and then the data section
+	treeSize := int(r.nodeCount * r.recordSize / 4)
+	if treeSize+16 > start {
+		return nil, errors.New("mmdb: search tree is truncated")
+	}
+
+	r.tree = buf[:treeSize]
+	r.data = mmdbDecoder{buf[treeSize+16 : start]}
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for j := 0; j < 96 && node < r.nodeCount; j++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node in the search tree
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	b := r.tree[node*r.recordSize/4:]
+
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]>>4)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the record for ip, or nil if there isn't one
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	addr := ip.To4()
+	if addr != nil && r.ipVersion == 6 {
+		node = r.ipv4Start
+	} else if addr == nil {
+		if r.ipVersion == 4 {
+			return nil, nil
+		}
+		addr = ip.To16()
+	}
+
+	for j := 0; j < len(addr)*8 && node < r.nodeCount; j++ {
+		bit := uint(addr[j/8]>>(7-uint(j%8))) & 1
+		node = r.record(node, bit)
+	}
+
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+
+	v, _, err := r.data.decode(int(node - r.nodeCount - 16))
+	return v, err
+}
+
+// mmdbDecoder decodes values from the data section (or metadata) of a MaxMind DB file
+type mmdbDecoder struct {
+	buf []byte
+}
+
+var errMMDBTruncated = errors.New("mmdb: data is truncated")
+
+// decode returns the value at offset, along with the offset following it
+func (d mmdbDecoder) decode(offset int) (interface{}, int, error) {
+	if offset < 0 || offset >= len(d.buf) {
+		return nil, 0, errMMDBTruncated
+	}
+
+	ctrl := d.buf[offset]
+	offset++
+
+	kind := int(ctrl >> 5)
+	if kind == 1 {
+		// Pointers refer to a value elsewhere in the data section
+		ss := int(ctrl>>3) & 3
+		if offset+ss+1 > len(d.buf) {
+			return nil, 0, errMMDBTruncated
+		}
+
+		b := d.buf[offset : offset+ss+1]
+		var p int
+		switch ss {
+		case 0:
+			p = int(ctrl&7)<<8 | int(b[0])
+		case 1:
+			p = (int(ctrl&7)<<16 | int(b[0])<<8 | int(b[1])) + 2048
+		case 2:
+			p = (int(ctrl&7)<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])) + 526336
+		case 3:
+			p = int(binary.BigEndian.Uint32(b))
+		}
+
+		// Pointers to pointers aren't allowed, which also stops a pointer from referring to itself
+		if p < len(d.buf) && d.buf[p]>>5 == 1 {
+			return nil, 0, errors.New("mmdb: pointer to a pointer")
+		}
+
+		v, _, err := d.decode(p)
+		return v, offset + ss + 1, err
+	}
+
+	if kind == 0 {
+		if offset >= len(d.buf) {
+			return nil, 0, errMMDBTruncated
+		}
+		kind = 7 + int(d.buf[offset])
+		offset++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(d.buf) {
+			return nil, 0, errMMDBTruncated
+		}
+
+		b := d.buf[offset : offset+n]
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + int(b[0])
+		case 2:
+			size = 285 + (int(b[0])<<8 | int(b[1]))
+		case 3:
+			size = 65821 + (int(b[0])<<16 | int(b[1])<<8 | int(b[2]))
+		}
+	}
+
+	switch kind {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for j := 0; j < size; j++ {
+			k, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			v, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			key, _ := k.(string)
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for j := 0; j < size; j++ {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+
+	case 14: // boolean, whose value is its size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > len(d.buf) {
+		return nil, 0, errMMDBTruncated
+	}
+	b := d.buf[offset : offset+size]
+	offset += size
+
+	switch kind {
+	case 2: // string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("mmdb: invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4: // bytes
+		return append([]byte{}, b...), offset, nil
+	case 5, 6, 9, 10: // unsigned integers. Anything over 64 bits is truncated.
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case 8: // int32
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("mmdb: invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	}
+
+	return nil, 0, fmt.Errorf("mmdb: unsupported data type %d", kind)
+}
+
+// mmdbUint returns a decoded unsigned integer, or 0 if the value isn't one
+func mmdbUint(v interface{}) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
@@ -10,11 +10,36 @@ import (
 // Option is a functional option applied to an Instance at creation time
 type Option func(*Instance)
 
+// WithACL registers an ACL, which guests can match addresses against with the fastly_acl hostcalls.
+// Each address matches the entry with the longest prefix containing it. Use ReadACL to read entries
+// from a file.
+func WithACL(name string, entries []ACLEntry) Option {
+	return func(i *Instance) {
+		i.addACL(name, entries)
+	}
+}
+
 // WithBackend registers an `http.Handler` identified by `name` used for subrequests targeting that
 // backend
 func WithBackend(name string, h http.Handler) Option {
 	return func(i *Instance) {
-		i.addBackend(name, h)
+		i.addBackend(Backend{Name: name, Handler: h})
+	}
+}
+
+// WithBackendConfig registers a backend along with the details guests see when they inspect it, such
+// as its target and health
+func WithBackendConfig(b Backend) Option {
+	return func(i *Instance) {
+		i.addBackend(b)
+	}
+}
+
+// WithCache puts an HTTP cache in front of the backends. Pass the same Cache to every instance that
+// should share it.
+func WithCache(c *Cache) Option {
+	return func(i *Instance) {
+		i.cache = c
 	}
 }
 
@@ -25,6 +50,15 @@ func WithDefaultBackend(fn func(name string) http.Handler) Option {
 	}
 }
 
+// WithExecutionLimits bounds how long the guest may run for each request, independently of the
+// downstream request's context. Guests which exceed the wall-clock limit are interrupted with a 504,
+// and guests which exceed the active time limit are interrupted with a 503.
+func WithExecutionLimits(limits ExecutionLimits) Option {
+	return func(i *Instance) {
+		i.limits = limits
+	}
+}
+
 // WithGeo replaces the default geographic lookup function
 func WithGeo(fn func(net.IP) Geo) Option {
 	return func(i *Instance) {
@@ -32,6 +66,14 @@ func WithGeo(fn func(net.IP) Geo) Option {
 	}
 }
 
+// WithKVStore registers a KV store, available to the guest by name with the fastly_kv_store and
+// fastly_object_store hostcalls. NewMemoryKVStore and NewDirKVStore return ready-made stores.
+func WithKVStore(name string, store KVStore) Option {
+	return func(i *Instance) {
+		i.addKVStore(name, store)
+	}
+}
+
 // WithLogger registers a new log endpoint usable from a wasm guest
 func WithLogger(name string, w io.Writer) Option {
 	return func(i *Instance) {
@@ -48,13 +90,90 @@ func WithDefaultLogger(fn func(name string) io.Writer) Option {
 	}
 }
 
-// WithDictionary registers a new dictionary with a corresponding lookup function
+// WithDeviceDetection replaces the default device detection lookup function, which has no data for
+// any user agent
+func WithDeviceDetection(fn DeviceLookupFunc) Option {
+	return func(i *Instance) {
+		i.deviceLookup = fn
+	}
+}
+
+// WithDynamicBackends allows or denies the guest registering backends while it's running. They're
+// denied by default, as they are on Fastly until they're enabled for a service.
+func WithDynamicBackends(allow bool) Option {
+	return func(i *Instance) {
+		i.dynamicBackendsAllowed = allow
+	}
+}
+
+// WithDynamicBackendPolicy is called with each dynamic backend the guest registers, and can veto it
+// (based on its target, for instance) by returning an error. It has no effect unless dynamic
+// backends are allowed with WithDynamicBackends.
+func WithDynamicBackendPolicy(fn DynamicBackendPolicy) Option {
+	return func(i *Instance) {
+		i.dynamicBackendPolicy = fn
+	}
+}
+
+// WithDictionary registers a new dictionary with a corresponding lookup function. Guests can read it
+// with either the fastly_dictionary or fastly_config_store hostcalls.
+// Every key is reported to the guest as found, with missing keys being empty. Use
+// WithDictionaryLookup to tell the two apart.
 func WithDictionary(name string, fn LookupFunc) Option {
+	return WithDictionaryLookup(name, fn.toDictionaryLookupFunc())
+}
+
+// WithDictionaryLookup registers a new dictionary with a lookup function which reports whether each
+// key exists
+func WithDictionaryLookup(name string, fn DictionaryLookupFunc) Option {
 	return func(i *Instance) {
 		i.addDictionary(name, fn)
 	}
 }
 
+// WithConfigStore registers a new config store with a corresponding lookup function. Config stores
+// are what dictionaries are now called, so this is the same as WithDictionary.
+func WithConfigStore(name string, fn LookupFunc) Option {
+	return WithDictionary(name, fn)
+}
+
+// WithMaxRequestBodySize limits the size of downstream request bodies. Requests which declare a
+// larger Content-Length are rejected with a 413 before reaching the guest, and requests of unknown
+// length fail with a 413 as soon as the guest reads past the limit.
+// A size of 0 (the default) means there is no limit.
+func WithMaxRequestBodySize(size int64) Option {
+	return func(i *Instance) {
+		i.maxBodySize = size
+	}
+}
+
+// WithMemoryLimit limits how large, in bytes, the guest's linear memory may grow. Once it's reached,
+// `memory.grow` fails inside the guest, and a guest which then fails is reported as having run out of
+// memory with a 500. A limit of 0 means there is no limit. The default is DefaultMemoryLimit.
+// The limit is applied when the program is compiled, so it has no effect when passed to
+// Fastlike.Instantiate.
+func WithMemoryLimit(limit int64) Option {
+	return func(i *Instance) {
+		i.memoryLimit = limit
+	}
+}
+
+// WithRateLimiter replaces the rate limiter used by the fastly_erl hostcalls. Pass the same
+// RateLimiter to every instance that should share it, or create one with a fake clock for tests.
+func WithRateLimiter(r *RateLimiter) Option {
+	return func(i *Instance) {
+		i.rateLimiter = r
+	}
+}
+
+// WithSecretStore registers a new secret store with a corresponding lookup function. Guests read
+// secrets from it with the fastly_secret_store hostcalls.
+func WithSecretStore(name string, fn SecretLookupFunc) Option {
+	return func(i *Instance) {
+		i.addSecretStore(name, fn)
+	}
+}
+
 // WithSecureFunc is an Option that determines if a request should be considered "secure" or not.
 // If it returns true, the request url has the "https" scheme and the "fastly-ssl" header set when
 // going into the wasm program.
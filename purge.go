@@ -0,0 +1,107 @@
+package fastlike
+
+import (
+	"net/url"
+)
+
+// PurgeSurrogateKey removes every response tagged with the surrogate key from the cache, and returns
+// how many were purged. A soft purge marks the responses as stale instead, so they can still be used
+// while they're revalidated if they have a stale-while-revalidate period.
+func (c *Cache) PurgeSurrogateKey(key string, soft bool) int {
+	return c.purge(soft, func(resp *CachedResponse) bool {
+		for _, k := range resp.SurrogateKeys {
+			if k == key {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// PurgeURL removes the response for the URL from the cache, and returns how many were purged.
+// The scheme is ignored, so purging "http://example.com/" also purges "https://example.com/".
+// A soft purge marks the response as stale instead.
+func (c *Cache) PurgeURL(u string, soft bool) int {
+	target := purgeTarget(u)
+	return c.purge(soft, func(resp *CachedResponse) bool {
+		return purgeTarget(resp.URL) == target
+	})
+}
+
+// PurgeAll removes everything from the cache, and returns how many responses were purged. A soft
+// purge marks everything as stale instead.
+func (c *Cache) PurgeAll(soft bool) int {
+	return c.purge(soft, func(_ *CachedResponse) bool {
+		return true
+	})
+}
+
+// purge removes (or marks stale) every response for which match returns true
+func (c *Cache) purge(soft bool, match func(*CachedResponse) bool) int {
+	now := c.now()
+	purged := 0
+
+	c.store.Range(func(key string, resp *CachedResponse) bool {
+		if !match(resp) {
+			return true
+		}
+		purged++
+
+		if !soft {
+			c.store.Delete(key)
+			return true
+		}
+
+		// Expire the response right away. Its stale-while-revalidate period starts now, rather than
+		// once it would have expired.
+		if resp.Fresh(now) {
+			stale := *resp
+			stale.TTL = stale.Age(now)
+			c.store.Set(key, &stale)
+		}
+		return true
+	})
+
+	return purged
+}
+
+// purgeTarget returns the part of a URL which identifies it for purging
+func purgeTarget(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return parsed.Host + parsed.RequestURI()
+}
+
+// PurgeSurrogateKey purges responses tagged with the surrogate key from the Fastlike's cache, if
+// it has one, along with any objects guests have tagged with it in the core cache. See
+// Cache.PurgeSurrogateKey.
+func (f *Fastlike) PurgeSurrogateKey(key string, soft bool) int {
+	purged := f.coreCache.purgeSurrogateKey(key, soft)
+	if f.cache != nil {
+		purged += f.cache.PurgeSurrogateKey(key, soft)
+	}
+	return purged
+}
+
+// PurgeURL purges the response for the URL from the Fastlike's cache, if it has one. See
+// Cache.PurgeURL.
+func (f *Fastlike) PurgeURL(u string, soft bool) int {
+	if f.cache == nil {
+		return 0
+	}
+	return f.cache.PurgeURL(u, soft)
+}
+
+// PurgeAll purges everything from the Fastlike's cache, if it has one, and from the core cache. See
+// Cache.PurgeAll.
+func (f *Fastlike) PurgeAll(soft bool) int {
+	purged := f.coreCache.purge(soft, func(_ *cacheObject) bool {
+		return true
+	})
+	if f.cache != nil {
+		purged += f.cache.PurgeAll(soft)
+	}
+	return purged
+}
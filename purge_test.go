@@ -0,0 +1,60 @@
+package fastlike_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Khan/fastlike"
+)
+
+// purgeWat purges the "k1" surrogate key
+var purgeWat = guest(`(import "fastly_purge" "purge_surrogate_key" (func $purge (param i32 i32 i32 i32) (result i32)))`, `
+	(data (i32.const 1024) "k1")
+	(func (export "_start")
+		(drop (call $purge (i32.const 1024) (i32.const 2) (i32.const 0) (i32.const 0))))`)
+
+func TestPurge(t *testing.T) {
+	t.Parallel()
+
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Surrogate-Key", "k1 k2")
+		w.Write([]byte("from origin"))
+	})
+
+	cache := fastlike.NewCache(nil)
+	f := newGuest(t, cachingProxy(0, 0, 0), fastlike.WithBackend("origin", origin), fastlike.WithCache(cache))
+	purger := newGuest(t, purgeWat, fastlike.WithCache(cache))
+
+	get := func(f *fastlike.Fastlike) string {
+		return serve(f).Header().Get("X-Cache")
+	}
+
+	steps := []struct {
+		name     string
+		purge    func() int
+		purged   int
+		expected []string
+	}{
+		{"warm", func() int { return 0 }, 0, []string{"MISS", "HIT"}},
+		{"url", func() int { return f.PurgeURL("https://origin/", false) }, 1, []string{"MISS", "HIT"}},
+		{"surrogate-key", func() int { return f.PurgeSurrogateKey("k2", false) }, 1, []string{"MISS", "HIT"}},
+		{"other-surrogate-key", func() int { return f.PurgeSurrogateKey("k3", false) }, 0, []string{"HIT"}},
+		{"soft", func() int { return f.PurgeAll(true) }, 1, []string{"MISS", "HIT"}},
+		{"hostcall", func() int { get(purger); return 0 }, 0, []string{"MISS", "HIT"}},
+	}
+
+	for _, step := range steps {
+		if purged := step.purge(); purged != step.purged {
+			t.Logf("%s: expected %d responses purged, got %d", step.name, step.purged, purged)
+			t.Fail()
+		}
+
+		for _, expected := range step.expected {
+			if actual := get(f); actual != expected {
+				t.Logf("%s: expected X-Cache %s, got %s", step.name, expected, actual)
+				t.Fail()
+			}
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package fastlike
+
+import (
+	"sync"
+	"time"
+)
+
+// rateCounterBuckets is how many one-second buckets each rate counter entry keeps, which is the
+// longest window or duration the guest can ask about
+const rateCounterBuckets = 60
+
+// RateLimiter holds the rate counters and penalty boxes used by the fastly_erl hostcalls. Fastlike
+// shares one between its instances, the way they'd be shared on a Fastly POP. Pass your own with
+// WithRateLimiter to control the clock it uses, or to share it between Fastlikes.
+type RateLimiter struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	counters map[string]map[string]*rateCounterEntry
+	boxes    map[string]map[string]time.Time
+
+	// swept is the second stale entries were last swept away
+	swept int64
+}
+
+// NewRateLimiter returns an empty RateLimiter which uses now to tell the time. A nil now uses
+// time.Now.
+func NewRateLimiter(now func() time.Time) *RateLimiter {
+	if now == nil {
+		now = time.Now
+	}
+
+	return &RateLimiter{
+		now:      now,
+		counters: map[string]map[string]*rateCounterEntry{},
+		boxes:    map[string]map[string]time.Time{},
+	}
+}
+
+// rateCounterEntry counts the hits for one entry in a rate counter, in one-second buckets
+type rateCounterEntry struct {
+	seconds [rateCounterBuckets]int64
+	counts  [rateCounterBuckets]uint32
+}
+
+// add counts delta hits at the time second
+func (e *rateCounterEntry) add(second int64, delta uint32) {
+	j := second % rateCounterBuckets
+	if e.seconds[j] != second {
+		e.seconds[j] = second
+		e.counts[j] = 0
+	}
+	e.counts[j] += delta
+}
+
+// sum returns how many hits were counted in the window of seconds up to and including second. It's
+// safe to call on a nil entry, which has no hits.
+func (e *rateCounterEntry) sum(second int64, window uint32) uint32 {
+	if e == nil {
+		return 0
+	}
+
+	var total uint32
+	for j, s := range e.seconds {
+		if s <= second && second-s < int64(window) {
+			total += e.counts[j]
+		}
+	}
+	return total
+}
+
+// clampWindow limits a window or duration to what a rate counter keeps track of
+func clampWindow(window uint32) uint32 {
+	if window < 1 {
+		return 1
+	} else if window > rateCounterBuckets {
+		return rateCounterBuckets
+	}
+	return window
+}
+
+// entry returns the entry in a rate counter, creating it if necessary. The caller must hold r.mu.
+func (r *RateLimiter) entry(counter, key string) *rateCounterEntry {
+	c, ok := r.counters[counter]
+	if !ok {
+		c = map[string]*rateCounterEntry{}
+		r.counters[counter] = c
+	}
+
+	e, ok := c[key]
+	if !ok {
+		e = &rateCounterEntry{}
+		c[key] = e
+	}
+	return e
+}
+
+// lookup returns the entry in a rate counter, or nil if it has never been hit. The caller must hold
+// r.mu.
+func (r *RateLimiter) lookup(counter, key string) *rateCounterEntry {
+	return r.counters[counter][key]
+}
+
+// sweep removes rate counter entries without any hits left in their buckets, and penalty box
+// entries which have expired. It does so at most once a second, as the buckets roll over. The caller
+// must hold r.mu.
+func (r *RateLimiter) sweep(now time.Time) {
+	second := now.Unix()
+	if second == r.swept {
+		return
+	}
+	r.swept = second
+
+	for name, c := range r.counters {
+		for key, e := range c {
+			if e.sum(second, rateCounterBuckets) == 0 {
+				delete(c, key)
+			}
+		}
+		if len(c) == 0 {
+			delete(r.counters, name)
+		}
+	}
+
+	for name, b := range r.boxes {
+		for key, expires := range b {
+			if !now.Before(expires) {
+				delete(b, key)
+			}
+		}
+		if len(b) == 0 {
+			delete(r.boxes, name)
+		}
+	}
+}
+
+// Increment adds delta to the entry in the rate counter
+func (r *RateLimiter) Increment(counter, key string, delta uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	r.sweep(now)
+	r.entry(counter, key).add(now.Unix(), delta)
+}
+
+// Rate returns the average number of hits per second for the entry in the rate counter over the
+// window, in seconds
+func (r *RateLimiter) Rate(counter, key string, window uint32) uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	window = clampWindow(window)
+	return r.lookup(counter, key).sum(r.now().Unix(), window) / window
+}
+
+// Count returns the number of hits for the entry in the rate counter over the duration, in seconds
+func (r *RateLimiter) Count(counter, key string, duration uint32) uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookup(counter, key).sum(r.now().Unix(), clampWindow(duration))
+}
+
+// PenaltyBoxAdd puts the entry in the penalty box for ttl
+func (r *RateLimiter) PenaltyBoxAdd(box, key string, ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweep(r.now())
+	r.penaltyBoxAdd(box, key, ttl)
+}
+
+func (r *RateLimiter) penaltyBoxAdd(box, key string, ttl time.Duration) {
+	b, ok := r.boxes[box]
+	if !ok {
+		b = map[string]time.Time{}
+		r.boxes[box] = b
+	}
+	b[key] = r.now().Add(ttl)
+}
+
+// PenaltyBoxHas returns true if the entry is in the penalty box
+func (r *RateLimiter) PenaltyBoxHas(box, key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.penaltyBoxHas(box, key)
+}
+
+func (r *RateLimiter) penaltyBoxHas(box, key string) bool {
+	expires, ok := r.boxes[box][key]
+	return ok && r.now().Before(expires)
+}
+
+// CheckRate adds delta to the entry in the rate counter, and returns true if the entry should be
+// blocked. That's the case if it's already in the penalty box, or if its rate over the window is now
+// over the limit, in which case it's also put in the penalty box for ttl.
+func (r *RateLimiter) CheckRate(counter, key string, delta, window, limit uint32, box string, ttl time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := r.now()
+	r.sweep(t)
+
+	now := t.Unix()
+	window = clampWindow(window)
+
+	e := r.entry(counter, key)
+	e.add(now, delta)
+
+	if r.penaltyBoxHas(box, key) {
+		return true
+	}
+
+	if e.sum(now, window)/window > limit {
+		r.penaltyBoxAdd(box, key, ttl)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,48 @@
+package fastlike
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterSweep(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1600000000, 0)
+	rl := NewRateLimiter(func() time.Time { return now })
+
+	// Looking things up doesn't create anything
+	rl.Rate("rc", "nobody", 10)
+	rl.Count("rc", "nobody", 10)
+	rl.PenaltyBoxHas("pb", "nobody")
+	if len(rl.counters) != 0 || len(rl.boxes) != 0 {
+		t.Logf("expected lookups to leave the rate limiter empty, got %v and %v", rl.counters, rl.boxes)
+		t.Fail()
+	}
+
+	rl.Increment("rc", "client", 1)
+	rl.PenaltyBoxAdd("pb", "client", 30*time.Second)
+
+	steps := []struct {
+		name            string
+		advance         time.Duration
+		counters, boxes int
+	}{
+		{"same second", 0, 1, 1},
+		{"penalty over", 30 * time.Second, 1, 0},
+		{"buckets rolled over", 30 * time.Second, 0, 0},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.advance)
+
+		// Sweeping happens whenever something is added
+		rl.Increment("other", "client", 0)
+		delete(rl.counters, "other")
+
+		if len(rl.counters) != step.counters || len(rl.boxes) != step.boxes {
+			t.Logf("%s: expected %d counters and %d penalty boxes, got %v and %v", step.name, step.counters, step.boxes, rl.counters, rl.boxes)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package fastlike_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Khan/fastlike"
+)
+
+// erlWat checks the rate of requests from "client", allowing 2 per second over a 1 second window
+// before putting it in the penalty box for a minute. It responds with a 429 when the client is
+// blocked.
+var erlWat = guest(`(import "fastly_erl" "check_rate" (func $check_rate (param i32 i32 i32 i32 i32 i32 i32 i32 i32 i32 i32) (result i32)))`, `
+	(data (i32.const 1024) "rc")
+	(data (i32.const 1040) "client")
+	(data (i32.const 1056) "pb")
+	(func (export "_start")
+		(drop (call $check_rate (i32.const 1024) (i32.const 2) (i32.const 1040) (i32.const 6) (i32.const 1) (i32.const 1) (i32.const 2) (i32.const 1056) (i32.const 2) (i32.const 60) (i32.const 16)))
+		(call $respond (select (i32.const 429) (i32.const 200) (i32.load (i32.const 16))) (call $body)))`)
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	var now int64 = 1600000000
+	rl := fastlike.NewRateLimiter(func() time.Time {
+		return time.Unix(atomic.LoadInt64(&now), 0)
+	})
+
+	f := newGuest(t, erlWat, fastlike.WithRateLimiter(rl))
+
+	steps := []struct {
+		name     string
+		advance  int64
+		expected []int
+	}{
+		{"under the limit", 0, []int{200, 200}},
+		{"over the limit", 0, []int{429}},
+		{"penalty box", 1, []int{429}},
+		{"penalty over", 60, []int{200, 200, 429}},
+	}
+
+	for _, step := range steps {
+		atomic.AddInt64(&now, step.advance)
+
+		for _, expected := range step.expected {
+			if w := serve(f); w.Code != expected {
+				t.Logf("%s: expected %d, got %d", step.name, expected, w.Code)
+				t.Fail()
+			}
+		}
+	}
+
+	// The requests before the penalty box expired are over a minute old
+	if count := rl.Count("rc", "client", 60); count != 3 {
+		t.Logf("expected a count of 3 over the last minute, got %d", count)
+		t.Fail()
+	}
+
+	if rate := rl.Rate("rc", "client", 10); rate != 0 {
+		t.Logf("expected a rate of 0 over the last 10 seconds, got %d", rate)
+		t.Fail()
+	}
+}
@@ -0,0 +1,31 @@
+package fastlike
+
+// SecretLookupFunc returns the secret stored under key, and whether there is one
+type SecretLookupFunc func(key string) ([]byte, bool)
+
+func (i *Instance) addSecretStore(name string, fn SecretLookupFunc) {
+	i.secretStores = append(i.secretStores, secretStore{name, fn})
+}
+
+func (i *Instance) getSecretStoreHandle(name string) int {
+	for j, s := range i.secretStores {
+		if s.name == name {
+			return j
+		}
+	}
+
+	return HandleInvalid
+}
+
+func (i *Instance) getSecretStore(handle int) SecretLookupFunc {
+	if handle < 0 || handle > len(i.secretStores)-1 {
+		return nil
+	}
+
+	return i.secretStores[handle].get
+}
+
+type secretStore struct {
+	name string
+	get  SecretLookupFunc
+}
@@ -0,0 +1,44 @@
+package fastlike_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Khan/fastlike"
+)
+
+// secretStoreWat responds with the plaintext of the "token" secret in the "secrets" store, or a 404
+// if there's no such secret. It first asks for the plaintext with a buffer that's too small, to find
+// out how big the secret is.
+var secretStoreWat = guest(`
+	(import "fastly_secret_store" "open" (func $open (param i32 i32 i32) (result i32)))
+	(import "fastly_secret_store" "get" (func $get (param i32 i32 i32 i32) (result i32)))
+	(import "fastly_secret_store" "plaintext" (func $plaintext (param i32 i32 i32 i32) (result i32)))`, `
+	(data (i32.const 1024) "secrets")
+	(data (i32.const 1040) "token")
+	(func (export "_start")
+		(drop (call $open (i32.const 1024) (i32.const 7) (i32.const 0)))
+		(if (call $get (i32.load (i32.const 0)) (i32.const 1040) (i32.const 5) (i32.const 4))
+			(then
+				(call $respond (i32.const 404) (call $body))
+				(return)))
+		(if (i32.eq (call $plaintext (i32.load (i32.const 4)) (i32.const 2048) (i32.const 1) (i32.const 16)) (i32.const 4))
+			(then
+				(drop (call $plaintext (i32.load (i32.const 4)) (i32.const 2048) (i32.load (i32.const 16)) (i32.const 16)))))
+		(call $respond_with (i32.const 200) (i32.const 2048) (i32.load (i32.const 16))))`)
+
+func TestSecretStore(t *testing.T) {
+	t.Parallel()
+
+	secrets := map[string]string{"token": "s3cr3t-t0k3n"}
+	lookup := func(key string) ([]byte, bool) {
+		v, ok := secrets[key]
+		return []byte(v), ok
+	}
+
+	// The secret is longer than the guest's first buffer, so it has to ask again with a bigger one
+	expectResponse(t, "found", newGuest(t, secretStoreWat, fastlike.WithSecretStore("secrets", lookup)), http.StatusOK, secrets["token"])
+
+	// A store registered under another name can't be opened, let alone have the secret read from it
+	expectResponse(t, "missing store", newGuest(t, secretStoreWat, fastlike.WithSecretStore("other", lookup)), http.StatusNotFound, "")
+}
@@ -10,8 +10,27 @@ const BACKEND: &str = "backend";
 // The example server will send any requests for this backend to httpbin.org
 const HTTPBIN: &str = "httpbin";
 
-#[fastly::main]
-fn main(mut req: Request) -> Result<Response, Error> {
+fn main() -> Result<(), Error> {
+    let req = Request::from_client();
+
+    // Streaming responses are sent downstream as they're written, so they can't go through the
+    // usual request -> response handler
+    if req.get_path() == "/stream" {
+        use std::io::Write;
+        let mut stream = Response::from_status(StatusCode::OK).stream_to_client();
+        for n in 1..=3 {
+            writeln!(stream, "chunk {}", n)?;
+            stream.flush()?;
+        }
+        stream.finish()?;
+        return Ok(());
+    }
+
+    handle(req)?.send_to_client();
+    Ok(())
+}
+
+fn handle(mut req: Request) -> Result<Response, Error> {
     if req.get_header("httpbin-proxy").is_some() {
         return Ok(req.send(HTTPBIN)?);
     }
@@ -60,6 +79,24 @@ fn main(mut req: Request) -> Result<Response, Error> {
 
         (&Method::GET, path) if path.starts_with("/proxy") => Ok(req.send(BACKEND)?),
 
+        (&Method::POST, "/echo") => Ok(Response::from_body(req.into_body())),
+
+        (&Method::GET, "/async") => {
+            // Fan out to the backend twice, and respond with the bodies in the order select
+            // returned them
+            use fastly::http::request::select;
+            let pending = vec![
+                Request::get("http://localhost/async/a").send_async(BACKEND)?,
+                Request::get("http://localhost/async/b").send_async(BACKEND)?,
+            ];
+            let (first, rest) = select(pending);
+            let mut bodies = vec![first?.into_body_str()];
+            for p in rest {
+                bodies.push(p.wait()?.into_body_str());
+            }
+            Ok(Response::from_status(StatusCode::OK).with_body(bodies.join("\n")))
+        }
+
         (&Method::GET, "/panic!") => {
             panic!("you told me to");
         }
@@ -1,5 +1,18 @@
 package fastlike
 
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
 // UserAgent represents a user agent.
 type UserAgent struct {
 	Family string
@@ -9,3 +22,238 @@ type UserAgent struct {
 }
 
 type UserAgentParser func(uastring string) UserAgent
+
+//go:embed useragent.yaml
+var defaultUserAgentRegexes []byte
+
+var (
+	defaultUserAgentParser     UserAgentParser
+	defaultUserAgentParserOnce sync.Once
+)
+
+// DefaultUserAgentParser returns a UserAgentParser for the most common browsers, tools, and crawlers.
+// It's meant for trying things out locally. For anything more, use NewUserAgentParser with the full
+// regexes.yaml from uap-core.
+func DefaultUserAgentParser() UserAgentParser {
+	defaultUserAgentParserOnce.Do(func() {
+		fn, err := NewUserAgentParserFromReader(bytes.NewReader(defaultUserAgentRegexes))
+		if err != nil {
+			panic(err)
+		}
+		defaultUserAgentParser = fn
+	})
+	return defaultUserAgentParser
+}
+
+// NewUserAgentParser returns a UserAgentParser which uses the user agent parsers in a file in the
+// format of uap-core's regexes.yaml (https://github.com/ua-parser/uap-core). Anything else in the
+// file, such as the OS and device parsers, is ignored, as are regexes Go can't compile.
+func NewUserAgentParser(path string) (UserAgentParser, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return NewUserAgentParserFromReader(fd)
+}
+
+// NewUserAgentParserFromReader is like NewUserAgentParser, but reads the regexes from r
+func NewUserAgentParserFromReader(r io.Reader) (UserAgentParser, error) {
+	parsers, err := readUserAgentParsers(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(uastring string) UserAgent {
+		for _, p := range parsers {
+			if ua, ok := p.parse(uastring); ok {
+				return ua
+			}
+		}
+		return UserAgent{Family: "Other"}
+	}, nil
+}
+
+// uaParser is one of the user agent parsers from a regexes.yaml file
+type uaParser struct {
+	regex *regexp.Regexp
+
+	// replacements are used instead of the regex's groups for the family, major, minor, and patch, and
+	// may refer to the groups themselves as $1, $2, and so on
+	replacements [4]string
+}
+
+// parse returns the user agent, if the parser's regex matches it
+func (p *uaParser) parse(uastring string) (UserAgent, bool) {
+	m := p.regex.FindStringSubmatchIndex(uastring)
+	if m == nil {
+		return UserAgent{}, false
+	}
+
+	var parts [4]string
+	for j := range parts {
+		if p.replacements[j] != "" {
+			parts[j] = strings.TrimSpace(string(p.regex.ExpandString(nil, p.replacements[j], uastring, m)))
+		} else if 2*(j+1) < len(m) && m[2*(j+1)] >= 0 {
+			parts[j] = uastring[m[2*(j+1)]:m[2*(j+1)+1]]
+		}
+	}
+
+	return UserAgent{Family: parts[0], Major: parts[1], Minor: parts[2], Patch: parts[3]}, true
+}
+
+// uaReplacementKeys are the keys for each of a uaParser's replacements
+var uaReplacementKeys = map[string]int{
+	"family_replacement": 0,
+	"v1_replacement":     1,
+	"v2_replacement":     2,
+	"v3_replacement":     3,
+}
+
+// uaGroupReference matches references to regex groups in replacements. They're written as $1, which
+// regexp would read as a group named "1abc" if followed by letters.
+var uaGroupReference = regexp.MustCompile(`\$(\d)`)
+
+// readUserAgentParsers reads the user_agent_parsers list from a regexes.yaml file. Rather than
+// bringing in a YAML library, this understands just enough YAML for the way those files are written:
+// a top-level mapping of lists, where each item is a mapping of scalars.
+func readUserAgentParsers(r io.Reader) ([]*uaParser, error) {
+	parsers := []*uaParser{}
+	var current map[string]string
+	section := ""
+	line := 0
+
+	finish := func() {
+		if current == nil {
+			return
+		}
+
+		expr := current["regex"]
+		if strings.Contains(current["regex_flag"], "i") {
+			expr = "(?i)" + expr
+		}
+
+		// A few regexes in uap-core use syntax that Go doesn't support, and are skipped
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			current = nil
+			return
+		}
+
+		p := &uaParser{regex: re}
+		for key, j := range uaReplacementKeys {
+			p.replacements[j] = uaGroupReference.ReplaceAllString(current[key], "$${$1}")
+		}
+
+		parsers = append(parsers, p)
+		current = nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		// Unindented lines start a new section
+		if text[0] != ' ' && text[0] != '-' {
+			finish()
+			section = strings.TrimSuffix(trimmed, ":")
+			continue
+		}
+
+		if section != "user_agent_parsers" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "- ") {
+			finish()
+			current = map[string]string{}
+			trimmed = strings.TrimSpace(trimmed[2:])
+		}
+
+		if current == nil {
+			return nil, fmt.Errorf("uap: unexpected %q on line %d", trimmed, line)
+		}
+
+		colon := strings.Index(trimmed, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("uap: expected a key and value on line %d", line)
+		}
+
+		value, err := yamlScalar(strings.TrimSpace(trimmed[colon+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("uap: %s on line %d", err.Error(), line)
+		}
+		current[strings.TrimSpace(trimmed[:colon])] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	finish()
+
+	return parsers, nil
+}
+
+// yamlScalar returns the value of a single-quoted, double-quoted, or plain YAML scalar
+func yamlScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "'"):
+		end := strings.LastIndex(s, "'")
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		return strings.ReplaceAll(s[1:end], "''", "'"), nil
+
+	case strings.HasPrefix(s, `"`):
+		var b strings.Builder
+		for j := 1; j < len(s); j++ {
+			switch s[j] {
+			case '"':
+				return b.String(), nil
+			case '\\':
+				j++
+				if j == len(s) {
+					return "", fmt.Errorf("unterminated string")
+				}
+
+				switch s[j] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case 'x', 'u', 'U':
+					n := map[byte]int{'x': 2, 'u': 4, 'U': 8}[s[j]]
+					if j+n >= len(s) {
+						return "", fmt.Errorf("invalid escape")
+					}
+
+					r, err := strconv.ParseUint(s[j+1:j+1+n], 16, 32)
+					if err != nil {
+						return "", fmt.Errorf("invalid escape")
+					}
+					b.WriteRune(rune(r))
+					j += n
+				default:
+					b.WriteByte(s[j])
+				}
+			default:
+				b.WriteByte(s[j])
+			}
+		}
+		return "", fmt.Errorf("unterminated string")
+	}
+
+	// Plain scalars end at a comment
+	if j := strings.Index(s, " #"); j >= 0 {
+		s = s[:j]
+	}
+	return strings.TrimSpace(s), nil
+}
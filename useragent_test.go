@@ -0,0 +1,50 @@
+package fastlike_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Khan/fastlike"
+)
+
+func TestUserAgentParser(t *testing.T) {
+	t.Parallel()
+
+	regexes := `user_agent_parsers:
+  # a comment
+  - regex: '(Fastlike)/(\d+)\.(\d+)'
+    family_replacement: 'Fastlike $1'
+    v3_replacement: "beta"
+  - regex: "(?:NEW|new)(agent)/(\\d+)"
+    regex_flag: 'i'
+    v1_replacement: '$2.0'
+os_parsers:
+  - regex: '(Fastlike)'
+`
+
+	custom, err := fastlike.NewUserAgentParserFromReader(strings.NewReader(regexes))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err.Error())
+	}
+
+	cases := []struct {
+		parser   fastlike.UserAgentParser
+		ua       string
+		expected fastlike.UserAgent
+	}{
+		{custom, "Fastlike/1.2", fastlike.UserAgent{"Fastlike Fastlike", "1", "2", "beta"}},
+		{custom, "NewAgent/7", fastlike.UserAgent{"Agent", "7.0", "", ""}},
+		{custom, "Mozilla/5.0", fastlike.UserAgent{"Other", "", "", ""}},
+		{fastlike.DefaultUserAgentParser(), "Mozilla/5.0 (X11; Fedora; Linux x86_64; rv:76.0) Gecko/20100101 Firefox/76.1.15", fastlike.UserAgent{"Firefox", "76", "1", "15"}},
+		{fastlike.DefaultUserAgentParser(), "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36 Edg/118.0.2088.46", fastlike.UserAgent{"Edge", "118", "0", "2088"}},
+		{fastlike.DefaultUserAgentParser(), "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1", fastlike.UserAgent{"Mobile Safari", "17", "0", ""}},
+		{fastlike.DefaultUserAgentParser(), "curl/8.4.0", fastlike.UserAgent{"curl", "8", "4", "0"}},
+	}
+
+	for _, c := range cases {
+		if actual := c.parser(c.ua); actual != c.expected {
+			t.Logf("%s: expected %+v, got %+v", c.ua, c.expected, actual)
+			t.Fail()
+		}
+	}
+}
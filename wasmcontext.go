@@ -1,44 +1,92 @@
 package fastlike
 
 import (
+	"bytes"
+	"log"
+
 	"github.com/bytecodealliance/wasmtime-go"
 )
 
+// wasmContext holds everything needed to run the wasm program. The engine and module are shared
+// between instances and the linker is created once per instance, while the store is created fresh
+// for each request so that nothing accumulates in it.
 type wasmContext struct {
+	engine *wasmtime.Engine
 	store  *wasmtime.Store
 	module *wasmtime.Module
 	linker *wasmtime.Linker
 }
 
-func (i *Instance) compile(wasmbytes []byte) {
+// compile turns the wasm program into a module, along with the engine it was compiled for. Both are
+// safe to share between instances, so this only needs to happen once per program.
+// Anything that doesn't look like a binary module is parsed as WebAssembly text.
+// If memoryLimit is positive, the program's memory can't grow any larger than that many bytes.
+// Anything worth knowing about the program that isn't an error is written to logger.
+func compile(wasmbytes []byte, memoryLimit int64, logger *log.Logger) (*wasmtime.Engine, *wasmtime.Module, error) {
+	if !bytes.HasPrefix(wasmbytes, []byte("\x00asm")) {
+		var err error
+		wasmbytes, err = wasmtime.Wat2Wasm(string(wasmbytes))
+		if err != nil {
+			return nil, nil, &CompileError{err}
+		}
+	}
+
+	if memoryLimit > 0 {
+		var err error
+		wasmbytes, err = limitMemory(wasmbytes, memoryLimit, logger)
+		if err != nil {
+			return nil, nil, &CompileError{err}
+		}
+	}
+
 	config := wasmtime.NewConfig()
 
-	check(config.CacheConfigLoadDefault())
+	if err := config.CacheConfigLoadDefault(); err != nil {
+		return nil, nil, &CompileError{err}
+	}
 	config.SetInterruptable(true)
 
 	engine := wasmtime.NewEngineWithConfig(config)
-	store := wasmtime.NewStore(engine)
-	module, err := wasmtime.NewModule(store.Engine, wasmbytes)
-	check(err)
-
-	wasicfg := wasmtime.NewWasiConfig()
-	wasicfg.InheritStdout()
-	wasicfg.InheritStderr()
+	module, err := wasmtime.NewModule(engine, wasmbytes)
+	if err != nil {
+		return nil, nil, &CompileError{err}
+	}
 
-	store.SetWasi(wasicfg)
+	return engine, module, nil
+}
 
+// prepare creates the per-instance linker used to instantiate an already compiled module. The host
+// functions are defined independently of any store, so the same linker can be used for a new store
+// on each request.
+func (i *Instance) prepare(engine *wasmtime.Engine, module *wasmtime.Module) error {
 	linker := wasmtime.NewLinker(engine)
-	check(linker.DefineWasi())
+	if err := linker.DefineWasi(); err != nil {
+		return &LinkError{err}
+	}
 
-	// We use
 	i.wasmctx = &wasmContext{
-		store:  store,
+		engine: engine,
 		module: module,
 		linker: linker,
 	}
 
 	i.link(linker)
 	i.linklegacy(linker)
+
+	return nil
+}
+
+// newStore creates a store for a single request
+func (ctx *wasmContext) newStore() *wasmtime.Store {
+	store := wasmtime.NewStore(ctx.engine)
+
+	wasicfg := wasmtime.NewWasiConfig()
+	wasicfg.InheritStdout()
+	wasicfg.InheritStderr()
+
+	store.SetWasi(wasicfg)
+
+	return store
 }
 
 func (i *Instance) link(linker *wasmtime.Linker) {
@@ -46,77 +94,160 @@ func (i *Instance) link(linker *wasmtime.Linker) {
 	// TODO: All of these fastly-sys methods are stubbed. As they are
 	// implemented, they'll be removed from here and explicitly linked in the
 	// section below.
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "pending_req_poll", i.wasm4("pending_req_poll"))
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "pending_req_select", i.wasm5("pending_req_select"))
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "pending_req_wait", i.wasm3("pending_req_wait"))
-
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "downstream_tls_cipher_openssl_name", i.wasm3("downstream_tls_cipher_openssl_name"))
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "downstream_tls_protocol", i.wasm3("downstream_tls_protocol"))
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "downstream_tls_client_hello", i.wasm3("downstream_tls_client_hello"))
+	linker.FuncWrap("fastly_http_req", "downstream_tls_cipher_openssl_name", i.wasm3("downstream_tls_cipher_openssl_name"))
+	linker.FuncWrap("fastly_http_req", "downstream_tls_protocol", i.wasm3("downstream_tls_protocol"))
+	linker.FuncWrap("fastly_http_req", "downstream_tls_client_hello", i.wasm3("downstream_tls_client_hello"))
 
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "header_insert", i.wasm5("header_insert"))
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "send_async", i.wasm5("send_async"))
+	linker.FuncWrap("fastly_http_req", "header_insert", i.wasm5("header_insert"))
 
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "original_header_count", i.wasm1("original_header_count"))
+	linker.FuncWrap("fastly_http_req", "original_header_count", i.wasm1("original_header_count"))
 
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "header_append", i.wasm5("header_append"))
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "header_insert", i.wasm5("header_insert"))
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "header_value_get", i.wasm6("header_value_get"))
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "header_remove", i.wasm3("header_remove"))
+	linker.FuncWrap("fastly_http_resp", "header_append", i.wasm5("header_append"))
+	linker.FuncWrap("fastly_http_resp", "header_insert", i.wasm5("header_insert"))
+	linker.FuncWrap("fastly_http_resp", "header_value_get", i.wasm6("header_value_get"))
+	linker.FuncWrap("fastly_http_resp", "header_remove", i.wasm3("header_remove"))
 	// End fastly-sys Stubbing -}}}
 
 	// xqd.go
-	linker.DefineFunc(i.wasmctx.store, "fastly_abi", "init", i.xqd_init)
-	linker.DefineFunc(i.wasmctx.store, "fastly_uap", "parse", i.xqd_uap_parse)
+	linker.FuncWrap("fastly_abi", "init", i.xqd_init)
+	linker.FuncWrap("fastly_uap", "parse", i.xqd_uap_parse)
 
 	// xqd_request.go
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "body_downstream_get", i.xqd_req_body_downstream_get)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "downstream_client_ip_addr", i.xqd_req_downstream_client_ip_addr)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "new", i.xqd_req_new)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "version_get", i.xqd_req_version_get)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "version_set", i.xqd_req_version_set)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "method_get", i.xqd_req_method_get)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "method_set", i.xqd_req_method_set)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "uri_get", i.xqd_req_uri_get)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "uri_set", i.xqd_req_uri_set)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "header_names_get", i.xqd_req_header_names_get)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "header_remove", i.xqd_req_header_remove)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "header_value_get", i.xqd_req_header_value_get)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "header_values_get", i.xqd_req_header_values_get)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "header_values_set", i.xqd_req_header_values_set)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "send", i.xqd_req_send)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "cache_override_set", i.xqd_req_cache_override_set)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "cache_override_v2_set", i.xqd_req_cache_override_v2_set)
+	linker.FuncWrap("fastly_http_req", "body_downstream_get", i.xqd_req_body_downstream_get)
+	linker.FuncWrap("fastly_http_req", "downstream_client_ip_addr", i.xqd_req_downstream_client_ip_addr)
+	linker.FuncWrap("fastly_http_req", "new", i.xqd_req_new)
+	linker.FuncWrap("fastly_http_req", "version_get", i.xqd_req_version_get)
+	linker.FuncWrap("fastly_http_req", "version_set", i.xqd_req_version_set)
+	linker.FuncWrap("fastly_http_req", "method_get", i.xqd_req_method_get)
+	linker.FuncWrap("fastly_http_req", "method_set", i.xqd_req_method_set)
+	linker.FuncWrap("fastly_http_req", "uri_get", i.xqd_req_uri_get)
+	linker.FuncWrap("fastly_http_req", "uri_set", i.xqd_req_uri_set)
+	linker.FuncWrap("fastly_http_req", "header_names_get", i.xqd_req_header_names_get)
+	linker.FuncWrap("fastly_http_req", "header_remove", i.xqd_req_header_remove)
+	linker.FuncWrap("fastly_http_req", "header_value_get", i.xqd_req_header_value_get)
+	linker.FuncWrap("fastly_http_req", "header_values_get", i.xqd_req_header_values_get)
+	linker.FuncWrap("fastly_http_req", "header_values_set", i.xqd_req_header_values_set)
+	linker.FuncWrap("fastly_http_req", "send", i.xqd_req_send)
+	linker.FuncWrap("fastly_http_req", "send_async", i.xqd_req_send_async)
+	linker.FuncWrap("fastly_http_req", "pending_req_poll", i.xqd_pending_req_poll)
+	linker.FuncWrap("fastly_http_req", "pending_req_select", i.xqd_pending_req_select)
+	linker.FuncWrap("fastly_http_req", "pending_req_wait", i.xqd_pending_req_wait)
+	linker.FuncWrap("fastly_http_req", "cache_override_set", i.xqd_req_cache_override_set)
+	linker.FuncWrap("fastly_http_req", "cache_override_v2_set", i.xqd_req_cache_override_v2_set)
 	// The Go http implementation doesn't make it easy to get at the original headers in order, so
 	// we just use the same sorted order
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "original_header_names_get", i.xqd_req_header_names_get)
+	linker.FuncWrap("fastly_http_req", "original_header_names_get", i.xqd_req_header_names_get)
+	linker.FuncWrap("fastly_http_req", "register_dynamic_backend", i.xqd_req_register_dynamic_backend)
 
 	// xqd_response.go
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "send_downstream", i.xqd_resp_send_downstream)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "new", i.xqd_resp_new)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "status_get", i.xqd_resp_status_get)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "status_set", i.xqd_resp_status_set)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "version_get", i.xqd_resp_version_get)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "version_set", i.xqd_resp_version_set)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "header_names_get", i.xqd_resp_header_names_get)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "header_remove", i.xqd_resp_header_remove)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "header_values_get", i.xqd_resp_header_values_get)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "header_values_set", i.xqd_resp_header_values_set)
+	linker.FuncWrap("fastly_http_resp", "send_downstream", i.xqd_resp_send_downstream)
+	linker.FuncWrap("fastly_http_resp", "new", i.xqd_resp_new)
+	linker.FuncWrap("fastly_http_resp", "status_get", i.xqd_resp_status_get)
+	linker.FuncWrap("fastly_http_resp", "status_set", i.xqd_resp_status_set)
+	linker.FuncWrap("fastly_http_resp", "version_get", i.xqd_resp_version_get)
+	linker.FuncWrap("fastly_http_resp", "version_set", i.xqd_resp_version_set)
+	linker.FuncWrap("fastly_http_resp", "header_names_get", i.xqd_resp_header_names_get)
+	linker.FuncWrap("fastly_http_resp", "header_remove", i.xqd_resp_header_remove)
+	linker.FuncWrap("fastly_http_resp", "header_values_get", i.xqd_resp_header_values_get)
+	linker.FuncWrap("fastly_http_resp", "header_values_set", i.xqd_resp_header_values_set)
 
 	// xqd_body.go
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_body", "new", i.xqd_body_new)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_body", "write", i.xqd_body_write)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_body", "read", i.xqd_body_read)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_body", "append", i.xqd_body_append)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_body", "close", i.xqd_body_close)
+	linker.FuncWrap("fastly_http_body", "new", i.xqd_body_new)
+	linker.FuncWrap("fastly_http_body", "write", i.xqd_body_write)
+	linker.FuncWrap("fastly_http_body", "read", i.xqd_body_read)
+	linker.FuncWrap("fastly_http_body", "append", i.xqd_body_append)
+	linker.FuncWrap("fastly_http_body", "close", i.xqd_body_close)
 
 	// xqd_log.go
-	linker.DefineFunc(i.wasmctx.store, "fastly_log", "endpoint_get", i.xqd_log_endpoint_get)
-	linker.DefineFunc(i.wasmctx.store, "fastly_log", "write", i.xqd_log_write)
+	linker.FuncWrap("fastly_log", "endpoint_get", i.xqd_log_endpoint_get)
+	linker.FuncWrap("fastly_log", "write", i.xqd_log_write)
 
 	// xqd_dictionary.go
-	linker.DefineFunc(i.wasmctx.store, "fastly_dictionary", "open", i.xqd_dictionary_open)
-	linker.DefineFunc(i.wasmctx.store, "fastly_dictionary", "get", i.xqd_dictionary_get)
+	linker.FuncWrap("fastly_dictionary", "open", i.xqd_dictionary_open)
+	linker.FuncWrap("fastly_dictionary", "get", i.xqd_dictionary_get)
+	linker.FuncWrap("fastly_config_store", "open", i.xqd_config_store_open)
+	linker.FuncWrap("fastly_config_store", "get", i.xqd_config_store_get)
+
+	// xqd_cache.go
+	linker.FuncWrap("fastly_cache", "lookup", i.xqd_cache_lookup)
+	linker.FuncWrap("fastly_cache", "insert", i.xqd_cache_insert)
+	linker.FuncWrap("fastly_cache", "transaction_lookup", i.xqd_cache_transaction_lookup)
+	linker.FuncWrap("fastly_cache", "transaction_insert", i.xqd_cache_transaction_insert)
+	linker.FuncWrap("fastly_cache", "transaction_insert_and_stream_back", i.xqd_cache_transaction_insert_and_stream_back)
+	linker.FuncWrap("fastly_cache", "transaction_update", i.xqd_cache_transaction_update)
+	linker.FuncWrap("fastly_cache", "transaction_cancel", i.xqd_cache_transaction_cancel)
+	linker.FuncWrap("fastly_cache", "close", i.xqd_cache_close)
+	linker.FuncWrap("fastly_cache", "get_state", i.xqd_cache_get_state)
+	linker.FuncWrap("fastly_cache", "get_user_metadata", i.xqd_cache_get_user_metadata)
+	linker.FuncWrap("fastly_cache", "get_body", i.xqd_cache_get_body)
+	linker.FuncWrap("fastly_cache", "get_length", i.xqd_cache_get_length)
+	linker.FuncWrap("fastly_cache", "get_max_age_ns", i.xqd_cache_get_max_age_ns)
+	linker.FuncWrap("fastly_cache", "get_stale_while_revalidate_ns", i.xqd_cache_get_stale_while_revalidate_ns)
+	linker.FuncWrap("fastly_cache", "get_age_ns", i.xqd_cache_get_age_ns)
+	linker.FuncWrap("fastly_cache", "get_hits", i.xqd_cache_get_hits)
+
+	// xqd_kv_store.go
+	linker.FuncWrap("fastly_kv_store", "open", i.xqd_kv_store_open)
+	linker.FuncWrap("fastly_kv_store", "lookup", i.xqd_kv_store_lookup)
+	linker.FuncWrap("fastly_kv_store", "lookup_wait", i.xqd_kv_store_lookup_wait)
+	linker.FuncWrap("fastly_kv_store", "lookup_wait_v2", i.xqd_kv_store_lookup_wait_v2)
+	linker.FuncWrap("fastly_kv_store", "insert", i.xqd_kv_store_insert)
+	linker.FuncWrap("fastly_kv_store", "insert_wait", i.xqd_kv_store_insert_wait)
+	linker.FuncWrap("fastly_kv_store", "delete", i.xqd_kv_store_delete)
+	linker.FuncWrap("fastly_kv_store", "delete_wait", i.xqd_kv_store_delete_wait)
+	linker.FuncWrap("fastly_kv_store", "list", i.xqd_kv_store_list)
+	linker.FuncWrap("fastly_kv_store", "list_wait", i.xqd_kv_store_list_wait)
+
+	linker.FuncWrap("fastly_object_store", "open", i.xqd_object_store_open)
+	linker.FuncWrap("fastly_object_store", "lookup", i.xqd_object_store_lookup)
+	linker.FuncWrap("fastly_object_store", "lookup_async", i.xqd_object_store_lookup_async)
+	linker.FuncWrap("fastly_object_store", "pending_lookup_wait", i.xqd_object_store_pending_lookup_wait)
+	linker.FuncWrap("fastly_object_store", "insert", i.xqd_object_store_insert)
+	linker.FuncWrap("fastly_object_store", "insert_async", i.xqd_object_store_insert_async)
+	linker.FuncWrap("fastly_object_store", "pending_insert_wait", i.xqd_object_store_pending_insert_wait)
+	linker.FuncWrap("fastly_object_store", "delete_async", i.xqd_object_store_delete_async)
+	linker.FuncWrap("fastly_object_store", "pending_delete_wait", i.xqd_object_store_pending_delete_wait)
+
+	// xqd_geo.go
+	linker.FuncWrap("fastly_geo", "lookup", i.xqd_geo_lookup)
+
+	// xqd_acl.go
+	linker.FuncWrap("fastly_acl", "open", i.xqd_acl_open)
+	linker.FuncWrap("fastly_acl", "lookup", i.xqd_acl_lookup)
+
+	// xqd_backend.go
+	linker.FuncWrap("fastly_backend", "exists", i.xqd_backend_exists)
+	linker.FuncWrap("fastly_backend", "is_healthy", i.xqd_backend_is_healthy)
+	linker.FuncWrap("fastly_backend", "is_dynamic", i.xqd_backend_is_dynamic)
+	linker.FuncWrap("fastly_backend", "get_host", i.xqd_backend_get_host)
+	linker.FuncWrap("fastly_backend", "get_override_host", i.xqd_backend_get_override_host)
+	linker.FuncWrap("fastly_backend", "get_port", i.xqd_backend_get_port)
+	linker.FuncWrap("fastly_backend", "get_connect_timeout_ms", i.xqd_backend_get_connect_timeout_ms)
+	linker.FuncWrap("fastly_backend", "get_first_byte_timeout_ms", i.xqd_backend_get_first_byte_timeout_ms)
+	linker.FuncWrap("fastly_backend", "get_between_bytes_timeout_ms", i.xqd_backend_get_between_bytes_timeout_ms)
+	linker.FuncWrap("fastly_backend", "is_ssl", i.xqd_backend_is_ssl)
+	linker.FuncWrap("fastly_backend", "get_ssl_min_version", i.xqd_backend_get_ssl_min_version)
+	linker.FuncWrap("fastly_backend", "get_ssl_max_version", i.xqd_backend_get_ssl_max_version)
+
+	// xqd_erl.go
+	linker.FuncWrap("fastly_erl", "check_rate", i.xqd_erl_check_rate)
+	linker.FuncWrap("fastly_erl", "ratecounter_increment", i.xqd_erl_ratecounter_increment)
+	linker.FuncWrap("fastly_erl", "ratecounter_lookup_rate", i.xqd_erl_ratecounter_lookup_rate)
+	linker.FuncWrap("fastly_erl", "ratecounter_lookup_count", i.xqd_erl_ratecounter_lookup_count)
+	linker.FuncWrap("fastly_erl", "penaltybox_add", i.xqd_erl_penaltybox_add)
+	linker.FuncWrap("fastly_erl", "penaltybox_has", i.xqd_erl_penaltybox_has)
+
+	// xqd_device_detection.go
+	linker.FuncWrap("fastly_device_detection", "lookup", i.xqd_device_detection_lookup)
+
+	// xqd_secret_store.go
+	linker.FuncWrap("fastly_secret_store", "open", i.xqd_secret_store_open)
+	linker.FuncWrap("fastly_secret_store", "get", i.xqd_secret_store_get)
+	linker.FuncWrap("fastly_secret_store", "plaintext", i.xqd_secret_store_plaintext)
+	linker.FuncWrap("fastly_secret_store", "from_bytes", i.xqd_secret_store_from_bytes)
+
+	// xqd_purge.go
+	linker.FuncWrap("fastly_purge", "purge_surrogate_key", i.xqd_purge_surrogate_key)
 }
 
 // linklegacy links in the abi methods using the legacy method names
@@ -124,74 +255,73 @@ func (i *Instance) linklegacy(linker *wasmtime.Linker) {
 	// XQD Stubbing -{{{
 	// TODO: All of these XQD methods are stubbed. As they are implemented, they'll be removed from
 	// here and explicitly linked in the section below.
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_pending_req_poll", i.wasm4("xqd_pending_req_poll"))
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_pending_req_select", i.wasm5("xqd_pending_req_select"))
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_pending_req_wait", i.wasm3("xqd_pending_req_wait"))
-
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_downstream_tls_cipher_openssl_name", i.wasm3("req_downstream_tls_cipher_openssl_name"))
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_downstream_tls_protocol", i.wasm3("req_downstream_tls_protocol"))
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_downstream_tls_client_hello", i.wasm3("req_downstream_tls_client_hello"))
+	linker.FuncWrap("env", "xqd_req_downstream_tls_cipher_openssl_name", i.wasm3("req_downstream_tls_cipher_openssl_name"))
+	linker.FuncWrap("env", "xqd_req_downstream_tls_protocol", i.wasm3("req_downstream_tls_protocol"))
+	linker.FuncWrap("env", "xqd_req_downstream_tls_client_hello", i.wasm3("req_downstream_tls_client_hello"))
 
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_header_insert", i.wasm5("req_header_insert"))
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_send_async", i.wasm5("req_send_async"))
+	linker.FuncWrap("env", "xqd_req_header_insert", i.wasm5("req_header_insert"))
 
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_original_header_count", i.wasm1("xqd_req_original_header_count"))
+	linker.FuncWrap("env", "xqd_req_original_header_count", i.wasm1("xqd_req_original_header_count"))
 
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_resp_header_append", i.wasm5("xqd_resp_header_append"))
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_resp_header_insert", i.wasm5("xqd_resp_header_insert"))
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_resp_header_value_get", i.wasm6("xqd_resp_header_value_get"))
+	linker.FuncWrap("env", "xqd_resp_header_append", i.wasm5("xqd_resp_header_append"))
+	linker.FuncWrap("env", "xqd_resp_header_insert", i.wasm5("xqd_resp_header_insert"))
+	linker.FuncWrap("env", "xqd_resp_header_value_get", i.wasm6("xqd_resp_header_value_get"))
 
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_body_close_downstream", i.xqd_body_close)
 	// End XQD Stubbing -}}}
 
 	// xqd.go
-	linker.DefineFunc(i.wasmctx.store, "fastly_abi", "init", i.xqd_init)
-	linker.DefineFunc(i.wasmctx.store, "fastly_uap", "parse", i.xqd_uap_parse)
+	linker.FuncWrap("fastly_abi", "init", i.xqd_init)
+	linker.FuncWrap("fastly_uap", "parse", i.xqd_uap_parse)
 
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "body_downstream_get", i.xqd_req_body_downstream_get)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_resp", "send_downstream", i.xqd_resp_send_downstream)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "downstream_client_ip_addr", i.xqd_req_downstream_client_ip_addr)
+	linker.FuncWrap("fastly_http_req", "body_downstream_get", i.xqd_req_body_downstream_get)
+	linker.FuncWrap("fastly_http_resp", "send_downstream", i.xqd_resp_send_downstream)
+	linker.FuncWrap("fastly_http_req", "downstream_client_ip_addr", i.xqd_req_downstream_client_ip_addr)
 
 	// xqd_request.go
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_new", i.xqd_req_new)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_version_get", i.xqd_req_version_get)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_version_set", i.xqd_req_version_set)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_method_get", i.xqd_req_method_get)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_method_set", i.xqd_req_method_set)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_uri_get", i.xqd_req_uri_get)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_uri_set", i.xqd_req_uri_set)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_header_remove", i.xqd_req_header_remove)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_header_names_get", i.xqd_req_header_names_get)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_header_value_get", i.xqd_req_header_value_get)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_header_values_get", i.xqd_req_header_values_get)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_header_values_set", i.xqd_req_header_values_set)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_send", i.xqd_req_send)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_cache_override_set", i.xqd_req_cache_override_set)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_req_cache_override_v2_set", i.xqd_req_cache_override_v2_set)
+	linker.FuncWrap("env", "xqd_req_new", i.xqd_req_new)
+	linker.FuncWrap("env", "xqd_req_version_get", i.xqd_req_version_get)
+	linker.FuncWrap("env", "xqd_req_version_set", i.xqd_req_version_set)
+	linker.FuncWrap("env", "xqd_req_method_get", i.xqd_req_method_get)
+	linker.FuncWrap("env", "xqd_req_method_set", i.xqd_req_method_set)
+	linker.FuncWrap("env", "xqd_req_uri_get", i.xqd_req_uri_get)
+	linker.FuncWrap("env", "xqd_req_uri_set", i.xqd_req_uri_set)
+	linker.FuncWrap("env", "xqd_req_header_remove", i.xqd_req_header_remove)
+	linker.FuncWrap("env", "xqd_req_header_names_get", i.xqd_req_header_names_get)
+	linker.FuncWrap("env", "xqd_req_header_value_get", i.xqd_req_header_value_get)
+	linker.FuncWrap("env", "xqd_req_header_values_get", i.xqd_req_header_values_get)
+	linker.FuncWrap("env", "xqd_req_header_values_set", i.xqd_req_header_values_set)
+	linker.FuncWrap("env", "xqd_req_send", i.xqd_req_send)
+	linker.FuncWrap("env", "xqd_req_send_async", i.xqd_req_send_async)
+	linker.FuncWrap("env", "xqd_pending_req_poll", i.xqd_pending_req_poll)
+	linker.FuncWrap("env", "xqd_pending_req_select", i.xqd_pending_req_select)
+	linker.FuncWrap("env", "xqd_pending_req_wait", i.xqd_pending_req_wait)
+	linker.FuncWrap("env", "xqd_req_cache_override_set", i.xqd_req_cache_override_set)
+	linker.FuncWrap("env", "xqd_req_cache_override_v2_set", i.xqd_req_cache_override_v2_set)
 	// The Go http implementation doesn't make it easy to get at the original headers in order, so
 	// we just use the same sorted order
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_req", "original_header_names_get", i.xqd_req_header_names_get)
+	linker.FuncWrap("fastly_http_req", "original_header_names_get", i.xqd_req_header_names_get)
 
 	// xqd_response.go
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_resp_new", i.xqd_resp_new)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_resp_status_get", i.xqd_resp_status_get)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_resp_status_set", i.xqd_resp_status_set)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_resp_version_get", i.xqd_resp_version_get)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_resp_version_set", i.xqd_resp_version_set)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_resp_header_remove", i.xqd_resp_header_remove)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_resp_header_names_get", i.xqd_resp_header_names_get)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_resp_header_values_get", i.xqd_resp_header_values_get)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_resp_header_values_set", i.xqd_resp_header_values_set)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_resp_send_downstream", i.xqd_resp_send_downstream)
+	linker.FuncWrap("env", "xqd_resp_new", i.xqd_resp_new)
+	linker.FuncWrap("env", "xqd_resp_status_get", i.xqd_resp_status_get)
+	linker.FuncWrap("env", "xqd_resp_status_set", i.xqd_resp_status_set)
+	linker.FuncWrap("env", "xqd_resp_version_get", i.xqd_resp_version_get)
+	linker.FuncWrap("env", "xqd_resp_version_set", i.xqd_resp_version_set)
+	linker.FuncWrap("env", "xqd_resp_header_remove", i.xqd_resp_header_remove)
+	linker.FuncWrap("env", "xqd_resp_header_names_get", i.xqd_resp_header_names_get)
+	linker.FuncWrap("env", "xqd_resp_header_values_get", i.xqd_resp_header_values_get)
+	linker.FuncWrap("env", "xqd_resp_header_values_set", i.xqd_resp_header_values_set)
+	linker.FuncWrap("env", "xqd_resp_send_downstream", i.xqd_resp_send_downstream)
 
 	// xqd_body.go
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_body", "new", i.xqd_body_new)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_body", "read", i.xqd_body_read)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_body", "write", i.xqd_body_write)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_body", "append", i.xqd_body_append)
-	linker.DefineFunc(i.wasmctx.store, "fastly_http_body", "close", i.xqd_body_close)
+	linker.FuncWrap("fastly_http_body", "new", i.xqd_body_new)
+	linker.FuncWrap("fastly_http_body", "read", i.xqd_body_read)
+	linker.FuncWrap("fastly_http_body", "write", i.xqd_body_write)
+	linker.FuncWrap("fastly_http_body", "append", i.xqd_body_append)
+	linker.FuncWrap("fastly_http_body", "close", i.xqd_body_close)
+	linker.FuncWrap("env", "xqd_body_close_downstream", i.xqd_body_close_downstream)
 
 	// xqd_log.go
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_log_endpoint_get", i.xqd_log_endpoint_get)
-	linker.DefineFunc(i.wasmctx.store, "env", "xqd_log_write", i.xqd_log_write)
+	linker.FuncWrap("env", "xqd_log_endpoint_get", i.xqd_log_endpoint_get)
+	linker.FuncWrap("env", "xqd_log_write", i.xqd_log_write)
 }
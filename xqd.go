@@ -1,11 +1,13 @@
 package fastlike
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"strings"
 )
 
@@ -33,13 +35,20 @@ func (i *Instance) xqd_req_body_downstream_get(request_handle_out int32, body_ha
 		rh.Request.URL.Scheme = "http"
 	}
 
-	// NOTE: Originally, we setup the body handle using `bodies.NewReader(rh.Body)`, but there is
-	// a bug when the *new* request (rh) is sent via subrequest where the subrequest target doesn't
-	// get the body. I don't know why. This "solves" the problem for fastlike, at least
-	// temporarily.
-	bhid, bh := i.bodies.NewBuffer()
-	io.Copy(bh, i.ds_request.Body)
-	i.ds_request.Body.Close()
+	// The body is read lazily, straight from the downstream request, as the guest asks for it
+	body := i.ds_request.Body
+	if body == nil {
+		body = http.NoBody
+	}
+	if i.maxBodySize > 0 {
+		i.ds_body = &limitedBody{ReadCloser: body, remaining: i.maxBodySize}
+		body = i.ds_body
+	}
+
+	// The body handle owns the body from here on out
+	rh.Body = nil
+	bhid, bh := i.bodies.NewReader(body)
+	bh.length = i.ds_request.ContentLength
 
 	i.memory.PutUint32(uint32(rhid), int64(request_handle_out))
 	i.memory.PutUint32(uint32(bhid), int64(body_handle_out))
@@ -50,11 +59,6 @@ func (i *Instance) xqd_req_body_downstream_get(request_handle_out int32, body_ha
 }
 
 func (i *Instance) xqd_resp_send_downstream(whandle int32, bhandle int32, stream int32) int32 {
-	if stream != 0 {
-		i.abilog.Printf("resp_send_downstream: streaming unsupported")
-		return XqdErrUnsupported
-	}
-
 	w, b := i.responses.Get(int(whandle)), i.bodies.Get(int(bhandle))
 	if w == nil {
 		i.abilog.Printf("resp_send_downstream: invalid response handle %d", whandle)
@@ -63,7 +67,17 @@ func (i *Instance) xqd_resp_send_downstream(whandle int32, bhandle int32, stream
 		i.abilog.Printf("resp_send_downstream: invalid body handle %d", bhandle)
 		return XqdErrInvalidHandle
 	}
-	defer b.Close()
+
+	if i.bodyTooLarge() {
+		i.abilog.Printf("resp_send_downstream: request body too large, sent 413 instead")
+		return XqdError
+	}
+
+	if i.ds_sent {
+		i.abilog.Printf("resp_send_downstream: response already sent")
+		return XqdError
+	}
+	i.ds_sent = true
 
 	for k, v := range w.Header {
 		i.ds_response.Header()[k] = v
@@ -71,6 +85,29 @@ func (i *Instance) xqd_resp_send_downstream(whandle int32, bhandle int32, stream
 
 	i.ds_response.WriteHeader(w.StatusCode)
 
+	if stream != 0 {
+		i.abilog.Printf("resp_send_downstream: streaming handle=%d body=%d", whandle, bhandle)
+
+		// Send along whatever the guest has already written to the body, and then hook the body
+		// handle up to the downstream response so that subsequent writes go straight through
+		dw := &downstreamWriter{w: i.ds_response}
+		_, err := io.Copy(dw, b)
+		if err != nil {
+			i.abilog.Printf("resp_send_downstream: copy err, got %s", err.Error())
+			return XqdError
+		}
+		b.Close()
+
+		b.reader = bytes.NewReader(nil)
+		b.writer = dw
+		b.closer = dw
+		dw.Flush()
+
+		return XqdStatusOK
+	}
+
+	defer b.Close()
+
 	_, err := io.Copy(i.ds_response, b)
 	if err != nil {
 		i.abilog.Printf("resp_send_downstream: copy err, got %s", err.Error())
@@ -0,0 +1,78 @@
+package fastlike
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+)
+
+// Values written to acl_error_out by fastly_acl::lookup
+const (
+	aclErrorOk              uint32 = 1
+	aclErrorNoContent       uint32 = 2
+	aclErrorTooManyRequests uint32 = 3
+)
+
+func (i *Instance) xqd_acl_open(name_addr int32, name_size int32, handle_out int32) int32 {
+	var buf = make([]byte, name_size)
+	var _, err = i.memory.ReadAt(buf, int64(name_addr))
+	if err != nil {
+		return XqdError
+	}
+
+	var name = string(buf)
+
+	i.abilog.Printf("acl_open: name=%s", name)
+
+	handle := i.getACLHandle(name)
+	if handle == HandleInvalid {
+		i.memory.PutUint32(HandleInvalid, int64(handle_out))
+		return XqdErrNone
+	}
+
+	i.memory.PutUint32(uint32(handle), int64(handle_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_acl_lookup(handle int32, addr_octets int32, addr_len int32, body_handle_out int32, acl_error_out int32) int32 {
+	var a = i.getACL(int(handle))
+	if a == nil {
+		i.abilog.Printf("acl_lookup: invalid handle=%d", handle)
+		return XqdErrInvalidHandle
+	}
+
+	// Addresses are passed as their raw octets, so the length says whether it's IPv4 or IPv6
+	if addr_len != net.IPv4len && addr_len != net.IPv6len {
+		i.abilog.Printf("acl_lookup: invalid address length=%d", addr_len)
+		return XqdErrInvalidArgument
+	}
+
+	var ip = make(net.IP, addr_len)
+	var _, err = i.memory.ReadAt(ip, int64(addr_octets))
+	if err != nil {
+		return XqdError
+	}
+
+	entry, ok := a.lookup(ip)
+
+	i.abilog.Printf("acl_lookup: handle=%d ip=%s matched=%t", handle, ip, ok)
+
+	if !ok {
+		i.memory.PutUint32(HandleInvalid, int64(body_handle_out))
+		i.memory.PutUint32(aclErrorNoContent, int64(acl_error_out))
+		return XqdStatusOK
+	}
+
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return XqdError
+	}
+
+	bhid, bh := i.bodies.NewReader(ioutil.NopCloser(bytes.NewReader(value)))
+	bh.length = int64(len(value))
+
+	i.memory.PutUint32(uint32(bhid), int64(body_handle_out))
+	i.memory.PutUint32(aclErrorOk, int64(acl_error_out))
+	return XqdStatusOK
+}
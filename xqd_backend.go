@@ -0,0 +1,230 @@
+package fastlike
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// readBackend reads a backend name from guest memory and returns the backend, and whether it's
+// dynamic. If there's no such backend, the status is XqdErrInvalidArgument.
+func (i *Instance) readBackend(fn string, name_addr int32, name_size int32) (*Backend, bool, int32) {
+	var buf = make([]byte, name_size)
+	var _, err = i.memory.ReadAt(buf, int64(name_addr))
+	if err != nil {
+		return nil, false, XqdError
+	}
+
+	var name = string(buf)
+
+	b, dynamic, ok := i.describeBackend(name)
+	if !ok {
+		i.abilog.Printf("%s: backend=%s not found", fn, name)
+		return nil, false, XqdErrInvalidArgument
+	}
+
+	i.abilog.Printf("%s: backend=%s", fn, name)
+	return b, dynamic, XqdStatusOK
+}
+
+// writeBackendString writes a string describing a backend to guest memory, the same way every other
+// hostcall returning a string does
+func (i *Instance) writeBackendString(value string, addr int32, size int32, nwritten_out int32) int32 {
+	if len(value) > int(size) {
+		i.memory.PutUint32(uint32(len(value)), int64(nwritten_out))
+		return XqdErrBufferLength
+	}
+
+	nwritten, err := i.memory.WriteAt([]byte(value), int64(addr))
+	if err != nil {
+		return XqdError
+	}
+
+	i.memory.PutUint32(uint32(nwritten), int64(nwritten_out))
+	return XqdStatusOK
+}
+
+// putBool writes a boolean to guest memory as a u32
+func (i *Instance) putBool(v bool, offset int32) {
+	if v {
+		i.memory.PutUint32(1, int64(offset))
+	} else {
+		i.memory.PutUint32(0, int64(offset))
+	}
+}
+
+// backendHostPort splits a backend's target into its host and port, with the port defaulting to
+// whatever the backend's protocol uses
+func backendHostPort(b *Backend) (string, uint16) {
+	host, port, err := net.SplitHostPort(b.Target)
+	if err != nil {
+		host, port = b.Target, ""
+	}
+
+	if n, err := strconv.ParseUint(port, 10, 16); err == nil {
+		return host, uint16(n)
+	} else if b.UseSSL {
+		return host, 443
+	}
+	return host, 80
+}
+
+// timeoutMillis returns a backend's timeout in milliseconds, or Fastly's default if it isn't set
+func timeoutMillis(timeout, fallback time.Duration) uint32 {
+	if timeout == 0 {
+		timeout = fallback
+	}
+	return uint32(timeout / time.Millisecond)
+}
+
+func (i *Instance) xqd_backend_exists(name_addr int32, name_size int32, exists_out int32) int32 {
+	var buf = make([]byte, name_size)
+	var _, err = i.memory.ReadAt(buf, int64(name_addr))
+	if err != nil {
+		return XqdError
+	}
+
+	var name = string(buf)
+
+	_, _, ok := i.describeBackend(name)
+
+	i.abilog.Printf("backend_exists: backend=%s exists=%t", name, ok)
+
+	i.putBool(ok, exists_out)
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_backend_is_healthy(name_addr int32, name_size int32, health_out int32) int32 {
+	b, _, status := i.readBackend("backend_is_healthy", name_addr, name_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	var health = BackendHealthUnknown
+	if b.Health != nil {
+		health = b.Health()
+	}
+
+	i.memory.PutUint32(uint32(health), int64(health_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_backend_is_dynamic(name_addr int32, name_size int32, dynamic_out int32) int32 {
+	_, dynamic, status := i.readBackend("backend_is_dynamic", name_addr, name_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	i.putBool(dynamic, dynamic_out)
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_backend_get_host(name_addr int32, name_size int32, addr int32, size int32, nwritten_out int32) int32 {
+	b, _, status := i.readBackend("backend_get_host", name_addr, name_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	host, _ := backendHostPort(b)
+	return i.writeBackendString(host, addr, size, nwritten_out)
+}
+
+func (i *Instance) xqd_backend_get_override_host(name_addr int32, name_size int32, addr int32, size int32, nwritten_out int32) int32 {
+	b, _, status := i.readBackend("backend_get_override_host", name_addr, name_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	if b.HostOverride == "" {
+		i.memory.PutUint32(0, int64(nwritten_out))
+		return XqdErrNone
+	}
+
+	return i.writeBackendString(b.HostOverride, addr, size, nwritten_out)
+}
+
+func (i *Instance) xqd_backend_get_port(name_addr int32, name_size int32, port_out int32) int32 {
+	b, _, status := i.readBackend("backend_get_port", name_addr, name_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	_, port := backendHostPort(b)
+	i.memory.PutUint16(port, int64(port_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_backend_get_connect_timeout_ms(name_addr int32, name_size int32, timeout_out int32) int32 {
+	b, _, status := i.readBackend("backend_get_connect_timeout_ms", name_addr, name_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	i.memory.PutUint32(timeoutMillis(b.ConnectTimeout, defaultConnectTimeout), int64(timeout_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_backend_get_first_byte_timeout_ms(name_addr int32, name_size int32, timeout_out int32) int32 {
+	b, _, status := i.readBackend("backend_get_first_byte_timeout_ms", name_addr, name_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	i.memory.PutUint32(timeoutMillis(b.FirstByteTimeout, defaultFirstByteTimeout), int64(timeout_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_backend_get_between_bytes_timeout_ms(name_addr int32, name_size int32, timeout_out int32) int32 {
+	b, _, status := i.readBackend("backend_get_between_bytes_timeout_ms", name_addr, name_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	i.memory.PutUint32(timeoutMillis(b.BetweenBytesTimeout, defaultBetweenBytesTimeout), int64(timeout_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_backend_is_ssl(name_addr int32, name_size int32, ssl_out int32) int32 {
+	b, _, status := i.readBackend("backend_is_ssl", name_addr, name_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	i.putBool(b.UseSSL, ssl_out)
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_backend_get_ssl_min_version(name_addr int32, name_size int32, version_out int32) int32 {
+	b, _, status := i.readBackend("backend_get_ssl_min_version", name_addr, name_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	return i.putTLSVersion(b, b.SSLMinVersion, version_out)
+}
+
+func (i *Instance) xqd_backend_get_ssl_max_version(name_addr int32, name_size int32, version_out int32) int32 {
+	b, _, status := i.readBackend("backend_get_ssl_max_version", name_addr, name_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	return i.putTLSVersion(b, b.SSLMaxVersion, version_out)
+}
+
+// putTLSVersion writes a backend's TLS version to guest memory the way guests number them. Backends
+// which don't use TLS, or don't restrict the version, have none.
+func (i *Instance) putTLSVersion(b *Backend, version uint16, version_out int32) int32 {
+	if !b.UseSSL {
+		return XqdErrNone
+	}
+
+	for v, tv := range tlsVersions {
+		if tv == version {
+			i.memory.PutUint32(v, int64(version_out))
+			return XqdStatusOK
+		}
+	}
+
+	return XqdErrNone
+}
@@ -42,20 +42,28 @@ func (i *Instance) xqd_body_read(handle int32, addr int32, maxlen int32, nread_o
 		return XqdErrInvalidHandle
 	}
 
-	buf := bytes.NewBuffer(make([]byte, 0, maxlen))
-	ncopied, err := io.Copy(buf, io.LimitReader(body, int64(maxlen)))
-	if err != nil {
+	// Read whatever is available rather than waiting to fill the guest's buffer, so that streaming
+	// bodies are seen as they arrive. Reading zero bytes tells the guest it's reached the end.
+	buf := make([]byte, maxlen)
+	var ncopied int
+	var err error
+	unblock := i.meter.block()
+	for ncopied == 0 && err == nil && len(buf) > 0 {
+		ncopied, err = body.Read(buf)
+	}
+	unblock()
+	if err != nil && err != io.EOF {
 		i.abilog.Printf("body_read: error copying got=%s", err.Error())
 		return XqdError
 	}
 
-	nwritten, err2 := i.memory.WriteAt(buf.Bytes(), int64(addr))
+	nwritten, err2 := i.memory.WriteAt(buf[:ncopied], int64(addr))
 	if err2 != nil {
 		i.abilog.Printf("body_read: error writing got=%s", err2.Error())
 		return XqdError
 	}
 
-	if ncopied != int64(nwritten) {
+	if ncopied != nwritten {
 		i.abilog.Printf("body_read: error copying copied=%d wrote=%d", ncopied, nwritten)
 		return XqdError
 	}
@@ -85,6 +93,12 @@ func (i *Instance) xqd_body_append(dst_handle int32, src_handle int32) int32 {
 	// and then from the source
 	dst.reader = io.MultiReader(dst.reader, src)
 
+	if dst.length < 0 || src.length < 0 {
+		dst.length = -1
+	} else {
+		dst.length += src.length
+	}
+
 	return XqdStatusOK
 }
 
@@ -95,3 +109,19 @@ func (i *Instance) xqd_body_close(handle int32) int32 {
 
 	return XqdStatusOK
 }
+
+func (i *Instance) xqd_body_close_downstream(handle int32) int32 {
+	i.abilog.Printf("body_close_downstream: handle=%d", handle)
+
+	if i.bodies.Get(int(handle)) == nil {
+		return XqdErrInvalidHandle
+	}
+
+	// For streaming bodies, this finishes the downstream response
+	if err := i.bodies.Close(int(handle)); err != nil {
+		i.abilog.Printf("body_close_downstream: close err, got %s", err.Error())
+		return XqdError
+	}
+
+	return XqdStatusOK
+}
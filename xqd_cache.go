@@ -0,0 +1,463 @@
+package fastlike
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Option bits for fastly_cache lookups
+const (
+	cacheLookupOptionsReserved       = 1 << 0
+	cacheLookupOptionsRequestHeaders = 1 << 1
+)
+
+// Option bits for fastly_cache inserts and updates
+const (
+	cacheWriteOptionsReserved       = 1 << 0
+	cacheWriteOptionsRequestHeaders = 1 << 1
+	cacheWriteOptionsVaryRule       = 1 << 2
+	cacheWriteOptionsInitialAge     = 1 << 3
+	cacheWriteOptionsSWR            = 1 << 4
+	cacheWriteOptionsSurrogateKeys  = 1 << 5
+	cacheWriteOptionsLength         = 1 << 6
+	cacheWriteOptionsUserMetadata   = 1 << 7
+	cacheWriteOptionsSensitiveData  = 1 << 8
+)
+
+// Option bits for fastly_cache get_body
+const (
+	cacheGetBodyOptionsReserved = 1 << 0
+	cacheGetBodyOptionsFrom     = 1 << 1
+	cacheGetBodyOptionsTo       = 1 << 2
+)
+
+// Bits describing the result of a cache lookup
+const (
+	cacheLookupStateFound              = 1 << 0
+	cacheLookupStateUsable             = 1 << 1
+	cacheLookupStateStale              = 1 << 2
+	cacheLookupStateMustInsertOrUpdate = 1 << 3
+)
+
+func (i *Instance) xqd_cache_lookup(key_addr int32, key_len int32, options_mask int32, options_addr int32, handle_out int32) int32 {
+	key, headers, status := i.cacheLookupArgs("cache_lookup", key_addr, key_len, options_mask, options_addr)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	obj := i.coreCache.lookup(key, headers)
+	chid, _ := i.caches.New(key, obj, nil)
+
+	i.abilog.Printf("cache_lookup: key=%q found=%t handle=%d", key, obj != nil, chid)
+
+	i.memory.PutUint32(uint32(chid), int64(handle_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_insert(key_addr int32, key_len int32, options_mask int32, options_addr int32, body_out int32) int32 {
+	key := make([]byte, key_len)
+	_, err := i.memory.ReadAt(key, int64(key_addr))
+	if err != nil {
+		return XqdError
+	}
+
+	obj, status := i.cacheWriteOptions("cache_insert", options_mask, options_addr, nil)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	i.coreCache.insert(string(key), obj)
+	bhid, _ := i.bodies.NewWriteCloser(i.coreCache.writer(string(key), obj.body))
+
+	i.abilog.Printf("cache_insert: key=%q max_age=%s body=%d", key, obj.maxAge, bhid)
+
+	i.memory.PutUint32(uint32(bhid), int64(body_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_transaction_lookup(key_addr int32, key_len int32, options_mask int32, options_addr int32, handle_out int32) int32 {
+	key, headers, status := i.cacheLookupArgs("cache_transaction_lookup", key_addr, key_len, options_mask, options_addr)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	// This may wait for another transaction to finish with the same key
+	unblock := i.meter.block()
+	obj, tx, err := i.coreCache.transactionLookup(i.meter.Context(), key, headers)
+	unblock()
+	if err != nil {
+		i.abilog.Printf("cache_transaction_lookup: key=%q error=%s", key, err.Error())
+		return XqdError
+	}
+
+	chid, _ := i.caches.New(key, obj, tx)
+
+	i.abilog.Printf("cache_transaction_lookup: key=%q found=%t must_insert=%t handle=%d", key, obj != nil, tx != nil, chid)
+
+	i.memory.PutUint32(uint32(chid), int64(handle_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_transaction_insert(handle int32, options_mask int32, options_addr int32, body_out int32) int32 {
+	ch, obj, status := i.cacheTransactionInsert("cache_transaction_insert", handle, options_mask, options_addr)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	bhid, _ := i.bodies.NewWriteCloser(i.coreCache.writer(ch.key, obj.body))
+
+	i.abilog.Printf("cache_transaction_insert: key=%q max_age=%s body=%d", ch.key, obj.maxAge, bhid)
+
+	i.memory.PutUint32(uint32(bhid), int64(body_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_transaction_insert_and_stream_back(handle int32, options_mask int32, options_addr int32, body_out int32, handle_out int32) int32 {
+	ch, obj, status := i.cacheTransactionInsert("cache_transaction_insert_and_stream_back", handle, options_mask, options_addr)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	bhid, _ := i.bodies.NewWriteCloser(i.coreCache.writer(ch.key, obj.body))
+	chid, _ := i.caches.New(ch.key, obj, nil)
+
+	i.abilog.Printf("cache_transaction_insert_and_stream_back: key=%q max_age=%s body=%d handle=%d", ch.key, obj.maxAge, bhid, chid)
+
+	i.memory.PutUint32(uint32(bhid), int64(body_out))
+	i.memory.PutUint32(uint32(chid), int64(handle_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_transaction_update(handle int32, options_mask int32, options_addr int32) int32 {
+	ch := i.caches.Get(int(handle))
+	if ch == nil {
+		i.abilog.Printf("cache_transaction_update: invalid handle=%d", handle)
+		return XqdErrInvalidHandle
+	}
+
+	// Updating freshens an existing object, so there has to be one
+	if ch.tx == nil || ch.object == nil {
+		i.abilog.Printf("cache_transaction_update: handle=%d has nothing to update", handle)
+		return XqdErrInvalidArgument
+	}
+
+	obj, status := i.cacheWriteOptions("cache_transaction_update", options_mask, options_addr, ch.object.body)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	ch.tx.insert(obj)
+	ch.tx = nil
+
+	i.abilog.Printf("cache_transaction_update: key=%q max_age=%s", ch.key, obj.maxAge)
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_transaction_cancel(handle int32) int32 {
+	ch := i.caches.Get(int(handle))
+	if ch == nil {
+		i.abilog.Printf("cache_transaction_cancel: invalid handle=%d", handle)
+		return XqdErrInvalidHandle
+	}
+
+	i.abilog.Printf("cache_transaction_cancel: key=%q", ch.key)
+
+	if ch.tx != nil {
+		ch.tx.cancel()
+		ch.tx = nil
+	}
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_close(handle int32) int32 {
+	if i.caches.Get(int(handle)) == nil {
+		i.abilog.Printf("cache_close: invalid handle=%d", handle)
+		return XqdErrInvalidHandle
+	}
+
+	i.abilog.Printf("cache_close: handle=%d", handle)
+
+	i.caches.Close(int(handle))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_get_state(handle int32, state_out int32) int32 {
+	ch := i.caches.Get(int(handle))
+	if ch == nil {
+		i.abilog.Printf("cache_get_state: invalid handle=%d", handle)
+		return XqdErrInvalidHandle
+	}
+
+	var state uint32
+	if ch.object != nil {
+		state |= cacheLookupStateFound | cacheLookupStateUsable
+		if !ch.object.Fresh(i.coreCache.now()) {
+			state |= cacheLookupStateStale
+		}
+	}
+	if ch.tx != nil {
+		state |= cacheLookupStateMustInsertOrUpdate
+	}
+
+	i.abilog.Printf("cache_get_state: handle=%d state=%d", handle, state)
+
+	i.memory.PutUint32(state, int64(state_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_get_user_metadata(handle int32, addr int32, size int32, nwritten_out int32) int32 {
+	obj, status := i.cacheObject("cache_get_user_metadata", handle)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	if len(obj.userMetadata) > int(size) {
+		i.memory.PutUint32(uint32(len(obj.userMetadata)), int64(nwritten_out))
+		return XqdErrBufferLength
+	}
+
+	nwritten, err := i.memory.WriteAt(obj.userMetadata, int64(addr))
+	if err != nil {
+		return XqdError
+	}
+
+	i.memory.PutUint32(uint32(nwritten), int64(nwritten_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_get_body(handle int32, options_mask int32, options_addr int32, body_out int32) int32 {
+	obj, status := i.cacheObject("cache_get_body", handle)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	if options_mask&cacheGetBodyOptionsReserved != 0 {
+		return XqdErrInvalidArgument
+	}
+
+	// GetBodyOptions is laid out as {from: u64, to: u64}, and the range includes both ends
+	var from, to int64 = 0, -1
+	if options_mask&cacheGetBodyOptionsFrom != 0 {
+		from = int64(i.memory.Uint64(int64(options_addr)))
+	}
+	if options_mask&cacheGetBodyOptionsTo != 0 {
+		to = int64(i.memory.Uint64(int64(options_addr) + 8))
+	}
+
+	bhid, bh := i.bodies.NewReader(obj.body.Reader(i.meter.Context(), from, to, i.meter.block))
+	if to < 0 && from == 0 {
+		bh.length = obj.body.Length()
+	}
+
+	i.abilog.Printf("cache_get_body: handle=%d from=%d to=%d body=%d", handle, from, to, bhid)
+
+	i.memory.PutUint32(uint32(bhid), int64(body_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_get_length(handle int32, length_out int32) int32 {
+	obj, status := i.cacheObject("cache_get_length", handle)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	length := obj.body.Length()
+	if length < 0 {
+		return XqdErrNone
+	}
+
+	i.memory.PutUint64(uint64(length), int64(length_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_get_max_age_ns(handle int32, duration_out int32) int32 {
+	obj, status := i.cacheObject("cache_get_max_age_ns", handle)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	i.memory.PutUint64(uint64(obj.maxAge), int64(duration_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_get_stale_while_revalidate_ns(handle int32, duration_out int32) int32 {
+	obj, status := i.cacheObject("cache_get_stale_while_revalidate_ns", handle)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	i.memory.PutUint64(uint64(obj.swr), int64(duration_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_get_age_ns(handle int32, duration_out int32) int32 {
+	obj, status := i.cacheObject("cache_get_age_ns", handle)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	i.memory.PutUint64(uint64(obj.Age(i.coreCache.now())), int64(duration_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_cache_get_hits(handle int32, hits_out int32) int32 {
+	obj, status := i.cacheObject("cache_get_hits", handle)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	i.memory.PutUint64(obj.Hits(), int64(hits_out))
+	return XqdStatusOK
+}
+
+// cacheLookupArgs reads the key and request headers for a lookup out of guest memory
+// The name is used as a prefix for abi log messages.
+func (i *Instance) cacheLookupArgs(name string, key_addr int32, key_len int32, options_mask int32, options_addr int32) (string, http.Header, int32) {
+	key := make([]byte, key_len)
+	_, err := i.memory.ReadAt(key, int64(key_addr))
+	if err != nil {
+		return "", nil, XqdError
+	}
+
+	if options_mask&cacheLookupOptionsReserved != 0 {
+		i.abilog.Printf("%s: reserved option set", name)
+		return "", nil, XqdErrInvalidArgument
+	}
+
+	// LookupOptions is laid out as {request_headers: RequestHandle}
+	headers := http.Header{}
+	if options_mask&cacheLookupOptionsRequestHeaders != 0 {
+		rhandle := i.memory.Uint32(int64(options_addr))
+		r := i.requests.Get(int(rhandle))
+		if r == nil {
+			i.abilog.Printf("%s: invalid request handle=%d", name, rhandle)
+			return "", nil, XqdErrInvalidHandle
+		}
+		if r.Header != nil {
+			headers = r.Header
+		}
+	}
+
+	return string(key), headers, XqdStatusOK
+}
+
+// cacheWriteOptions builds a new object out of the write options in guest memory. If body is nil,
+// the object gets a new, empty body, and otherwise it shares the supplied body.
+// The name is used as a prefix for abi log messages.
+func (i *Instance) cacheWriteOptions(name string, options_mask int32, options_addr int32, body *cacheBody) (*cacheObject, int32) {
+	if options_mask&cacheWriteOptionsReserved != 0 {
+		i.abilog.Printf("%s: reserved option set", name)
+		return nil, XqdErrInvalidArgument
+	}
+
+	// WriteOptions is laid out as {max_age_ns: u64, request_headers: RequestHandle,
+	// vary_rule_ptr, vary_rule_len, initial_age_ns: u64, stale_while_revalidate_ns: u64,
+	// surrogate_keys_ptr, surrogate_keys_len, length: u64, user_metadata_ptr, user_metadata_len}
+	base := int64(options_addr)
+	obj := &cacheObject{
+		inserted: i.coreCache.now(),
+		maxAge:   time.Duration(i.memory.Uint64(base)),
+		vary:     http.Header{},
+		hits:     new(uint64),
+		body:     body,
+	}
+
+	headers := http.Header{}
+	if options_mask&cacheWriteOptionsRequestHeaders != 0 {
+		rhandle := i.memory.Uint32(base + 8)
+		r := i.requests.Get(int(rhandle))
+		if r == nil {
+			i.abilog.Printf("%s: invalid request handle=%d", name, rhandle)
+			return nil, XqdErrInvalidHandle
+		}
+		if r.Header != nil {
+			headers = r.Header
+		}
+	}
+
+	if options_mask&cacheWriteOptionsVaryRule != 0 {
+		rule := i.cacheString(base+12, base+16)
+		for _, h := range strings.Fields(rule) {
+			obj.vary[h] = headers.Values(h)
+		}
+	}
+
+	if options_mask&cacheWriteOptionsInitialAge != 0 {
+		obj.initialAge = time.Duration(i.memory.Uint64(base + 24))
+	}
+
+	if options_mask&cacheWriteOptionsSWR != 0 {
+		obj.swr = time.Duration(i.memory.Uint64(base + 32))
+	}
+
+	if options_mask&cacheWriteOptionsSurrogateKeys != 0 {
+		obj.surrogateKeys = strings.Fields(i.cacheString(base+40, base+44))
+	}
+
+	if obj.body == nil {
+		var length int64 = -1
+		if options_mask&cacheWriteOptionsLength != 0 {
+			length = int64(i.memory.Uint64(base + 48))
+		}
+		obj.body = newCacheBody(length)
+	}
+
+	if options_mask&cacheWriteOptionsUserMetadata != 0 {
+		obj.userMetadata = []byte(i.cacheString(base+56, base+60))
+	}
+
+	obj.sensitive = options_mask&cacheWriteOptionsSensitiveData != 0
+
+	return obj, XqdStatusOK
+}
+
+// cacheString reads a string out of guest memory, given the addresses of its pointer and length
+func (i *Instance) cacheString(ptr_addr int64, len_addr int64) string {
+	buf := make([]byte, i.memory.Uint32(len_addr))
+	i.memory.ReadAt(buf, int64(i.memory.Uint32(ptr_addr)))
+	return string(buf)
+}
+
+// cacheTransactionInsert completes the transaction for handle by inserting a new object built from
+// the write options
+// The name is used as a prefix for abi log messages.
+func (i *Instance) cacheTransactionInsert(name string, handle int32, options_mask int32, options_addr int32) (*CacheHandle, *cacheObject, int32) {
+	ch := i.caches.Get(int(handle))
+	if ch == nil {
+		i.abilog.Printf("%s: invalid handle=%d", name, handle)
+		return nil, nil, XqdErrInvalidHandle
+	}
+
+	if ch.tx == nil {
+		i.abilog.Printf("%s: handle=%d isn't responsible for inserting", name, handle)
+		return nil, nil, XqdErrInvalidArgument
+	}
+
+	obj, status := i.cacheWriteOptions(name, options_mask, options_addr, nil)
+	if status != XqdStatusOK {
+		return nil, nil, status
+	}
+
+	ch.tx.insert(obj)
+	ch.tx = nil
+
+	return ch, obj, XqdStatusOK
+}
+
+// cacheObject returns the object found by the lookup for handle
+// The name is used as a prefix for abi log messages.
+func (i *Instance) cacheObject(name string, handle int32) (*cacheObject, int32) {
+	ch := i.caches.Get(int(handle))
+	if ch == nil {
+		i.abilog.Printf("%s: invalid handle=%d", name, handle)
+		return nil, XqdErrInvalidHandle
+	}
+
+	if ch.object == nil {
+		i.abilog.Printf("%s: handle=%d found nothing", name, handle)
+		return nil, XqdErrNone
+	}
+
+	return ch.object, XqdStatusOK
+}
@@ -0,0 +1,33 @@
+package fastlike
+
+func (i *Instance) xqd_device_detection_lookup(ua_addr int32, ua_size int32, addr int32, size int32, nwritten_out int32) int32 {
+	var buf = make([]byte, ua_size)
+	var _, err = i.memory.ReadAt(buf, int64(ua_addr))
+	if err != nil {
+		return XqdError
+	}
+
+	var ua = string(buf)
+
+	i.abilog.Printf("device_detection_lookup: useragent=%s", ua)
+
+	value, ok := i.deviceLookup(ua)
+	if !ok {
+		i.memory.PutUint32(0, int64(nwritten_out))
+		return XqdErrNone
+	}
+
+	// If the data doesn't fit, the guest can try again with a bigger buffer
+	if len(value) > int(size) {
+		i.memory.PutUint32(uint32(len(value)), int64(nwritten_out))
+		return XqdErrBufferLength
+	}
+
+	nwritten, err := i.memory.WriteAt(value, int64(addr))
+	if err != nil {
+		return XqdError
+	}
+
+	i.memory.PutUint32(uint32(nwritten), int64(nwritten_out))
+	return XqdStatusOK
+}
@@ -36,7 +36,17 @@ func (i *Instance) xqd_dictionary_get(handle int32, key_addr int32, key_size int
 
 	i.abilog.Printf("dictionary_get: handle=%d key=%s", handle, key)
 
-	var value = lookup(key)
+	var value, ok = lookup(key)
+	if !ok {
+		i.memory.PutUint32(0, int64(nwritten_out))
+		return XqdErrNone
+	}
+
+	// If the value doesn't fit, the guest can try again with a bigger buffer
+	if len(value) > int(size) {
+		i.memory.PutUint32(uint32(len(value)), int64(nwritten_out))
+		return XqdErrBufferLength
+	}
 
 	nwritten, err := i.memory.WriteAt([]byte(value), int64(addr))
 	if err != nil {
@@ -46,3 +56,14 @@ func (i *Instance) xqd_dictionary_get(handle int32, key_addr int32, key_size int
 	i.memory.PutUint32(uint32(nwritten), int64(nwritten_out))
 	return XqdStatusOK
 }
+
+// Config stores are what dictionaries are called in newer SDKs. They share the same registry, so
+// guests can use either ABI to read the same data.
+
+func (i *Instance) xqd_config_store_open(name_addr int32, name_size int32, addr int32) int32 {
+	return i.xqd_dictionary_open(name_addr, name_size, addr)
+}
+
+func (i *Instance) xqd_config_store_get(handle int32, key_addr int32, key_size int32, addr int32, size int32, nwritten_out int32) int32 {
+	return i.xqd_dictionary_get(handle, key_addr, key_size, addr, size, nwritten_out)
+}
@@ -0,0 +1,109 @@
+package fastlike
+
+import "time"
+
+// erlString reads a rate counter, penalty box, or entry name from guest memory
+func (i *Instance) erlString(addr int32, size int32) (string, bool) {
+	var buf = make([]byte, size)
+	var _, err = i.memory.ReadAt(buf, int64(addr))
+	if err != nil {
+		return "", false
+	}
+	return string(buf), true
+}
+
+func (i *Instance) xqd_erl_check_rate(rc_addr int32, rc_size int32, entry_addr int32, entry_size int32, delta int32, window int32, limit int32, pb_addr int32, pb_size int32, ttl int32, blocked_out int32) int32 {
+	rc, ok1 := i.erlString(rc_addr, rc_size)
+	entry, ok2 := i.erlString(entry_addr, entry_size)
+	pb, ok3 := i.erlString(pb_addr, pb_size)
+	if !ok1 || !ok2 || !ok3 {
+		return XqdError
+	}
+
+	blocked := i.rateLimiter.CheckRate(rc, entry, uint32(delta), uint32(window), uint32(limit), pb, time.Duration(ttl)*time.Second)
+
+	i.abilog.Printf("erl_check_rate: ratecounter=%s entry=%s delta=%d window=%d limit=%d penaltybox=%s ttl=%d blocked=%t",
+		rc, entry, delta, window, limit, pb, ttl, blocked)
+
+	if blocked {
+		i.memory.PutUint32(1, int64(blocked_out))
+	} else {
+		i.memory.PutUint32(0, int64(blocked_out))
+	}
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_erl_ratecounter_increment(rc_addr int32, rc_size int32, entry_addr int32, entry_size int32, delta int32) int32 {
+	rc, ok1 := i.erlString(rc_addr, rc_size)
+	entry, ok2 := i.erlString(entry_addr, entry_size)
+	if !ok1 || !ok2 {
+		return XqdError
+	}
+
+	i.abilog.Printf("erl_ratecounter_increment: ratecounter=%s entry=%s delta=%d", rc, entry, delta)
+
+	i.rateLimiter.Increment(rc, entry, uint32(delta))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_erl_ratecounter_lookup_rate(rc_addr int32, rc_size int32, entry_addr int32, entry_size int32, window int32, rate_out int32) int32 {
+	rc, ok1 := i.erlString(rc_addr, rc_size)
+	entry, ok2 := i.erlString(entry_addr, entry_size)
+	if !ok1 || !ok2 {
+		return XqdError
+	}
+
+	rate := i.rateLimiter.Rate(rc, entry, uint32(window))
+
+	i.abilog.Printf("erl_ratecounter_lookup_rate: ratecounter=%s entry=%s window=%d rate=%d", rc, entry, window, rate)
+
+	i.memory.PutUint32(rate, int64(rate_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_erl_ratecounter_lookup_count(rc_addr int32, rc_size int32, entry_addr int32, entry_size int32, duration int32, count_out int32) int32 {
+	rc, ok1 := i.erlString(rc_addr, rc_size)
+	entry, ok2 := i.erlString(entry_addr, entry_size)
+	if !ok1 || !ok2 {
+		return XqdError
+	}
+
+	count := i.rateLimiter.Count(rc, entry, uint32(duration))
+
+	i.abilog.Printf("erl_ratecounter_lookup_count: ratecounter=%s entry=%s duration=%d count=%d", rc, entry, duration, count)
+
+	i.memory.PutUint32(count, int64(count_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_erl_penaltybox_add(pb_addr int32, pb_size int32, entry_addr int32, entry_size int32, ttl int32) int32 {
+	pb, ok1 := i.erlString(pb_addr, pb_size)
+	entry, ok2 := i.erlString(entry_addr, entry_size)
+	if !ok1 || !ok2 {
+		return XqdError
+	}
+
+	i.abilog.Printf("erl_penaltybox_add: penaltybox=%s entry=%s ttl=%d", pb, entry, ttl)
+
+	i.rateLimiter.PenaltyBoxAdd(pb, entry, time.Duration(ttl)*time.Second)
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_erl_penaltybox_has(pb_addr int32, pb_size int32, entry_addr int32, entry_size int32, has_out int32) int32 {
+	pb, ok1 := i.erlString(pb_addr, pb_size)
+	entry, ok2 := i.erlString(entry_addr, entry_size)
+	if !ok1 || !ok2 {
+		return XqdError
+	}
+
+	has := i.rateLimiter.PenaltyBoxHas(pb, entry)
+
+	i.abilog.Printf("erl_penaltybox_has: penaltybox=%s entry=%s has=%t", pb, entry, has)
+
+	if has {
+		i.memory.PutUint32(1, int64(has_out))
+	} else {
+		i.memory.PutUint32(0, int64(has_out))
+	}
+	return XqdStatusOK
+}
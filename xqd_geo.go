@@ -0,0 +1,41 @@
+package fastlike
+
+import (
+	"encoding/json"
+	"net"
+)
+
+func (i *Instance) xqd_geo_lookup(addr_octets int32, addr_len int32, addr int32, size int32, nwritten_out int32) int32 {
+	// Addresses are passed as their raw octets, so the length says whether it's IPv4 or IPv6
+	if addr_len != net.IPv4len && addr_len != net.IPv6len {
+		i.abilog.Printf("geo_lookup: invalid address length=%d", addr_len)
+		return XqdErrInvalidArgument
+	}
+
+	var ip = make(net.IP, addr_len)
+	var _, err = i.memory.ReadAt(ip, int64(addr_octets))
+	if err != nil {
+		return XqdError
+	}
+
+	i.abilog.Printf("geo_lookup: ip=%s", ip)
+
+	value, err := json.Marshal(i.geolookup(ip))
+	if err != nil {
+		return XqdError
+	}
+
+	// If the data doesn't fit, the guest can try again with a bigger buffer
+	if len(value) > int(size) {
+		i.memory.PutUint32(uint32(len(value)), int64(nwritten_out))
+		return XqdErrBufferLength
+	}
+
+	nwritten, err := i.memory.WriteAt(value, int64(addr))
+	if err != nil {
+		return XqdError
+	}
+
+	i.memory.PutUint32(uint32(nwritten), int64(nwritten_out))
+	return XqdStatusOK
+}
@@ -0,0 +1,548 @@
+package fastlike
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Error codes reported to guests by the fastly_kv_store hostcalls
+const (
+	kvErrorOk                 uint32 = 1
+	kvErrorBadRequest         uint32 = 2
+	kvErrorNotFound           uint32 = 3
+	kvErrorPreconditionFailed uint32 = 4
+	kvErrorPayloadTooLarge    uint32 = 5
+	kvErrorInternal           uint32 = 6
+)
+
+// Option bits for fastly_kv_store inserts
+const (
+	kvInsertConfigReserved          = 1 << 0
+	kvInsertConfigBackgroundFetch   = 1 << 1
+	kvInsertConfigIfGenerationMatch = 1 << 2
+	kvInsertConfigMetadata          = 1 << 3
+	kvInsertConfigTTL               = 1 << 4
+)
+
+// Option bits for fastly_kv_store lists
+const (
+	kvListConfigReserved = 1 << 0
+	kvListConfigCursor   = 1 << 1
+	kvListConfigLimit    = 1 << 2
+	kvListConfigPrefix   = 1 << 3
+)
+
+// Limits on KV store keys and values, the same as Fastly's
+const (
+	kvMaxKeyLength    = 1024
+	kvMaxValueSize    = 25 * 1024 * 1024
+	kvDefaultPageSize = 100
+)
+
+var (
+	errKVInvalidKey      = errors.New("kv store: invalid key")
+	errKVPayloadTooLarge = errors.New("kv store: value too large")
+)
+
+// kvError converts the result of a KV store operation into the error code reported to the guest
+func kvError(err error) uint32 {
+	switch err {
+	case nil:
+		return kvErrorOk
+	case ErrKVNotFound:
+		return kvErrorNotFound
+	case ErrKVPreconditionFailed:
+		return kvErrorPreconditionFailed
+	case errKVInvalidKey:
+		return kvErrorBadRequest
+	case errKVPayloadTooLarge:
+		return kvErrorPayloadTooLarge
+	}
+	return kvErrorInternal
+}
+
+// validateKVKey checks key against the same rules Fastly uses
+func validateKVKey(key string) error {
+	if key == "" || len(key) > kvMaxKeyLength || key == "." || key == ".." ||
+		strings.ContainsAny(key, "\r\n") || strings.HasPrefix(key, ".well-known/acme-challenge/") {
+		return errKVInvalidKey
+	}
+	return nil
+}
+
+// kvStoreArgs reads a key out of guest memory along with the store it's for
+// The name is used as a prefix for abi log messages.
+func (i *Instance) kvStoreArgs(name string, handle int32, key_addr int32, key_len int32) (KVStore, string, int32) {
+	store := i.getKVStore(int(handle))
+	if store == nil {
+		i.abilog.Printf("%s: invalid store handle=%d", name, handle)
+		return nil, "", XqdErrInvalidHandle
+	}
+
+	buf := make([]byte, key_len)
+	_, err := i.memory.ReadAt(buf, int64(key_addr))
+	if err != nil {
+		return nil, "", XqdError
+	}
+
+	return store, string(buf), XqdStatusOK
+}
+
+// kvLookup looks up key in store
+func kvLookup(store KVStore, key string) *KVPending {
+	if err := validateKVKey(key); err != nil {
+		return &KVPending{err: err}
+	}
+
+	entry, err := store.Lookup(key)
+	return &KVPending{entry: entry, err: err}
+}
+
+// kvInsert reads the value out of a body handle, consuming it, and inserts it into store
+func (i *Instance) kvInsert(store KVStore, key string, body_handle int32, opts KVInsertOptions) (*KVPending, int32) {
+	body := i.bodies.Get(int(body_handle))
+	if body == nil {
+		return nil, XqdErrInvalidHandle
+	}
+
+	value, err := ioutil.ReadAll(body)
+	i.bodies.Close(int(body_handle))
+	if err != nil {
+		return nil, XqdError
+	}
+
+	if err := validateKVKey(key); err != nil {
+		return &KVPending{err: err}, XqdStatusOK
+	}
+
+	if len(value) > kvMaxValueSize {
+		return &KVPending{err: errKVPayloadTooLarge}, XqdStatusOK
+	}
+
+	return &KVPending{err: store.Insert(key, value, opts)}, XqdStatusOK
+}
+
+// kvDelete deletes key from store
+func kvDelete(store KVStore, key string) *KVPending {
+	if err := validateKVKey(key); err != nil {
+		return &KVPending{err: err}
+	}
+
+	return &KVPending{err: store.Delete(key)}
+}
+
+// kvBody creates a body handle for the value of a KV store entry
+func (i *Instance) kvBody(entry KVEntry) int {
+	bhid, bh := i.bodies.NewReader(ioutil.NopCloser(bytes.NewReader(entry.Value)))
+	bh.length = int64(len(entry.Value))
+	return bhid
+}
+
+func (i *Instance) xqd_kv_store_open(name_addr int32, name_size int32, handle_out int32) int32 {
+	buf := make([]byte, name_size)
+	_, err := i.memory.ReadAt(buf, int64(name_addr))
+	if err != nil {
+		return XqdError
+	}
+
+	name := string(buf)
+	handle := i.getKVStoreHandle(name)
+
+	i.abilog.Printf("kv_store_open: name=%q handle=%d", name, handle)
+
+	if handle == HandleInvalid {
+		return XqdErrInvalidArgument
+	}
+
+	i.memory.PutUint32(uint32(handle), int64(handle_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_kv_store_lookup(handle int32, key_addr int32, key_len int32, config_mask int32, config_addr int32, handle_out int32) int32 {
+	store, key, status := i.kvStoreArgs("kv_store_lookup", handle, key_addr, key_len)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	khid := i.kvPending.New(kvLookup(store, key))
+
+	i.abilog.Printf("kv_store_lookup: store=%d key=%q handle=%d", handle, key, khid)
+
+	i.memory.PutUint32(uint32(khid), int64(handle_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_kv_store_lookup_wait(handle int32, body_out int32, metadata_addr int32, metadata_len int32, nwritten_out int32, generation_out int32, kv_error_out int32) int32 {
+	return i.kvStoreLookupWait("kv_store_lookup_wait", handle, body_out, metadata_addr, metadata_len, nwritten_out, kv_error_out, func(generation uint64) {
+		i.memory.PutUint32(uint32(generation), int64(generation_out))
+	})
+}
+
+func (i *Instance) xqd_kv_store_lookup_wait_v2(handle int32, body_out int32, metadata_addr int32, metadata_len int32, nwritten_out int32, generation_out int32, kv_error_out int32) int32 {
+	return i.kvStoreLookupWait("kv_store_lookup_wait_v2", handle, body_out, metadata_addr, metadata_len, nwritten_out, kv_error_out, func(generation uint64) {
+		i.memory.PutUint64(generation, int64(generation_out))
+	})
+}
+
+// kvStoreLookupWait hands the result of a lookup to the guest. The two versions of lookup_wait only
+// differ in the size of the generation, so they each supply a function to write it out.
+// The name is used as a prefix for abi log messages.
+func (i *Instance) kvStoreLookupWait(name string, handle int32, body_out int32, metadata_addr int32, metadata_len int32, nwritten_out int32, kv_error_out int32, putGeneration func(uint64)) int32 {
+	kp := i.kvPending.Get(int(handle))
+	if kp == nil {
+		i.abilog.Printf("%s: invalid handle=%d", name, handle)
+		return XqdErrInvalidHandle
+	}
+
+	i.abilog.Printf("%s: handle=%d kv_error=%d", name, handle, kvError(kp.err))
+
+	i.memory.PutUint32(kvError(kp.err), int64(kv_error_out))
+	if kp.err != nil {
+		i.kvPending.Complete(int(handle))
+		i.memory.PutUint32(HandleInvalid, int64(body_out))
+		return XqdStatusOK
+	}
+
+	// If the metadata doesn't fit, the guest can try again with a bigger buffer
+	if len(kp.entry.Metadata) > int(metadata_len) {
+		i.memory.PutUint32(uint32(len(kp.entry.Metadata)), int64(nwritten_out))
+		return XqdErrBufferLength
+	}
+
+	i.kvPending.Complete(int(handle))
+
+	nwritten, err := i.memory.WriteAt([]byte(kp.entry.Metadata), int64(metadata_addr))
+	if err != nil {
+		return XqdError
+	}
+
+	i.memory.PutUint32(uint32(nwritten), int64(nwritten_out))
+	putGeneration(kp.entry.Generation)
+	i.memory.PutUint32(uint32(i.kvBody(kp.entry)), int64(body_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_kv_store_insert(handle int32, key_addr int32, key_len int32, body_handle int32, config_mask int32, config_addr int32, handle_out int32) int32 {
+	store, key, status := i.kvStoreArgs("kv_store_insert", handle, key_addr, key_len)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	if config_mask&kvInsertConfigReserved != 0 {
+		return XqdErrInvalidArgument
+	}
+
+	// InsertConfig is laid out as {mode: u32, unused: u32, metadata_ptr, metadata_len,
+	// time_to_live_sec: u32, if_generation_match: u64}
+	base := int64(config_addr)
+	opts := KVInsertOptions{Mode: KVInsertMode(i.memory.Uint32(base))}
+
+	if config_mask&kvInsertConfigMetadata != 0 {
+		buf := make([]byte, i.memory.Uint32(base+12))
+		i.memory.ReadAt(buf, int64(i.memory.Uint32(base+8)))
+		opts.Metadata = string(buf)
+	}
+
+	if config_mask&kvInsertConfigTTL != 0 {
+		opts.TTL = time.Duration(i.memory.Uint32(base+16)) * time.Second
+	}
+
+	if config_mask&kvInsertConfigIfGenerationMatch != 0 {
+		generation := i.memory.Uint64(base + 24)
+		opts.IfGenerationMatch = &generation
+	}
+
+	kp, status := i.kvInsert(store, key, body_handle, opts)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	khid := i.kvPending.New(kp)
+
+	i.abilog.Printf("kv_store_insert: store=%d key=%q mode=%d handle=%d", handle, key, opts.Mode, khid)
+
+	i.memory.PutUint32(uint32(khid), int64(handle_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_kv_store_insert_wait(handle int32, kv_error_out int32) int32 {
+	return i.kvStoreWait("kv_store_insert_wait", handle, kv_error_out)
+}
+
+func (i *Instance) xqd_kv_store_delete(handle int32, key_addr int32, key_len int32, config_mask int32, config_addr int32, handle_out int32) int32 {
+	store, key, status := i.kvStoreArgs("kv_store_delete", handle, key_addr, key_len)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	khid := i.kvPending.New(kvDelete(store, key))
+
+	i.abilog.Printf("kv_store_delete: store=%d key=%q handle=%d", handle, key, khid)
+
+	i.memory.PutUint32(uint32(khid), int64(handle_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_kv_store_delete_wait(handle int32, kv_error_out int32) int32 {
+	return i.kvStoreWait("kv_store_delete_wait", handle, kv_error_out)
+}
+
+// kvStoreWait hands the result of an operation without any other output to the guest
+// The name is used as a prefix for abi log messages.
+func (i *Instance) kvStoreWait(name string, handle int32, kv_error_out int32) int32 {
+	kp := i.kvPending.Get(int(handle))
+	if kp == nil {
+		i.abilog.Printf("%s: invalid handle=%d", name, handle)
+		return XqdErrInvalidHandle
+	}
+
+	i.kvPending.Complete(int(handle))
+
+	i.abilog.Printf("%s: handle=%d kv_error=%d", name, handle, kvError(kp.err))
+
+	i.memory.PutUint32(kvError(kp.err), int64(kv_error_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_kv_store_list(handle int32, config_mask int32, config_addr int32, handle_out int32) int32 {
+	store := i.getKVStore(int(handle))
+	if store == nil {
+		i.abilog.Printf("kv_store_list: invalid store handle=%d", handle)
+		return XqdErrInvalidHandle
+	}
+
+	if config_mask&kvListConfigReserved != 0 {
+		return XqdErrInvalidArgument
+	}
+
+	// ListConfig is laid out as {mode: u32, cursor_ptr, cursor_len, limit: u32, prefix_ptr,
+	// prefix_len}
+	base := int64(config_addr)
+	var cursor, prefix string
+	limit := kvDefaultPageSize
+
+	if config_mask&kvListConfigCursor != 0 {
+		buf := make([]byte, i.memory.Uint32(base+8))
+		i.memory.ReadAt(buf, int64(i.memory.Uint32(base+4)))
+		cursor = string(buf)
+	}
+
+	if config_mask&kvListConfigLimit != 0 && i.memory.Uint32(base+12) > 0 {
+		limit = int(i.memory.Uint32(base + 12))
+	}
+
+	if config_mask&kvListConfigPrefix != 0 {
+		buf := make([]byte, i.memory.Uint32(base+20))
+		i.memory.ReadAt(buf, int64(i.memory.Uint32(base+16)))
+		prefix = string(buf)
+	}
+
+	khid := i.kvPending.New(kvList(store, prefix, cursor, limit))
+
+	i.abilog.Printf("kv_store_list: store=%d prefix=%q cursor=%q limit=%d handle=%d", handle, prefix, cursor, limit, khid)
+
+	i.memory.PutUint32(uint32(khid), int64(handle_out))
+	return XqdStatusOK
+}
+
+// kvList lists a page of keys from store, in the same JSON format Fastly uses. The cursor is the
+// last key of the previous page.
+func kvList(store KVStore, prefix string, cursor string, limit int) *KVPending {
+	keys, err := store.List(prefix)
+	if err != nil {
+		return &KVPending{err: err}
+	}
+
+	if cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return &KVPending{err: errKVInvalidKey}
+		}
+
+		start := sort.SearchStrings(keys, string(after))
+		if start < len(keys) && keys[start] == string(after) {
+			start++
+		}
+		keys = keys[start:]
+	}
+
+	meta := map[string]interface{}{
+		"limit":  limit,
+		"prefix": prefix,
+		"mode":   "strong",
+	}
+
+	if len(keys) > limit {
+		keys = keys[:limit]
+		meta["next_cursor"] = base64.RawURLEncoding.EncodeToString([]byte(keys[len(keys)-1]))
+	}
+
+	list, err := json.Marshal(map[string]interface{}{"data": keys, "meta": meta})
+	return &KVPending{list: list, err: err}
+}
+
+func (i *Instance) xqd_kv_store_list_wait(handle int32, body_out int32, kv_error_out int32) int32 {
+	kp := i.kvPending.Get(int(handle))
+	if kp == nil {
+		i.abilog.Printf("kv_store_list_wait: invalid handle=%d", handle)
+		return XqdErrInvalidHandle
+	}
+
+	i.kvPending.Complete(int(handle))
+
+	i.abilog.Printf("kv_store_list_wait: handle=%d kv_error=%d", handle, kvError(kp.err))
+
+	i.memory.PutUint32(kvError(kp.err), int64(kv_error_out))
+	if kp.err != nil {
+		i.memory.PutUint32(HandleInvalid, int64(body_out))
+		return XqdStatusOK
+	}
+
+	i.memory.PutUint32(uint32(i.kvBody(KVEntry{Value: kp.list})), int64(body_out))
+	return XqdStatusOK
+}
+
+// The fastly_object_store module is the original version of the KV store API, which reports errors
+// using status codes rather than KV errors.
+
+// objectStoreStatus converts the result of a KV store operation into a status for the guest
+func objectStoreStatus(err error) int32 {
+	switch err {
+	case nil, ErrKVNotFound:
+		return XqdStatusOK
+	case errKVInvalidKey, errKVPayloadTooLarge:
+		return XqdErrInvalidArgument
+	}
+	return XqdError
+}
+
+func (i *Instance) xqd_object_store_open(name_addr int32, name_size int32, handle_out int32) int32 {
+	return i.xqd_kv_store_open(name_addr, name_size, handle_out)
+}
+
+func (i *Instance) xqd_object_store_lookup(handle int32, key_addr int32, key_len int32, body_out int32) int32 {
+	store, key, status := i.kvStoreArgs("object_store_lookup", handle, key_addr, key_len)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	i.abilog.Printf("object_store_lookup: store=%d key=%q", handle, key)
+
+	return i.objectStoreLookupResult(kvLookup(store, key), body_out)
+}
+
+func (i *Instance) xqd_object_store_lookup_async(handle int32, key_addr int32, key_len int32, pending_out int32) int32 {
+	store, key, status := i.kvStoreArgs("object_store_lookup_async", handle, key_addr, key_len)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	khid := i.kvPending.New(kvLookup(store, key))
+
+	i.abilog.Printf("object_store_lookup_async: store=%d key=%q handle=%d", handle, key, khid)
+
+	i.memory.PutUint32(uint32(khid), int64(pending_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_object_store_pending_lookup_wait(handle int32, body_out int32) int32 {
+	kp := i.kvPending.Get(int(handle))
+	if kp == nil {
+		i.abilog.Printf("object_store_pending_lookup_wait: invalid handle=%d", handle)
+		return XqdErrInvalidHandle
+	}
+
+	i.kvPending.Complete(int(handle))
+	return i.objectStoreLookupResult(kp, body_out)
+}
+
+// objectStoreLookupResult hands the result of a lookup to the guest. Keys which don't exist get an
+// invalid body handle.
+func (i *Instance) objectStoreLookupResult(kp *KVPending, body_out int32) int32 {
+	if kp.err != nil {
+		i.memory.PutUint32(HandleInvalid, int64(body_out))
+		return objectStoreStatus(kp.err)
+	}
+
+	i.memory.PutUint32(uint32(i.kvBody(kp.entry)), int64(body_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_object_store_insert(handle int32, key_addr int32, key_len int32, body_handle int32) int32 {
+	store, key, status := i.kvStoreArgs("object_store_insert", handle, key_addr, key_len)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	kp, status := i.kvInsert(store, key, body_handle, KVInsertOptions{})
+	if status != XqdStatusOK {
+		return status
+	}
+
+	i.abilog.Printf("object_store_insert: store=%d key=%q", handle, key)
+
+	return objectStoreStatus(kp.err)
+}
+
+func (i *Instance) xqd_object_store_insert_async(handle int32, key_addr int32, key_len int32, body_handle int32, pending_out int32) int32 {
+	store, key, status := i.kvStoreArgs("object_store_insert_async", handle, key_addr, key_len)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	kp, status := i.kvInsert(store, key, body_handle, KVInsertOptions{})
+	if status != XqdStatusOK {
+		return status
+	}
+
+	khid := i.kvPending.New(kp)
+
+	i.abilog.Printf("object_store_insert_async: store=%d key=%q handle=%d", handle, key, khid)
+
+	i.memory.PutUint32(uint32(khid), int64(pending_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_object_store_pending_insert_wait(handle int32) int32 {
+	return i.objectStoreWait("object_store_pending_insert_wait", handle)
+}
+
+func (i *Instance) xqd_object_store_delete_async(handle int32, key_addr int32, key_len int32, pending_out int32) int32 {
+	store, key, status := i.kvStoreArgs("object_store_delete_async", handle, key_addr, key_len)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	khid := i.kvPending.New(kvDelete(store, key))
+
+	i.abilog.Printf("object_store_delete_async: store=%d key=%q handle=%d", handle, key, khid)
+
+	i.memory.PutUint32(uint32(khid), int64(pending_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_object_store_pending_delete_wait(handle int32) int32 {
+	return i.objectStoreWait("object_store_pending_delete_wait", handle)
+}
+
+// objectStoreWait hands the result of an operation without any other output to the guest
+// The name is used as a prefix for abi log messages.
+func (i *Instance) objectStoreWait(name string, handle int32) int32 {
+	kp := i.kvPending.Get(int(handle))
+	if kp == nil {
+		i.abilog.Printf("%s: invalid handle=%d", name, handle)
+		return XqdErrInvalidHandle
+	}
+
+	i.kvPending.Complete(int(handle))
+
+	i.abilog.Printf("%s: handle=%d", name, handle)
+
+	return objectStoreStatus(kp.err)
+}
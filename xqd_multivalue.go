@@ -30,7 +30,9 @@ func xqd_multivalue(memory *Memory, data []string, addr int32, maxlen int32, cur
 	v = append(v, '\x00')
 
 	nwritten, err := memory.WriteAt(v, int64(addr))
-	check(err)
+	if err != nil {
+		return XqdError
+	}
 
 	memory.PutUint32(uint32(nwritten), int64(nwritten_out))
 
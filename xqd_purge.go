@@ -0,0 +1,65 @@
+package fastlike
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// Option bits for purge_surrogate_key
+const (
+	purgeOptionsSoftPurge = 1 << 0
+	purgeOptionsRetBuf    = 1 << 1
+)
+
+// purgeCount is used to give each purge a unique id
+var purgeCount uint64
+
+func (i *Instance) xqd_purge_surrogate_key(sk_addr int32, sk_len int32, options_mask int32, options_addr int32) int32 {
+	buf := make([]byte, sk_len)
+	_, err := i.memory.ReadAt(buf, int64(sk_addr))
+	if err != nil {
+		return XqdError
+	}
+
+	key := string(buf)
+	soft := options_mask&purgeOptionsSoftPurge != 0
+
+	purged := i.coreCache.purgeSurrogateKey(key, soft)
+	if i.cache != nil {
+		purged += i.cache.PurgeSurrogateKey(key, soft)
+	}
+
+	i.abilog.Printf("purge_surrogate_key: key=%q soft=%t purged=%d", key, soft, purged)
+
+	if options_mask&purgeOptionsRetBuf == 0 {
+		return XqdStatusOK
+	}
+
+	// The guest wants the same JSON the Fastly API responds with. PurgeOptions is laid out as
+	// {ret_buf_ptr, ret_buf_len, ret_buf_nwritten_out}.
+	var (
+		ret_buf_ptr          = int64(i.memory.Uint32(int64(options_addr)))
+		ret_buf_len          = int(i.memory.Uint32(int64(options_addr) + 4))
+		ret_buf_nwritten_out = int64(i.memory.Uint32(int64(options_addr) + 8))
+	)
+
+	id := atomic.AddUint64(&purgeCount, 1)
+	ret, _ := json.Marshal(map[string]string{
+		"status": "ok",
+		"id":     fmt.Sprintf("fastlike-%d", id),
+	})
+
+	if len(ret) > ret_buf_len {
+		i.memory.PutUint32(uint32(len(ret)), ret_buf_nwritten_out)
+		return XqdErrBufferLength
+	}
+
+	nwritten, err := i.memory.WriteAt(ret, ret_buf_ptr)
+	if err != nil {
+		return XqdError
+	}
+
+	i.memory.PutUint32(uint32(nwritten), ret_buf_nwritten_out)
+	return XqdStatusOK
+}
@@ -4,10 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
-	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"sort"
 	"strings"
+	"time"
 )
 
 func (i *Instance) xqd_req_version_get(handle int32, version_out int32) int32 {
@@ -38,24 +39,42 @@ func (i *Instance) xqd_req_version_set(handle int32, version int32) int32 {
 }
 
 func (i *Instance) xqd_req_cache_override_set(handle int32, tag int32, ttl int32, swr int32) int32 {
-	// We don't actually *do* anything with cache overrides, since we don't have or need a cache.
-
-	if i.requests.Get(int(handle)) == nil {
+	// Cache overrides only make a difference when there's a cache configured with WithCache
+	r := i.requests.Get(int(handle))
+	if r == nil {
 		i.abilog.Printf("req_cache_override_set: invalid handle %d", handle)
 		return XqdErrInvalidHandle
 	}
 
+	i.abilog.Printf("req_cache_override_set: handle=%d tag=%d ttl=%d swr=%d", handle, tag, ttl, swr)
+
+	r.fastlyMeta.overrideTag = uint32(tag)
+	r.fastlyMeta.overrideTTL = uint32(ttl)
+	r.fastlyMeta.overrideSWR = uint32(swr)
+
 	return XqdStatusOK
 }
 
 func (i *Instance) xqd_req_cache_override_v2_set(handle int32, tag int32, ttl int32, swr int32, sk int32, sk_len int32) int32 {
-	// We don't actually *do* anything with cache overrides, since we don't have or need a cache.
-
-	if i.requests.Get(int(handle)) == nil {
+	r := i.requests.Get(int(handle))
+	if r == nil {
 		i.abilog.Printf("req_cache_override_v2_set: invalid handle %d", handle)
 		return XqdErrInvalidHandle
 	}
 
+	buf := make([]byte, sk_len)
+	_, err := i.memory.ReadAt(buf, int64(sk))
+	if err != nil {
+		return XqdError
+	}
+
+	i.abilog.Printf("req_cache_override_v2_set: handle=%d tag=%d ttl=%d swr=%d sk=%q", handle, tag, ttl, swr, buf)
+
+	r.fastlyMeta.overrideTag = uint32(tag)
+	r.fastlyMeta.overrideTTL = uint32(ttl)
+	r.fastlyMeta.overrideSWR = uint32(swr)
+	r.fastlyMeta.surrogateKeys = string(buf)
+
 	return XqdStatusOK
 }
 
@@ -295,31 +314,81 @@ func (i *Instance) xqd_req_new(handle_out int32) int32 {
 func (i *Instance) xqd_req_send(rhandle int32, bhandle int32, backend_addr, backend_size int32, wh_out int32, bh_out int32) int32 {
 	// sends the request described by (rh, bh) to the backend
 	// expects a response handle and response body handle
+	req, backend, status := i.subrequest("req_send", rhandle, bhandle, backend_addr, backend_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	unblock := i.meter.block()
+	w := i.send(backend, i.backendHandler(backend), req, i.requests.Get(int(rhandle)).fastlyMeta)
+	unblock()
+
+	whid, bhid := i.addResponse(w)
+
+	i.abilog.Printf("req_send: response handle=%d body=%d", whid, bhid)
+
+	i.memory.PutUint32(uint32(whid), int64(wh_out))
+	i.memory.PutUint32(uint32(bhid), int64(bh_out))
+
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_req_send_async(rhandle int32, bhandle int32, backend_addr, backend_size int32, ph_out int32) int32 {
+	req, backend, status := i.subrequest("req_send_async", rhandle, bhandle, backend_addr, backend_size)
+	if status != XqdStatusOK {
+		return status
+	}
+
+	// The guest is free to change the request once it's been sent, so hold on to a copy of its settings
+	meta := *i.requests.Get(int(rhandle)).fastlyMeta
+	handler := i.backendHandler(backend)
+	phid, ph := i.pending.New()
+
+	// The backend runs in its own goroutine, and the guest collects the response using one of the
+	// pending_req_* methods. Handles are only created on the guest's side of things, so we don't
+	// need any locking around the handle lists.
+	go func() {
+		ph.resp = i.send(backend, handler, req, &meta)
+		close(ph.done)
+	}()
+
+	i.abilog.Printf("req_send_async: pending handle=%d", phid)
+
+	i.memory.PutUint32(uint32(phid), int64(ph_out))
+
+	return XqdStatusOK
+}
+
+// subrequest reads the backend name out of guest memory and converts the request described by
+// (rhandle, bhandle) into an *http.Request which can be sent to that backend.
+// The name is used as a prefix for abi log messages.
+func (i *Instance) subrequest(name string, rhandle, bhandle, backend_addr, backend_size int32) (*http.Request, string, int32) {
 	r := i.requests.Get(int(rhandle))
 	if r == nil {
-		i.abilog.Printf("req_send: invalid request handle=%d", rhandle)
-		return XqdErrInvalidHandle
+		i.abilog.Printf("%s: invalid request handle=%d", name, rhandle)
+		return nil, "", XqdErrInvalidHandle
 	}
 
 	b := i.bodies.Get(int(bhandle))
 	if b == nil {
-		i.abilog.Printf("req_send: invalid body handle=%d", bhandle)
-		return XqdErrInvalidHandle
+		i.abilog.Printf("%s: invalid body handle=%d", name, bhandle)
+		return nil, "", XqdErrInvalidHandle
 	}
 
 	buf := make([]byte, backend_size)
 	_, err := i.memory.ReadAt(buf, int64(backend_addr))
 	if err != nil {
-		return XqdError
+		return nil, "", XqdError
 	}
 
 	backend := string(buf)
 
-	i.abilog.Printf("req_send: handle=%d body=%d backend=%q uri=%q", rhandle, bhandle, backend, r.URL)
+	i.abilog.Printf("%s: handle=%d body=%d backend=%q uri=%q", name, rhandle, bhandle, backend, r.URL)
 
-	req, err := http.NewRequest(r.Method, r.URL.String(), b)
+	// Subrequests are abandoned if the guest runs into its execution limits while waiting on them
+	req, err := http.NewRequestWithContext(i.meter.Context(), r.Method, r.URL.String(), b)
 	if err != nil {
-		return XqdErrHttpUserInvalid
+		return nil, "", XqdErrHttpUserInvalid
 	}
 
 	req.Header = r.Header.Clone()
@@ -332,44 +401,272 @@ func (i *Instance) xqd_req_send(rhandle int32, bhandle int32, backend_addr, back
 	// Make sure to add a CDN-Loop header, which we can check (and block) at ingress
 	req.Header.Add("cdn-loop", "fastlike")
 
-	// TODO: Not sure if this is strictly necessary (or correct!)
-	if req.Header.Get("content-length") == "" {
-		req.Header.Add("content-length", fmt.Sprintf("%d", b.Size()))
-		req.ContentLength = b.Size()
-	} else if req.ContentLength <= 0 {
-		req.ContentLength = b.Size()
-	}
-
-	// If the backend is geolocation, we select the geobackend explicitly
-	var handler http.Handler
-	if backend == "geolocation" {
-		handler = geoHandler(i.geolookup)
+	// The body handle knows how big it is (or that it doesn't know), which takes precedence over any
+	// content-length header from the guest. Bodies of unknown size are sent chunked.
+	req.ContentLength = b.Size()
+	if req.ContentLength >= 0 {
+		req.Header.Set("content-length", fmt.Sprintf("%d", req.ContentLength))
 	} else {
-		handler = i.getBackend(backend)
+		req.Header.Del("content-length")
 	}
 
-	// TODO: Is there a better way to get an *http.Response from an http.Handler?
-	// The Handler interface is useful for embedders, since often-times they'll be processing wasm
-	// requests in the embedding application, and it's very easy to adapt an http.Handler to an
-	// http.RoundTripper if they want it to go offsite.
-	wr := httptest.NewRecorder()
-	handler.ServeHTTP(wr, req)
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
 
-	w := wr.Result()
+	return req, backend, XqdStatusOK
+}
 
-	// Convert the response into an (rh, bh) pair, put them in the list, and write out the handles
+// addResponse converts a backend response into an (rh, bh) pair, puts them in the handle lists, and
+// returns their ids
+func (i *Instance) addResponse(w *http.Response) (int, int) {
 	whid, wh := i.responses.New()
 	wh.Status = w.Status
 	wh.StatusCode = w.StatusCode
 	wh.Header = w.Header.Clone()
 	wh.Body = w.Body
 
-	bhid, _ := i.bodies.NewReader(wh.Body)
+	bhid, bh := i.bodies.NewReader(wh.Body)
+	bh.length = w.ContentLength
 
-	i.abilog.Printf("req_send: response handle=%d body=%d", whid, bhid)
+	return whid, bhid
+}
+
+func (i *Instance) xqd_pending_req_poll(phandle int32, is_done_out int32, wh_out int32, bh_out int32) int32 {
+	ph := i.pending.Get(int(phandle))
+	if ph == nil {
+		i.abilog.Printf("pending_req_poll: invalid pending handle=%d", phandle)
+		return XqdErrInvalidHandle
+	}
+
+	if !ph.Done() {
+		i.abilog.Printf("pending_req_poll: handle=%d done=false", phandle)
+		i.memory.PutUint32(0, int64(is_done_out))
+		i.memory.PutUint32(HandleInvalid, int64(wh_out))
+		i.memory.PutUint32(HandleInvalid, int64(bh_out))
+		return XqdStatusOK
+	}
 
+	i.pending.Complete(int(phandle))
+	whid, bhid := i.addResponse(ph.resp)
+
+	i.abilog.Printf("pending_req_poll: handle=%d done=true response handle=%d body=%d", phandle, whid, bhid)
+
+	i.memory.PutUint32(1, int64(is_done_out))
 	i.memory.PutUint32(uint32(whid), int64(wh_out))
 	i.memory.PutUint32(uint32(bhid), int64(bh_out))
 
 	return XqdStatusOK
 }
+
+func (i *Instance) xqd_pending_req_select(phandles_addr int32, phandles_len int32, done_idx_out int32, wh_out int32, bh_out int32) int32 {
+	if phandles_len <= 0 {
+		i.abilog.Printf("pending_req_select: no pending handles")
+		return XqdErrInvalidArgument
+	}
+	if phandles_addr < 0 || int64(phandles_addr)+int64(phandles_len)*4 > int64(i.memory.Len()) {
+		i.abilog.Printf("pending_req_select: handles out of bounds")
+		return XqdErrInvalidArgument
+	}
+
+	// Build a select case for each of the pending requests, so that we can block until whichever
+	// one finishes first
+	ids := make([]int, phandles_len)
+	cases := make([]reflect.SelectCase, phandles_len, phandles_len+1)
+	for j := range ids {
+		ids[j] = int(i.memory.Uint32(int64(phandles_addr) + int64(j*4)))
+
+		ph := i.pending.Get(ids[j])
+		if ph == nil {
+			i.abilog.Printf("pending_req_select: invalid pending handle=%d", ids[j])
+			return XqdErrInvalidHandle
+		}
+
+		cases[j] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ph.done)}
+	}
+
+	i.abilog.Printf("pending_req_select: handles=%v", ids)
+
+	// Stop waiting if the guest runs into its execution limits
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(i.meter.Context().Done())})
+
+	unblock := i.meter.block()
+	idx, _, _ := reflect.Select(cases)
+	unblock()
+
+	if idx == len(ids) {
+		i.abilog.Printf("pending_req_select: execution limit exceeded")
+		return XqdError
+	}
+	ph := i.pending.Get(ids[idx])
+
+	i.pending.Complete(ids[idx])
+	whid, bhid := i.addResponse(ph.resp)
+
+	i.abilog.Printf("pending_req_select: done=%d response handle=%d body=%d", idx, whid, bhid)
+
+	i.memory.PutUint32(uint32(idx), int64(done_idx_out))
+	i.memory.PutUint32(uint32(whid), int64(wh_out))
+	i.memory.PutUint32(uint32(bhid), int64(bh_out))
+
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_pending_req_wait(phandle int32, wh_out int32, bh_out int32) int32 {
+	ph := i.pending.Get(int(phandle))
+	if ph == nil {
+		i.abilog.Printf("pending_req_wait: invalid pending handle=%d", phandle)
+		return XqdErrInvalidHandle
+	}
+
+	unblock := i.meter.block()
+	select {
+	case <-ph.done:
+	case <-i.meter.Context().Done():
+		unblock()
+		i.abilog.Printf("pending_req_wait: execution limit exceeded")
+		return XqdError
+	}
+	unblock()
+
+	i.pending.Complete(int(phandle))
+	whid, bhid := i.addResponse(ph.resp)
+
+	i.abilog.Printf("pending_req_wait: handle=%d response handle=%d body=%d", phandle, whid, bhid)
+
+	i.memory.PutUint32(uint32(whid), int64(wh_out))
+	i.memory.PutUint32(uint32(bhid), int64(bh_out))
+
+	return XqdStatusOK
+}
+
+// Bits of the config mask passed to register_dynamic_backend, saying which parts of the config are
+// set
+const (
+	dynamicBackendReserved       uint32 = 1 << 0
+	dynamicBackendHostOverride   uint32 = 1 << 1
+	dynamicBackendConnectTimeout uint32 = 1 << 2
+	dynamicBackendFirstByte      uint32 = 1 << 3
+	dynamicBackendBetweenBytes   uint32 = 1 << 4
+	dynamicBackendUseSSL         uint32 = 1 << 5
+	dynamicBackendSSLMinVersion  uint32 = 1 << 6
+	dynamicBackendSSLMaxVersion  uint32 = 1 << 7
+	dynamicBackendCertHostname   uint32 = 1 << 8
+	dynamicBackendCACert         uint32 = 1 << 9
+	dynamicBackendCiphers        uint32 = 1 << 10
+	dynamicBackendSNIHostname    uint32 = 1 << 11
+	dynamicBackendDontPool       uint32 = 1 << 12
+)
+
+// dynamicBackendConfigSize is the size of the config passed to register_dynamic_backend, which ends
+// with the SNI hostname's pointer and length
+const dynamicBackendConfigSize = 60
+
+func (i *Instance) xqd_req_register_dynamic_backend(name_addr int32, name_size int32, target_addr int32, target_size int32, config_mask int32, config_addr int32) int32 {
+	if name_size < 0 || target_size < 0 {
+		return XqdErrInvalidArgument
+	}
+
+	name := make([]byte, name_size)
+	if _, err := i.memory.ReadAt(name, int64(name_addr)); err != nil {
+		return XqdError
+	}
+
+	target := make([]byte, target_size)
+	if _, err := i.memory.ReadAt(target, int64(target_addr)); err != nil {
+		return XqdError
+	}
+
+	b, status := i.dynamicBackendConfig(uint32(config_mask), int64(config_addr))
+	if status != XqdStatusOK {
+		return status
+	}
+
+	b.Name = string(name)
+	b.Target = string(target)
+
+	if err := i.addDynamicBackend(b); err != nil {
+		i.abilog.Printf("register_dynamic_backend: name=%q target=%q failed, %s", b.Name, b.Target, err.Error())
+		if err == ErrDynamicBackendsDisabled {
+			return XqdErrUnsupported
+		}
+		return XqdErrInvalidArgument
+	}
+
+	i.abilog.Printf("register_dynamic_backend: name=%q target=%q ssl=%t", b.Name, b.Target, b.UseSSL)
+	return XqdStatusOK
+}
+
+// dynamicBackendConfig reads the parts of a dynamic backend's config which are set in the mask
+func (i *Instance) dynamicBackendConfig(mask uint32, addr int64) (DynamicBackend, int32) {
+	var b DynamicBackend
+
+	if mask&dynamicBackendReserved != 0 {
+		return b, XqdErrInvalidArgument
+	}
+
+	// Nothing is read from the config unless the mask says so, but whatever is read has to be in
+	// memory
+	if mask != 0 && (addr < 0 || addr+dynamicBackendConfigSize > int64(i.memory.Len())) {
+		return b, XqdErrInvalidArgument
+	}
+
+	str := func(offset int64) (string, bool) {
+		ptr, size := int64(i.memory.Uint32(addr+offset)), int64(i.memory.Uint32(addr+offset+4))
+		if ptr+size > int64(i.memory.Len()) {
+			return "", false
+		}
+
+		buf := make([]byte, size)
+		_, err := i.memory.ReadAt(buf, ptr)
+		return string(buf), err == nil
+	}
+	millis := func(offset int64) time.Duration {
+		return time.Duration(i.memory.Uint32(addr+offset)) * time.Millisecond
+	}
+	version := func(offset int64) (uint16, bool) {
+		v, ok := tlsVersions[i.memory.Uint32(addr+offset)]
+		return v, ok
+	}
+
+	ok := true
+	if mask&dynamicBackendHostOverride != 0 {
+		b.HostOverride, ok = str(0)
+	}
+	if mask&dynamicBackendConnectTimeout != 0 {
+		b.ConnectTimeout = millis(8)
+	}
+	if mask&dynamicBackendFirstByte != 0 {
+		b.FirstByteTimeout = millis(12)
+	}
+	if mask&dynamicBackendBetweenBytes != 0 {
+		b.BetweenBytesTimeout = millis(16)
+	}
+	if ok && mask&dynamicBackendSSLMinVersion != 0 {
+		b.SSLMinVersion, ok = version(20)
+	}
+	if ok && mask&dynamicBackendSSLMaxVersion != 0 {
+		b.SSLMaxVersion, ok = version(24)
+	}
+	if ok && mask&dynamicBackendCertHostname != 0 {
+		b.CertHostname, ok = str(28)
+	}
+	if ok && mask&dynamicBackendCACert != 0 {
+		b.CACert, ok = str(36)
+	}
+	if ok && mask&dynamicBackendCiphers != 0 {
+		b.Ciphers, ok = str(44)
+	}
+	if ok && mask&dynamicBackendSNIHostname != 0 {
+		b.SNIHostname, ok = str(52)
+	}
+
+	if !ok {
+		return b, XqdErrInvalidArgument
+	}
+
+	b.UseSSL = mask&dynamicBackendUseSSL != 0
+	b.DontPool = mask&dynamicBackendDontPool != 0
+
+	return b, XqdStatusOK
+}
@@ -0,0 +1,97 @@
+package fastlike_test
+
+import (
+	"encoding/binary"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Khan/fastlike"
+)
+
+// asyncWat sends requests to the "slow" and "fast" backends asynchronously, and collects them with
+// each of the pending_req_* hostcalls. It responds with the results, as a list of i32s.
+var asyncWat = guest(`
+	(import "fastly_http_req" "send_async" (func $send_async (param i32 i32 i32 i32 i32) (result i32)))
+	(import "fastly_http_req" "pending_req_poll" (func $poll (param i32 i32 i32 i32) (result i32)))
+	(import "fastly_http_req" "pending_req_select" (func $select (param i32 i32 i32 i32 i32) (result i32)))
+	(import "fastly_http_req" "pending_req_wait" (func $wait (param i32 i32 i32) (result i32)))
+	(import "fastly_http_resp" "status_get" (func $status_get (param i32 i32) (result i32)))`, `
+	(data (i32.const 1024) "http://slow/")
+	(data (i32.const 1040) "slow")
+	(data (i32.const 1056) "http://fast/")
+	(data (i32.const 1072) "fast")
+	(func $send_to (param $uri i32) (param $backend i32) (param $ph_out i32)
+		(drop (call $send_async (call $request (local.get $uri) (i32.const 12)) (call $body) (local.get $backend) (i32.const 4) (local.get $ph_out))))
+	(func $status (param $resp i32) (result i32)
+		(drop (call $status_get (local.get $resp) (i32.const 60)))
+		(i32.load (i32.const 60)))
+	(func (export "_start")
+		(call $send_to (i32.const 1024) (i32.const 1040) (i32.const 0))
+		(call $send_to (i32.const 1056) (i32.const 1072) (i32.const 4))
+
+		(drop (call $poll (i32.load (i32.const 0)) (i32.const 2048) (i32.const 20) (i32.const 24)))
+
+		(drop (call $select (i32.const 0) (i32.const 2) (i32.const 2052) (i32.const 20) (i32.const 24)))
+		(i32.store (i32.const 2056) (call $status (i32.load (i32.const 20))))
+		(i32.store (i32.const 2060) (call $wait (i32.load (i32.const 4)) (i32.const 20) (i32.const 24)))
+
+		(loop $until_done
+			(drop (call $poll (i32.load (i32.const 0)) (i32.const 2064) (i32.const 20) (i32.const 24)))
+			(br_if $until_done (i32.eqz (i32.load (i32.const 2064)))))
+		(i32.store (i32.const 2068) (call $status (i32.load (i32.const 20))))
+		(i32.store (i32.const 2072) (call $poll (i32.load (i32.const 0)) (i32.const 28) (i32.const 20) (i32.const 24)))
+		(i32.store (i32.const 2076) (call $wait (i32.load (i32.const 0)) (i32.const 20) (i32.const 24)))
+		(i32.store (i32.const 2080) (call $wait (i32.const 99) (i32.const 20) (i32.const 24)))
+
+		(call $send_to (i32.const 1056) (i32.const 1072) (i32.const 8))
+		(i32.store (i32.const 2084) (call $wait (i32.load (i32.const 8)) (i32.const 20) (i32.const 24)))
+		(i32.store (i32.const 2088) (call $status (i32.load (i32.const 20))))
+		(i32.store (i32.const 2092) (call $select (i32.const 0) (i32.const 1) (i32.const 32) (i32.const 20) (i32.const 24)))
+		(i32.store (i32.const 2096) (call $select (i32.const 0) (i32.const -1) (i32.const 32) (i32.const 20) (i32.const 24)))
+		(i32.store (i32.const 2100) (call $select (i32.const 65532) (i32.const 2) (i32.const 32) (i32.const 20) (i32.const 24)))
+
+		(call $respond_with (i32.const 200) (i32.const 2048) (i32.const 56)))`)
+
+func TestAsyncRequests(t *testing.T) {
+	t.Parallel()
+
+	slow := fastlike.WithBackend("slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	fast := fastlike.WithBackend("fast", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	w := serve(newGuest(t, asyncWat, slow, fast))
+	if w.Code != http.StatusOK || w.Body.Len() != 56 {
+		t.Fatalf("expected the results, got %d %q", w.Code, w.Body.String())
+	}
+
+	actual := make([]int32, 14)
+	binary.Read(w.Body, binary.LittleEndian, actual)
+
+	expected := []int32{
+		0,                              // slow isn't done when polled straight away
+		1,                              // fast is selected first
+		http.StatusAccepted,            // with fast's response
+		fastlike.XqdErrInvalidHandle,   // and can't be waited on again
+		1,                              // slow is done when polled later
+		http.StatusCreated,             // with slow's response
+		fastlike.XqdErrInvalidHandle,   // and can't be polled
+		fastlike.XqdErrInvalidHandle,   // or waited on again
+		fastlike.XqdErrInvalidHandle,   // nor can a handle which never existed
+		fastlike.XqdStatusOK,           // another request to fast can be waited on
+		http.StatusAccepted,            // with fast's response
+		fastlike.XqdErrInvalidHandle,   // and selecting a completed request fails
+		fastlike.XqdErrInvalidArgument, // as does selecting a negative number of requests
+		fastlike.XqdErrInvalidArgument, // or handles which run off the end of memory
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Logf("expected %v, got %v", expected, actual)
+		t.Fail()
+	}
+}
@@ -0,0 +1,94 @@
+package fastlike
+
+// Secrets are never written to the abi log. Guests get a handle to each secret they look up, and
+// only see its value when they ask for the plaintext.
+
+func (i *Instance) xqd_secret_store_open(name_addr int32, name_size int32, handle_out int32) int32 {
+	var buf = make([]byte, name_size)
+	var _, err = i.memory.ReadAt(buf, int64(name_addr))
+	if err != nil {
+		return XqdError
+	}
+
+	var name = string(buf)
+
+	i.abilog.Printf("secret_store_open: name=%s", name)
+
+	handle := i.getSecretStoreHandle(name)
+	if handle == HandleInvalid {
+		i.memory.PutUint32(HandleInvalid, int64(handle_out))
+		return XqdErrNone
+	}
+
+	i.memory.PutUint32(uint32(handle), int64(handle_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_secret_store_get(handle int32, key_addr int32, key_size int32, secret_handle_out int32) int32 {
+	var lookup = i.getSecretStore(int(handle))
+	if lookup == nil {
+		i.abilog.Printf("secret_store_get: invalid handle=%d", handle)
+		return XqdErrInvalidHandle
+	}
+
+	var buf = make([]byte, key_size)
+	var _, err = i.memory.ReadAt(buf, int64(key_addr))
+	if err != nil {
+		return XqdError
+	}
+
+	var key = string(buf)
+
+	value, ok := lookup(key)
+	if !ok {
+		i.abilog.Printf("secret_store_get: handle=%d key=%s not found", handle, key)
+		i.memory.PutUint32(HandleInvalid, int64(secret_handle_out))
+		return XqdErrNone
+	}
+
+	shid := i.secrets.New(value)
+
+	i.abilog.Printf("secret_store_get: handle=%d key=%s secret=%d", handle, key, shid)
+
+	i.memory.PutUint32(uint32(shid), int64(secret_handle_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_secret_store_plaintext(handle int32, addr int32, size int32, nwritten_out int32) int32 {
+	var value = i.secrets.Get(int(handle))
+	if value == nil {
+		i.abilog.Printf("secret_store_plaintext: invalid handle=%d", handle)
+		return XqdErrInvalidHandle
+	}
+
+	i.abilog.Printf("secret_store_plaintext: handle=%d", handle)
+
+	// If the secret doesn't fit, the guest can try again with a bigger buffer
+	if len(value) > int(size) {
+		i.memory.PutUint32(uint32(len(value)), int64(nwritten_out))
+		return XqdErrBufferLength
+	}
+
+	nwritten, err := i.memory.WriteAt(value, int64(addr))
+	if err != nil {
+		return XqdError
+	}
+
+	i.memory.PutUint32(uint32(nwritten), int64(nwritten_out))
+	return XqdStatusOK
+}
+
+func (i *Instance) xqd_secret_store_from_bytes(addr int32, size int32, secret_handle_out int32) int32 {
+	var value = make([]byte, size)
+	var _, err = i.memory.ReadAt(value, int64(addr))
+	if err != nil {
+		return XqdError
+	}
+
+	shid := i.secrets.New(value)
+
+	i.abilog.Printf("secret_store_from_bytes: secret=%d", shid)
+
+	i.memory.PutUint32(uint32(shid), int64(secret_handle_out))
+	return XqdStatusOK
+}
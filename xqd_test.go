@@ -0,0 +1,207 @@
+package fastlike_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Khan/fastlike"
+)
+
+// streamWat streams a response downstream in two chunks, waiting for a response from the "wait"
+// backend in between. Before the second chunk, it tries to send another response downstream and
+// writes the status that returned as "s=<status>". Whatever's given to fmt.Sprintf runs at the end.
+const streamWat = `
+	(data (i32.const 1024) "chunk 1\n")
+	(data (i32.const 1040) "chunk 2\n")
+	(data (i32.const 1056) "s=?\n")
+	(data (i32.const 1072) "http://wait/")
+	(data (i32.const 1088) "wait")
+	(func (export "_start")
+		(local $body i32)
+		(drop (call $resp_new (i32.const 0)))
+		(local.set $body (call $body))
+		(drop (call $body_write (local.get $body) (i32.const 1024) (i32.const 8) (i32.const 0) (i32.const 8)))
+		(drop (call $send_downstream (i32.load (i32.const 0)) (local.get $body) (i32.const 1)))
+		(drop (call $send (call $request (i32.const 1072) (i32.const 12)) (call $body) (i32.const 1088) (i32.const 4) (i32.const 12) (i32.const 16)))
+		(i32.store8 (i32.const 1058) (i32.add (i32.const 48) (call $send_downstream (i32.load (i32.const 0)) (call $body) (i32.const 0))))
+		(drop (call $body_write (local.get $body) (i32.const 1056) (i32.const 4) (i32.const 0) (i32.const 8)))
+		(drop (call $body_write (local.get $body) (i32.const 1040) (i32.const 8) (i32.const 0) (i32.const 8)))
+		(drop (call $close_downstream (local.get $body)))
+		%s)`
+
+// streamRecorder is an http.ResponseWriter which records every status line it's sent, and signals
+// flushed the first time it's flushed with something in its body
+type streamRecorder struct {
+	header   http.Header
+	mu       sync.Mutex
+	body     bytes.Buffer
+	statuses []int
+	flushed  chan struct{}
+	once     sync.Once
+}
+
+// Header implements http.ResponseWriter for a streamRecorder
+func (s *streamRecorder) Header() http.Header {
+	return s.header
+}
+
+// WriteHeader implements http.ResponseWriter for a streamRecorder
+func (s *streamRecorder) WriteHeader(code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses = append(s.statuses, code)
+}
+
+// Write implements http.ResponseWriter for a streamRecorder
+func (s *streamRecorder) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.body.Write(p)
+}
+
+// Flush implements http.Flusher for a streamRecorder
+func (s *streamRecorder) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.body.Len() > 0 {
+		s.once.Do(func() { close(s.flushed) })
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		end  string
+	}{
+		{"finished", ""},
+		{"trap after streaming", "(unreachable)"},
+	}
+
+	for _, c := range cases {
+		w := &streamRecorder{header: http.Header{}, flushed: make(chan struct{})}
+
+		// The guest waits on this backend, which only responds once the first chunk has made it
+		// downstream
+		var streamed bool
+		wait := fastlike.WithBackend("wait", http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+			select {
+			case <-w.flushed:
+				streamed = true
+			case <-time.After(2 * time.Second):
+			}
+		}))
+
+		wat := guest(`(import "env" "xqd_body_close_downstream" (func $close_downstream (param i32) (result i32)))`, fmt.Sprintf(streamWat, c.end))
+		f := newGuest(t, wat, wait)
+
+		r, _ := http.NewRequest("GET", "http://localhost:1337/", nil)
+		f.ServeHTTP(w, r)
+
+		if !streamed {
+			t.Logf("%s: expected the first chunk to be flushed while the guest was running", c.name)
+			t.Fail()
+		}
+
+		// The second attempt at sending a response fails with XqdError, and a trap after streaming
+		// starts is only logged
+		expected := "chunk 1\ns=1\nchunk 2\n"
+		if actual := w.body.String(); actual != expected {
+			t.Logf("%s: expected %q, got %q", c.name, expected, actual)
+			t.Fail()
+		}
+
+		if len(w.statuses) != 1 || w.statuses[0] != http.StatusOK {
+			t.Logf("%s: expected a single 200 status line, got %v", c.name, w.statuses)
+			t.Fail()
+		}
+	}
+}
+
+// downstreamBodyWat reads the whole downstream request body and echoes it back
+var downstreamBodyWat = guest(`
+	(import "fastly_http_req" "body_downstream_get" (func $ds_get (param i32 i32) (result i32)))
+	(import "fastly_http_body" "read" (func $body_read (param i32 i32 i32 i32) (result i32)))`, `
+	(func (export "_start")
+		(local $read i32)
+		(drop (call $ds_get (i32.const 0) (i32.const 4)))
+		(loop $until_done
+			(drop (call $body_read (i32.load (i32.const 4)) (i32.add (i32.const 2048) (local.get $read)) (i32.const 1024) (i32.const 8)))
+			(local.set $read (i32.add (local.get $read) (i32.load (i32.const 8))))
+			(br_if $until_done (i32.load (i32.const 8))))
+		(call $respond_with (i32.const 200) (i32.const 2048) (local.get $read)))`)
+
+// downstreamProxyWat forwards the downstream request, body and all, to the "echo" backend
+var downstreamProxyWat = guest(`(import "fastly_http_req" "body_downstream_get" (func $ds_get (param i32 i32) (result i32)))`, `
+	(data (i32.const 1024) "echo")
+	(func (export "_start")
+		(drop (call $ds_get (i32.const 0) (i32.const 4)))
+		(drop (call $send (i32.load (i32.const 0)) (i32.load (i32.const 4)) (i32.const 1024) (i32.const 4) (i32.const 8) (i32.const 12)))
+		(drop (call $send_downstream (i32.load (i32.const 8)) (i32.load (i32.const 12)) (i32.const 0))))`)
+
+func TestDownstreamBody(t *testing.T) {
+	t.Parallel()
+
+	// echo responds with the body it was sent, and the Content-Length it was sent with
+	echo := fastlike.WithBackend("echo", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("x-content-length", strconv.FormatInt(r.ContentLength, 10))
+		w.Write(body)
+	}))
+
+	cases := []struct {
+		name          string
+		wat           string
+		length        int64
+		max           int64
+		code          int
+		expected      string
+		contentLength string
+	}{
+		{"read", downstreamBodyWat, 5, 0, 200, "hello", ""},
+		{"read at the limit", downstreamBodyWat, -1, 5, 200, "hello", ""},
+		{"read past the limit", downstreamBodyWat, -1, 4, 413, "", ""},
+		{"declared past the limit", downstreamBodyWat, 5, 4, 413, "", ""},
+		{"proxied", downstreamProxyWat, 5, 0, 200, "hello", "5"},
+		{"proxied under the limit", downstreamProxyWat, 5, 10, 200, "hello", "5"},
+		{"proxied past the limit", downstreamProxyWat, -1, 4, 413, "", ""},
+	}
+
+	for _, c := range cases {
+		f := newGuest(t, c.wat, echo, fastlike.WithMaxRequestBodySize(c.max))
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://localhost:1337/", ioutil.NopCloser(strings.NewReader("hello")))
+		r.ContentLength = c.length
+		f.ServeHTTP(w, r)
+
+		if w.Code != c.code {
+			t.Logf("%s: expected %d, got %d %q", c.name, c.code, w.Code, w.Body.String())
+			t.Fail()
+			continue
+		}
+
+		if c.code == http.StatusOK && w.Body.String() != c.expected {
+			t.Logf("%s: expected %q, got %q", c.name, c.expected, w.Body.String())
+			t.Fail()
+		}
+
+		if actual := w.Header().Get("x-content-length"); actual != c.contentLength {
+			t.Logf("%s: expected the subrequest to have a Content-Length of %q, got %q", c.name, c.contentLength, actual)
+			t.Fail()
+		}
+	}
+}